@@ -0,0 +1,623 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveSep separates an archive from the path of a member inside it, as in takeout.zip!/Photos/IMG_1.jpg
+const archiveSep = "!/"
+
+// Archive formats scanned as directories
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar" // plain or gzip-compressed
+)
+
+// tarSidecarMax is the largest sidecar of a tar archive kept in memory for the scan
+const tarSidecarMax = 1 << 20
+
+// errNoRandomAccess is returned when a tar member is read outside of the walk that streams it
+var errNoRandomAccess = errors.New("tar archives can only be read front to back")
+
+// archiveKind returns the format of an archive scanned as a directory, "" for other files
+func archiveKind(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTar
+	}
+	return ""
+}
+
+// splitArchivePath splits takeout.zip!/Photos/IMG_1.jpg into the archive and
+// the member path. The archive itself, takeout.zip!, has member ".".
+func splitArchivePath(p string) (string, string, bool) {
+	if i := strings.Index(p, archiveSep); i >= 0 {
+		return p[:i], p[i+len(archiveSep):], true
+	}
+	if archive := strings.TrimSuffix(p, "!"); archive != p && archiveKind(archive) != "" {
+		return archive, ".", true
+	}
+	return "", "", false
+}
+
+// isArchiveMember reports whether a source path points into an archive
+func isArchiveMember(p string) bool {
+	_, _, ok := splitArchivePath(p)
+	return ok
+}
+
+// archiveRegistry keeps the zip archives being scanned open and knows where
+// the tar members being imported were spooled to
+type archiveRegistry struct {
+	mu      sync.Mutex
+	zips    map[string]*openZip
+	spooled map[string]string    // tar member path -> temp file holding its content
+	tars    map[string]*tarIndex // tar archive -> its listing, while a scan reads it
+}
+
+// tarIndex lists the files of a tar archive by directory and keeps its small
+// sidecars. It is read from the headers before the archive is walked, so that
+// sidecars and Takeout JSON can be matched before their media is streamed.
+type tarIndex struct {
+	dirs  map[string][]os.DirEntry // member directory -> its files
+	infos map[string]os.FileInfo   // member path -> its FileInfo
+	data  map[string][]byte        // member path -> content of a sidecar up to tarSidecarMax
+}
+
+// readTarIndex reads the headers of a tar archive through, keeping the sidecars
+func readTarIndex(archive string) (*tarIndex, error) {
+	c, err := openTar(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	idx := &tarIndex{
+		dirs:  make(map[string][]os.DirEntry),
+		infos: make(map[string]os.FileInfo),
+		data:  make(map[string][]byte),
+	}
+	for {
+		hdr, member, err := c.next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := memberInfo{FileInfo: hdr.FileInfo(), name: path.Base(member)}
+		dir := path.Dir(member)
+		idx.dirs[dir] = append(idx.dirs[dir], fs.FileInfoToDirEntry(info))
+		idx.infos[member] = info
+		if sidecarKind(member) != "" && hdr.Size <= tarSidecarMax {
+			data, err := io.ReadAll(c.tr)
+			if err != nil {
+				return nil, err
+			}
+			idx.data[member] = data
+		}
+	}
+}
+
+// tarIndexOf returns the listing of a tar archive being scanned, or nil
+func (r *archiveRegistry) tarIndexOf(archive string) *tarIndex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tars[archive]
+}
+
+type openZip struct {
+	rc   *zip.ReadCloser
+	refs int
+}
+
+var archives = &archiveRegistry{
+	zips:    make(map[string]*openZip),
+	spooled: make(map[string]string),
+	tars:    make(map[string]*tarIndex),
+}
+
+// zipReader returns the zip archive at path, opening it if no one has it open.
+// release must be called once the reader is no longer used.
+func (r *archiveRegistry) zipReader(archive string) (*zip.Reader, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	z, ok := r.zips[archive]
+	if !ok {
+		rc, err := zip.OpenReader(archive)
+		// Members with names such as ../x are not reachable through the reader's fs.FS
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			return nil, nil, err
+		}
+		z = &openZip{rc: rc}
+		r.zips[archive] = z
+	}
+	z.refs++
+	var once sync.Once
+	return &z.rc.Reader, func() { once.Do(func() { r.releaseZip(archive) }) }, nil
+}
+
+func (r *archiveRegistry) releaseZip(archive string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	z, ok := r.zips[archive]
+	if !ok {
+		return
+	}
+	if z.refs--; z.refs <= 0 {
+		z.rc.Close()
+		delete(r.zips, archive)
+	}
+}
+
+func (r *archiveRegistry) spooledPath(member string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.spooled[member]
+	return p, ok
+}
+
+// scanArchives tracks the archives a scan holds open and the tar members it spooled
+type scanArchives struct {
+	mu       sync.Mutex
+	spoolDir string // created under DestFolder on first use
+	dest     string
+	zips     map[string]func()
+	tars     []string // tar archives indexed for the scan
+}
+
+func newScanArchives(config ProcessingConfig) *scanArchives {
+	return &scanArchives{dest: config.DestFolder, zips: make(map[string]func())}
+}
+
+// holdZip keeps a zip open until the scan ends, so its central directory is read once
+func (a *scanArchives) holdZip(archive string) (*zip.Reader, error) {
+	zr, release, err := archives.zipReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, held := a.zips[archive]; held {
+		release()
+	} else {
+		a.zips[archive] = release
+	}
+	return zr, nil
+}
+
+// indexTar lists a tar archive until the scan ends, unless it already is
+func (a *scanArchives) indexTar(archive string) error {
+	if archives.tarIndexOf(archive) != nil {
+		return nil
+	}
+	idx, err := readTarIndex(archive)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.tars = append(a.tars, archive)
+	a.mu.Unlock()
+	archives.mu.Lock()
+	archives.tars[archive] = idx
+	archives.mu.Unlock()
+	return nil
+}
+
+// spool writes a tar member to a temp file until release is called for it
+func (a *scanArchives) spool(member string, r io.Reader, hdr *tar.Header) error {
+	a.mu.Lock()
+	if a.spoolDir == "" {
+		dir, err := os.MkdirTemp(a.dest, ".photoManager-spool-")
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		a.spoolDir = dir
+	}
+	dir := a.spoolDir
+	a.mu.Unlock()
+
+	f, err := os.CreateTemp(dir, "member-*"+path.Ext(hdr.Name))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The copy in the library takes its mode and times from the spooled file
+	_ = os.Chmod(tmp, hdr.FileInfo().Mode().Perm())
+	_ = os.Chtimes(tmp, hdr.AccessTime, hdr.ModTime)
+
+	archives.mu.Lock()
+	archives.spooled[member] = tmp
+	archives.mu.Unlock()
+	return nil
+}
+
+// release drops the spooled copy of a tar member once it has been recorded
+func (a *scanArchives) release(member string) {
+	if a == nil {
+		return
+	}
+	archives.mu.Lock()
+	tmp, ok := archives.spooled[member]
+	delete(archives.spooled, member)
+	archives.mu.Unlock()
+	if ok {
+		_ = os.Remove(tmp)
+	}
+}
+
+// close releases the zips the scan held and removes its spool directory
+func (a *scanArchives) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, release := range a.zips {
+		release()
+	}
+	a.zips = map[string]func(){}
+	archives.mu.Lock()
+	for _, archive := range a.tars {
+		delete(archives.tars, archive)
+	}
+	archives.mu.Unlock()
+	a.tars = nil
+	if a.spoolDir != "" {
+		_ = os.RemoveAll(a.spoolDir)
+		a.spoolDir = ""
+	}
+}
+
+// tarCursor reads a tar archive, optionally gzip-compressed, front to back
+type tarCursor struct {
+	f  *os.File
+	gz *gzip.Reader
+	tr *tar.Reader
+}
+
+func openTar(archive string) (*tarCursor, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	c := &tarCursor{f: f}
+	var r io.Reader = f
+	if lower := strings.ToLower(archive); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		if c.gz, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = c.gz
+	}
+	c.tr = tar.NewReader(r)
+	return c, nil
+}
+
+// next returns the next regular file of the archive, with its cleaned member
+// path, or io.EOF. Its content is read from c.tr.
+func (c *tarCursor) next() (*tar.Header, string, error) {
+	for {
+		hdr, err := c.tr.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		name := path.Clean(strings.TrimPrefix(filepath.ToSlash(hdr.Name), "/"))
+		if hdr.Typeflag != tar.TypeReg || name == "." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		return hdr, name, nil
+	}
+}
+
+func (c *tarCursor) close() {
+	if c.gz != nil {
+		c.gz.Close()
+	}
+	c.f.Close()
+}
+
+// seek advances to member, which must come later in the archive
+func (c *tarCursor) seek(member string) (*tar.Header, error) {
+	for {
+		hdr, name, err := c.next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: not found in archive", member)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if name == member {
+			return hdr, nil
+		}
+	}
+}
+
+// memberInfo is the FileInfo of an archive member, named after the member
+type memberInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (m memberInfo) Name() string { return m.name }
+
+// walkArchive visits the members of an archive as the files of a directory
+// named after it. Zip members are read in place; a tar can only be read front
+// to back, so it is indexed first and each member is spooled to a temp file
+// just before it is emitted. Member directories go through the directory filters.
+func walkArchive(config ProcessingConfig, archive string, visit func(path string, info os.FileInfo, emit func(path string, info os.FileInfo) error) error, emit func(path string, info os.FileInfo) error) error {
+	skipped := map[string]bool{}
+	skipDir := func(member string) bool {
+		for dir := path.Dir(member); dir != "."; dir = path.Dir(dir) {
+			skip, seen := skipped[dir]
+			if !seen {
+				skip = config.filter.skipDir(archive+archiveSep+dir, archiveDirInfo(path.Base(dir)))
+				skipped[dir] = skip
+			}
+			if skip {
+				return true
+			}
+		}
+		return false
+	}
+
+	fmt.Println("Reading archive", archive)
+	if archiveKind(archive) == ArchiveZip {
+		zr, err := config.archives.holdZip(archive)
+		if err != nil {
+			fmt.Println("skipping archive", archive, ":", err)
+			return nil
+		}
+		return fs.WalkDir(zr, ".", func(member string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || skipDir(member) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			return visit(archive+archiveSep+member, info, emit)
+		})
+	}
+
+	if err := config.archives.indexTar(archive); err != nil {
+		fmt.Println("skipping archive", archive, ":", err)
+		return nil
+	}
+	c, err := openTar(archive)
+	if err != nil {
+		fmt.Println("skipping archive", archive, ":", err)
+		return nil
+	}
+	defer c.close()
+	for {
+		hdr, member, err := c.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fmt.Println("stopped reading archive", archive, ":", err)
+			return nil
+		}
+		if skipDir(member) {
+			continue
+		}
+		p := archive + archiveSep + member
+		info := memberInfo{FileInfo: hdr.FileInfo(), name: path.Base(member)}
+		err = visit(p, info, func(p string, info os.FileInfo) error {
+			if err := config.archives.spool(p, c.tr, hdr); err != nil {
+				fmt.Println("skipping", p, ":", err)
+				return nil
+			}
+			if err := emit(p, info); err != nil {
+				config.archives.release(p)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveDirInfo describes a directory inside an archive for the directory filters
+type archiveDirInfo string
+
+func (d archiveDirInfo) Name() string       { return string(d) }
+func (d archiveDirInfo) Size() int64        { return 0 }
+func (d archiveDirInfo) Mode() os.FileMode  { return os.ModeDir | 0o755 }
+func (d archiveDirInfo) ModTime() time.Time { return time.Time{} }
+func (d archiveDirInfo) IsDir() bool        { return true }
+func (d archiveDirInfo) Sys() interface{}   { return nil }
+
+// openSource opens a source file for reading; it may be a member of an archive
+func openSource(p string) (io.ReadCloser, os.FileInfo, error) {
+	archive, member, ok := splitArchivePath(p)
+	if !ok {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, info, nil
+	}
+	if archiveKind(archive) == ArchiveTar {
+		tmp, ok := archives.spooledPath(p)
+		if !ok {
+			// Sidecars are kept from the index
+			if idx := archives.tarIndexOf(archive); idx != nil {
+				if data, ok := idx.data[member]; ok {
+					return io.NopCloser(bytes.NewReader(data)), idx.infos[member], nil
+				}
+			}
+			return nil, nil, fmt.Errorf("%s: %w", p, errNoRandomAccess)
+		}
+		f, err := os.Open(tmp)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, memberInfo{FileInfo: info, name: path.Base(member)}, nil
+	}
+	zr, release, err := archives.zipReader(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := zr.Open(member)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		release()
+		return nil, nil, err
+	}
+	return &zipMember{File: f, release: release}, info, nil
+}
+
+// zipMember releases its archive when closed
+type zipMember struct {
+	fs.File
+	release func()
+}
+
+func (m *zipMember) Close() error {
+	err := m.File.Close()
+	m.release()
+	return err
+}
+
+// statSource returns the FileInfo of a source file or archive member. Tar
+// members that are not spooled are looked up by reading the archive.
+func statSource(p string) (os.FileInfo, error) {
+	archive, member, ok := splitArchivePath(p)
+	if !ok {
+		return os.Stat(p)
+	}
+	if archiveKind(archive) == ArchiveTar {
+		if _, spooled := archives.spooledPath(p); !spooled {
+			if idx := archives.tarIndexOf(archive); idx != nil {
+				if info, ok := idx.infos[member]; ok {
+					return info, nil
+				}
+				return nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+			}
+			c, err := openTar(archive)
+			if err != nil {
+				return nil, err
+			}
+			defer c.close()
+			hdr, err := c.seek(member)
+			if err != nil {
+				return nil, err
+			}
+			return memberInfo{FileInfo: hdr.FileInfo(), name: path.Base(member)}, nil
+		}
+	}
+	f, info, err := openSource(p)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return info, nil
+}
+
+// readSourceDir lists a source directory, which may be a directory of an
+// archive. Tar archives are only listed while a scan has them indexed.
+func readSourceDir(dir string) ([]os.DirEntry, error) {
+	archive, member, ok := splitArchivePath(dir)
+	if !ok {
+		return os.ReadDir(dir)
+	}
+	if archiveKind(archive) == ArchiveTar {
+		idx := archives.tarIndexOf(archive)
+		if idx == nil {
+			return nil, errNoRandomAccess
+		}
+		entries, ok := idx.dirs[member]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", dir, fs.ErrNotExist)
+		}
+		return entries, nil
+	}
+	zr, release, err := archives.zipReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return fs.ReadDir(zr, member)
+}
+
+// readSourceFile reads a whole source file or archive member
+func readSourceFile(p string) ([]byte, error) {
+	f, _, err := openSource(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// readSourceAt reads len(buf) bytes at off like io.ReaderAt, through throttle
+// if set. Archive members cannot seek and are read up to off.
+func readSourceAt(p string, buf []byte, off int64, throttle *ioThrottle) (int, error) {
+	if !isArchiveMember(p) {
+		f, err := os.Open(p)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		n, err := f.ReadAt(buf, off)
+		if werr := throttle.wait(n); werr != nil {
+			return n, werr
+		}
+		return n, err
+	}
+	f, _, err := openSource(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := throttle.reader(f)
+	if _, err := io.CopyN(io.Discard, r, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
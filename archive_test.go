@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveMembers maps member names to contents
+var archiveMembers = map[string]string{
+	"Trip/IMG_0001.JPG": "first photo",
+	"Trip/IMG_0002.JPG": "second photo",
+}
+
+func writeTestZip(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range archiveMembers {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range archiveMembers {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanArchives(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(*testing.T, string)
+	}{
+		{"photos.zip", writeTestZip},
+		{"photos.tar.gz", writeTestTarGz},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dest := t.TempDir(), t.TempDir()
+			archive := filepath.Join(src, tt.name)
+			tt.write(t, archive)
+
+			st := runTestScan(t, ProcessingConfig{SrcFolder: src, DestFolder: dest, Cleanup: CleanupDelete})
+			if st.Copied != 2 || st.Failed != 0 {
+				t.Errorf("copied %d, failed %d; want 2, 0", st.Copied, st.Failed)
+			}
+			// Members stay in their archive, which is not removed for them
+			if _, err := os.Stat(archive); err != nil {
+				t.Errorf("archive removed by cleanup: %v", err)
+			}
+			db := openTestDB(t, dest)
+			rows, err := db.listOutcomingRows(0, 10, 0, false)
+			if err != nil || len(rows) != 2 {
+				t.Fatalf("%d library files, %v; want 2", len(rows), err)
+			}
+			for _, row := range rows {
+				if archive, _, ok := splitArchivePath(row.SrcPath); !ok || archive != filepath.Join(src, tt.name) {
+					t.Errorf("%s was imported from %s, want a member of the archive", row.DestPath, row.SrcPath)
+				}
+			}
+		})
+	}
+}
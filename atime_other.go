@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileAccessTime returns the file's mtime; access times are not portable here
+func fileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source cleanup modes for ProcessingConfig.Cleanup
+const (
+	CleanupNone   = "none"   // copy only, sources are left untouched
+	CleanupTrash  = "trash"  // move imported sources into a trash folder on the source side
+	CleanupDelete = "delete" // delete imported sources
+)
+
+// defaultTrashRetention is how long trashed sources are kept before being purged
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashDirName is the default trash folder created under SrcFolder
+const trashDirName = ".photoManager-trash"
+
+func (c ProcessingConfig) cleanupMode() string {
+	if c.Cleanup != "" {
+		return c.Cleanup
+	}
+	return CleanupNone
+}
+
+// trashFolder returns the configured trash folder, defaulting to <src>/.photoManager-trash
+func (c ProcessingConfig) trashFolder() string {
+	if c.TrashFolder != "" {
+		return filepath.Clean(c.TrashFolder)
+	}
+	return filepath.Join(c.SrcFolder, trashDirName)
+}
+
+func (c ProcessingConfig) trashRetention() time.Duration {
+	if c.TrashRetention > 0 {
+		return c.TrashRetention
+	}
+	return defaultTrashRetention
+}
+
+func validateCleanupMode(s string) error {
+	switch s {
+	case CleanupNone, CleanupTrash, CleanupDelete:
+		return nil
+	}
+	return fmt.Errorf("unknown cleanup mode %q (expected %s, %s or %s)", s, CleanupNone, CleanupTrash, CleanupDelete)
+}
+
+// cleanupSource removes (or trashes) the source of an imported file.
+// It only acts when an outcoming row exists for the file's hash and the library
+// copy it points to is present with the expected size and content. Returns true
+// if the source was handled.
+func cleanupSource(db *DB, config ProcessingConfig, fileInfo FileInfo) (bool, error) {
+	mode := config.cleanupMode()
+	if mode == CleanupNone || fileInfo.err != nil || fileInfo.hash == "" {
+		return false, nil
+	}
+	// Members stay in their archive; the archive is not removed for them
+	if isArchiveMember(fileInfo.srcPath) {
+		return false, nil
+	}
+
+	_, destPath, exists, err := db.findOutcomingByHash(fileInfo.hash)
+	if err != nil || !exists {
+		return false, err
+	}
+	dstInfo, err := os.Stat(destPath)
+	if err != nil {
+		return false, fmt.Errorf("library copy %s missing, keeping source: %w", destPath, err)
+	}
+	if dstInfo.Size() != fileInfo.size {
+		return false, fmt.Errorf("library copy %s has size %d, expected %d, keeping source", destPath, dstInfo.Size(), fileInfo.size)
+	}
+	// A copy made by this scan was verified while copying; any other library
+	// copy is read back before its source goes
+	if fileInfo.copied || fileInfo.importMethod == "" || destPath != fileInfo.destPath {
+		got, err := readFileHash(destPath, config.throttle())
+		if err != nil {
+			return false, fmt.Errorf("failed to verify library copy %s, keeping source: %w", destPath, err)
+		}
+		if got != fileInfo.hash {
+			return false, fmt.Errorf("library copy %s no longer matches the source, keeping source", destPath)
+		}
+	}
+
+	trashPath := ""
+	if mode == CleanupTrash {
+		trashPath, err = trashTarget(config, fileInfo.srcPath, time.Now())
+		if err != nil {
+			return false, err
+		}
+		if err := ensureDirectory(filepath.Dir(trashPath)); err != nil {
+			return false, err
+		}
+		if err := moveFile(fileInfo.srcPath, trashPath); err != nil {
+			return false, fmt.Errorf("failed to trash %s: %w", fileInfo.srcPath, err)
+		}
+		fmt.Println("trashed source", fileInfo.srcPath, "->", trashPath)
+	} else {
+		if err := os.Remove(fileInfo.srcPath); err != nil {
+			return false, fmt.Errorf("failed to delete %s: %w", fileInfo.srcPath, err)
+		}
+		fmt.Println("deleted source", fileInfo.srcPath)
+	}
+
+	if err := db.insertCleanupRecord(fileInfo.hash, fileInfo.srcPath, mode, trashPath, config.trashExpiry(mode)); err != nil {
+		fmt.Println("failed to log cleanup of", fileInfo.srcPath, ":", err)
+	}
+	_ = db.deleteHashCache(fileInfo.srcPath)
+	return true, nil
+}
+
+// trashTarget maps a source path to <trash>/<YYYY-MM-DD>/<path relative to SrcFolder>
+func trashTarget(config ProcessingConfig, srcPath string, now time.Time) (string, error) {
+	rel, err := filepath.Rel(config.SrcFolder, srcPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(srcPath)
+	}
+	target := filepath.Join(config.trashFolder(), now.Format("2006-01-02"), rel)
+	// Trashed files keep their source names, so only the exact name can clash
+	if !pathExists(target) {
+		return target, nil
+	}
+	// Same file trashed twice on the same day: keep both
+	ext := filepath.Ext(target)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(target, ext), now.UnixNano(), ext), nil
+}
+
+// moveFile renames src to dst, falling back to a verified copy and delete across devices
+func moveFile(src, dst string) error {
+	if err := renameNoReplace(src, dst); err == nil {
+		return nil
+	} else if os.IsExist(err) {
+		return err
+	}
+	hash, err := computeFileHash(src)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(src, dst, hash, nil, 0, nil); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// restoreTrash moves every trashed source that has not been purged back to its original path
+func restoreTrash(db *DB) (int, error) {
+	rows, err := db.listTrashedCleanups(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, r := range rows {
+		if err := ensureDirectory(filepath.Dir(r.SrcPath)); err != nil {
+			fmt.Println("restore failed for", r.SrcPath, ":", err)
+			continue
+		}
+		if err := moveFile(r.TrashPath, r.SrcPath); err != nil {
+			fmt.Println("restore failed for", r.SrcPath, ":", err)
+			continue
+		}
+		if err := db.markCleanupRestored(r.ID); err != nil {
+			return restored, err
+		}
+		fmt.Println("restored", r.TrashPath, "->", r.SrcPath)
+		restored++
+	}
+	return restored, nil
+}
+
+// trashExpiry returns when a source cleaned up with mode may be purged, zero for deletes
+func (c ProcessingConfig) trashExpiry(mode string) time.Time {
+	if mode != CleanupTrash {
+		return time.Time{}
+	}
+	return time.Now().Add(c.trashRetention())
+}
+
+// purgeTrash permanently deletes trashed sources whose retention has passed.
+// Each source keeps the retention of the scan that trashed it; sources logged
+// before retentions were stored are purged after retention.
+func purgeTrash(db *DB, retention time.Duration) (int, error) {
+	now := time.Now()
+	rows, err := db.listExpiredTrash(now, now.Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, r := range rows {
+		if err := os.Remove(r.TrashPath); err != nil && !os.IsNotExist(err) {
+			fmt.Println("purge failed for", r.TrashPath, ":", err)
+			continue
+		}
+		if err := db.markCleanupPurged(r.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// importOne scans a source folder holding a single file and returns its path and library copy
+func importOne(t *testing.T, config ProcessingConfig) (string, string) {
+	t.Helper()
+	src := filepath.Join(config.SrcFolder, "IMG_0001.JPG")
+	if err := os.WriteFile(src, []byte("original content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := computeFileHash(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := runTestScan(t, config); status.Copied != 1 {
+		t.Fatalf("copied %d files, want 1", status.Copied)
+	}
+	db, err := initializeDB(config.DestFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, dest, ok, err := db.findOutcomingByHash(hash)
+	if err != nil || !ok {
+		t.Fatalf("no library copy: %v", err)
+	}
+	return src, dest
+}
+
+func TestCleanupDeletesImportedSource(t *testing.T) {
+	config := ProcessingConfig{SrcFolder: t.TempDir(), DestFolder: t.TempDir(), Cleanup: CleanupDelete}
+	src, dest := importOne(t, config)
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+	if _, err := os.Stat(dest); err != nil {
+		t.Errorf("library copy missing: %v", err)
+	}
+}
+
+func TestCleanupTrashesImportedSource(t *testing.T) {
+	config := ProcessingConfig{SrcFolder: t.TempDir(), DestFolder: t.TempDir(), Cleanup: CleanupTrash, TrashFolder: t.TempDir()}
+	src, _ := importOne(t, config)
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+	trashed, _ := filepath.Glob(filepath.Join(config.TrashFolder, "*", "IMG_0001.JPG"))
+	if len(trashed) != 1 {
+		t.Errorf("trash holds %v, want the source", trashed)
+	}
+}
+
+func TestCleanupKeepsSourceOfAlteredLibraryCopy(t *testing.T) {
+	config := ProcessingConfig{SrcFolder: t.TempDir(), DestFolder: t.TempDir()}
+	src, dest := importOne(t, config)
+
+	// Same size, different content: only the hash tells them apart
+	if err := os.WriteFile(dest, []byte("altered content!"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.Cleanup = CleanupDelete
+	if status := runTestScan(t, config); status.Skipped != 1 {
+		t.Fatalf("skipped %d files, want the duplicate", status.Skipped)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source of an altered library copy was removed: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collision strategies for ProcessingConfig.OnCollision
+const (
+	CollisionSuffix = "suffix" // IMG_0001.JPG -> IMG_0001_1.JPG, IMG_0001_2.JPG, ...
+	CollisionHash   = "hash"   // IMG_0001.JPG -> IMG_0001_<hash:8>.JPG
+	CollisionFail   = "fail"   // leave the file in incoming with an error
+)
+
+// collisionStrategy returns the configured collision strategy, defaulting to suffix
+func (c ProcessingConfig) collisionStrategy() string {
+	if c.OnCollision != "" {
+		return c.OnCollision
+	}
+	return CollisionSuffix
+}
+
+func validateCollisionStrategy(s string) error {
+	switch s {
+	case CollisionSuffix, CollisionHash, CollisionFail:
+		return nil
+	}
+	return fmt.Errorf("unknown collision strategy %q (expected %s, %s or %s)", s, CollisionSuffix, CollisionHash, CollisionFail)
+}
+
+// destReservations remembers destination paths handed out during the current scan
+// so that two workers never pick the same target. Keys are lower-cased so that
+// names differing only by case are treated as colliding. Each destination
+// directory is listed once per scan, so picking names stays linear in its size.
+type destReservations struct {
+	mu    sync.Mutex
+	paths map[string]bool
+	dirs  map[string]map[string]bool // directory -> lower-cased names it held when first listed
+}
+
+func newDestReservations() *destReservations {
+	return &destReservations{paths: make(map[string]bool), dirs: make(map[string]map[string]bool)}
+}
+
+// reserve returns true if path was free (on disk and in this scan) and is now reserved
+func (r *destReservations) reserve(path string) bool {
+	key := strings.ToLower(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paths[key] || r.exists(path) {
+		return false
+	}
+	r.paths[key] = true
+	return true
+}
+
+// exists is destExists against the cached listing of the directory; r.mu must be held.
+// Files appearing later are still caught by name, only their case-variants are not.
+func (r *destReservations) exists(path string) bool {
+	if _, err := os.Lstat(path); err == nil {
+		return true
+	}
+	dir := filepath.Dir(path)
+	names, ok := r.dirs[dir]
+	if !ok {
+		names = make(map[string]bool)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			names[strings.ToLower(e.Name())] = true
+		}
+		r.dirs[dir] = names
+	}
+	return names[strings.ToLower(filepath.Base(path))]
+}
+
+// hold reserves path even though it exists on disk, e.g. a library file being replaced in place
+func (r *destReservations) hold(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths[strings.ToLower(path)] = true
+}
+
+// release gives a reservation back, e.g. when the copy failed
+func (r *destReservations) release(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.paths, strings.ToLower(path))
+}
+
+// destExists reports whether path, or a name differing only by case, exists in its
+// directory. It lists the directory, so it is for one-off checks; scans go through
+// destReservations.
+func destExists(path string) bool {
+	if _, err := os.Lstat(path); err == nil {
+		return true
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	name := filepath.Base(path)
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathExists reports whether path itself exists, without looking for case-variants
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// resolveCollision returns a free destination path for dstPath according to the
+// configured strategy and reserves it. With CollisionFail an error is returned instead.
+func resolveCollision(config ProcessingConfig, reservations *destReservations, dstPath, hash string) (string, error) {
+	if reservations.reserve(dstPath) {
+		return dstPath, nil
+	}
+
+	strategy := config.collisionStrategy()
+	if strategy == CollisionFail {
+		return "", fmt.Errorf("destination %s already exists", dstPath)
+	}
+
+	ext := filepath.Ext(dstPath)
+	base := strings.TrimSuffix(dstPath, ext)
+	if strategy == CollisionHash {
+		short := hash
+		if len(short) > 8 {
+			short = short[:8]
+		}
+		base = base + "_" + short
+		if candidate := base + ext; reservations.reserve(candidate) {
+			return candidate, nil
+		}
+	}
+	for i := 1; ; i++ {
+		if candidate := base + "_" + strconv.Itoa(i) + ext; reservations.reserve(candidate) {
+			return candidate, nil
+		}
+	}
+}
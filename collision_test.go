@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCollision(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		onDisk   []string // files already in the destination folder
+		reserved []string // names handed out earlier in the scan
+		want     []string // names given to successive files named IMG_1.JPG; "" for an error
+	}{
+		{"free", CollisionSuffix, nil, nil, []string{"IMG_1.JPG"}},
+		{"suffix", CollisionSuffix, []string{"IMG_1.JPG"}, nil, []string{"IMG_1_1.JPG", "IMG_1_2.JPG"}},
+		{"suffix skips taken", CollisionSuffix, []string{"IMG_1.JPG", "IMG_1_1.JPG"}, []string{"IMG_1_2.JPG"}, []string{"IMG_1_3.JPG"}},
+		{"case differs", CollisionSuffix, []string{"img_1.jpg"}, nil, []string{"IMG_1_1.JPG"}},
+		{"reserved in this scan", CollisionSuffix, nil, nil, []string{"IMG_1.JPG", "IMG_1_1.JPG", "IMG_1_2.JPG"}},
+		{"hash", CollisionHash, []string{"IMG_1.JPG"}, nil, []string{"IMG_1_abcdef01.JPG", "IMG_1_abcdef01_1.JPG"}},
+		{"fail", CollisionFail, []string{"IMG_1.JPG"}, nil, []string{""}},
+		{"fail on free name", CollisionFail, nil, nil, []string{"IMG_1.JPG", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.onDisk {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dests := newDestReservations()
+			for _, name := range tt.reserved {
+				dests.reserve(filepath.Join(dir, name))
+			}
+			config := ProcessingConfig{OnCollision: tt.strategy}
+			for i, want := range tt.want {
+				got, err := resolveCollision(config, dests, filepath.Join(dir, "IMG_1.JPG"), "abcdef0123456789")
+				if want == "" {
+					if err == nil {
+						t.Errorf("file %d: got %s, want an error", i+1, got)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("file %d: %v", i+1, err)
+				}
+				if got != filepath.Join(dir, want) {
+					t.Errorf("file %d: got %s, want %s", i+1, filepath.Base(got), want)
+				}
+			}
+		})
+	}
+}
+
+func TestDestReservationsRelease(t *testing.T) {
+	dir := t.TempDir()
+	dests := newDestReservations()
+	p := filepath.Join(dir, "IMG_1.JPG")
+	if !dests.reserve(p) {
+		t.Fatal("first reserve failed")
+	}
+	if dests.reserve(filepath.Join(dir, "img_1.jpg")) {
+		t.Error("a name differing by case was reserved twice")
+	}
+	dests.release(p)
+	if !dests.reserve(p) {
+		t.Error("a released name could not be reserved again")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -53,6 +56,84 @@ CREATE TABLE IF NOT EXISTS outcoming (
 	metadata JSON NOT NULL DEFAULT '{}',
 	thumbnail_path TEXT DEFAULT '',
 	tags TEXT
+);
+CREATE TABLE IF NOT EXISTS source_cleanup (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	hash TEXT NOT NULL,
+	src_path TEXT NOT NULL,
+	action TEXT NOT NULL,
+	trash_path TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL,
+	restored_at TEXT,
+	purged_at TEXT
+);
+CREATE TABLE IF NOT EXISTS scan_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	src TEXT NOT NULL,
+	dest TEXT NOT NULL,
+	config JSON NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL,
+	started_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	processed INTEGER NOT NULL DEFAULT 0,
+	last_path TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS scan_run_errors (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id INTEGER NOT NULL,
+	src_path TEXT NOT NULL,
+	error TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_scan_run_errors_run ON scan_run_errors(run_id);
+CREATE TABLE IF NOT EXISTS hash_cache (
+	path TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	mtime INTEGER NOT NULL,
+	inode INTEGER NOT NULL DEFAULT 0,
+	hash TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS duplicate_resolutions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	outcoming_id INTEGER NOT NULL,
+	keeper_id INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	name TEXT NOT NULL,
+	src_path TEXT NOT NULL,
+	dest_path TEXT NOT NULL,
+	trash_path TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_duplicate_resolutions_hash ON duplicate_resolutions(hash);
+CREATE TABLE IF NOT EXISTS stacks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	stack_key TEXT NOT NULL UNIQUE,
+	cover_id INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS attachments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	outcoming_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	src_path TEXT NOT NULL,
+	dest_path TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	size INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL,
+	UNIQUE(outcoming_id, dest_path)
+);
+CREATE TABLE IF NOT EXISTS source_profiles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	src TEXT NOT NULL,
+	filters JSON NOT NULL DEFAULT '{}',
+	layout TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '',
+	mode TEXT NOT NULL DEFAULT 'copy',
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
 );`
 	if _, err := sqlDB.Exec(schema); err != nil {
 		sqlDB.Close()
@@ -86,6 +167,89 @@ CREATE TABLE IF NOT EXISTS outcoming (
 	if tagsCol == 0 {
 		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN tags TEXT`)
 	}
+	// Ensure import_method column exists in outcoming table
+	var methodCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='import_method'`).Scan(&methodCol)
+	if methodCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN import_method TEXT NOT NULL DEFAULT 'copy'`)
+	}
+	// Ensure ledger columns exist in incoming table
+	for _, col := range []struct{ name, ddl string }{
+		{"stage", `ALTER TABLE incoming ADD COLUMN stage TEXT NOT NULL DEFAULT 'hashed'`},
+		{"dest_path", `ALTER TABLE incoming ADD COLUMN dest_path TEXT NOT NULL DEFAULT ''`},
+		{"run_id", `ALTER TABLE incoming ADD COLUMN run_id INTEGER NOT NULL DEFAULT 0`},
+		{"replaces_id", `ALTER TABLE incoming ADD COLUMN replaces_id INTEGER NOT NULL DEFAULT 0`},
+		{"trash_path", `ALTER TABLE incoming ADD COLUMN trash_path TEXT NOT NULL DEFAULT ''`},
+	} {
+		var n int
+		_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('incoming') WHERE name=?`, col.name).Scan(&n)
+		if n == 0 {
+			_, _ = sqlDB.Exec(col.ddl)
+		}
+	}
+	// Ensure totals columns exist in scan_runs table
+	for _, col := range []struct{ name, ddl string }{
+		{"ended_at", `ALTER TABLE scan_runs ADD COLUMN ended_at TEXT NOT NULL DEFAULT ''`},
+		{"found", `ALTER TABLE scan_runs ADD COLUMN found INTEGER NOT NULL DEFAULT 0`},
+		{"copied", `ALTER TABLE scan_runs ADD COLUMN copied INTEGER NOT NULL DEFAULT 0`},
+		{"skipped", `ALTER TABLE scan_runs ADD COLUMN skipped INTEGER NOT NULL DEFAULT 0`},
+		{"filtered", `ALTER TABLE scan_runs ADD COLUMN filtered INTEGER NOT NULL DEFAULT 0`},
+		{"failed", `ALTER TABLE scan_runs ADD COLUMN failed INTEGER NOT NULL DEFAULT 0`},
+		{"bytes", `ALTER TABLE scan_runs ADD COLUMN bytes INTEGER NOT NULL DEFAULT 0`},
+		{"error", `ALTER TABLE scan_runs ADD COLUMN error TEXT NOT NULL DEFAULT ''`},
+		{"owner", `ALTER TABLE scan_runs ADD COLUMN owner TEXT NOT NULL DEFAULT ''`},
+	} {
+		var n int
+		_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('scan_runs') WHERE name=?`, col.name).Scan(&n)
+		if n == 0 {
+			_, _ = sqlDB.Exec(col.ddl)
+		}
+	}
+	// Ensure run_id column exists in outcoming table
+	var runCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='run_id'`).Scan(&runCol)
+	if runCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN run_id INTEGER NOT NULL DEFAULT 0`)
+	}
+	// Ensure partial_hash column exists in outcoming table, and an index for the size prefilter
+	var partialCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='partial_hash'`).Scan(&partialCol)
+	if partialCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN partial_hash TEXT NOT NULL DEFAULT ''`)
+	}
+	_, _ = sqlDB.Exec(`CREATE INDEX IF NOT EXISTS idx_outcoming_size ON outcoming(size)`)
+	// Ensure phash column exists in outcoming table
+	var phashCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='phash'`).Scan(&phashCol)
+	if phashCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN phash TEXT NOT NULL DEFAULT ''`)
+	}
+	// Ensure stack_id column exists in outcoming table
+	var stackCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='stack_id'`).Scan(&stackCol)
+	if stackCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN stack_id INTEGER NOT NULL DEFAULT 0`)
+	}
+	_, _ = sqlDB.Exec(`CREATE INDEX IF NOT EXISTS idx_outcoming_stack ON outcoming(stack_id)`)
+	// Ensure album column exists in outcoming table
+	var albumCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('outcoming') WHERE name='album'`).Scan(&albumCol)
+	if albumCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE outcoming ADD COLUMN album TEXT NOT NULL DEFAULT ''`)
+	}
+	// Ensure expires_at column exists in source_cleanup table
+	var expiresCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('source_cleanup') WHERE name='expires_at'`).Scan(&expiresCol)
+	if expiresCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE source_cleanup ADD COLUMN expires_at TEXT NOT NULL DEFAULT ''`)
+	}
+	// Ensure reason column exists in duplicate_resolutions table
+	var reasonCol int
+	_ = sqlDB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('duplicate_resolutions') WHERE name='reason'`).Scan(&reasonCol)
+	if reasonCol == 0 {
+		_, _ = sqlDB.Exec(`ALTER TABLE duplicate_resolutions ADD COLUMN reason TEXT NOT NULL DEFAULT 'duplicate'`)
+	}
+	_, _ = sqlDB.Exec(`CREATE INDEX IF NOT EXISTS idx_duplicate_resolutions_keeper ON duplicate_resolutions(keeper_id)`)
 	// Best-effort unique indexes on hash (ignore errors if duplicates exist)
 	_, _ = sqlDB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_incoming_hash ON incoming(hash)`)
 	_, _ = sqlDB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_outcoming_hash ON outcoming(hash)`)
@@ -104,27 +268,113 @@ SELECT name, size, modified_at, src_path, dest_path, copied_at, '' FROM files;
 	return db, nil
 }
 
+// clearedTables are the tables -clear-db empties. Scan history, source
+// cleanup, duplicate resolutions, profiles and the hash cache are kept.
+var clearedTables = []string{"incoming", "outcoming", "stacks", "attachments"}
+
 func (db *DB) clearDBTables() error {
-	if _, err := db.Exec(`DELETE FROM incoming`); err != nil {
-		return err
-	}
-	if _, err := db.Exec(`DELETE FROM outcoming`); err != nil {
-		return err
+	for _, table := range clearedTables {
+		if _, err := db.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// insertCleanupRecord logs a cleaned up source. A trashed source is purged
+// once expiresAt has passed; a zero expiresAt is used for deletes.
+func (db *DB) insertCleanupRecord(hash, srcPath, action, trashPath string, expiresAt time.Time) error {
+	expires := ""
+	if !expiresAt.IsZero() {
+		expires = expiresAt.UTC().Format(time.RFC3339)
+	}
+	_, err := db.Exec(`INSERT INTO source_cleanup (hash, src_path, action, trash_path, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		hash, srcPath, action, trashPath, time.Now().Format(time.RFC3339), expires)
+	return err
+}
+
+type CleanupRow struct {
+	ID        int64  `json:"id"`
+	Hash      string `json:"hash"`
+	SrcPath   string `json:"srcPath"`
+	Action    string `json:"action"`
+	TrashPath string `json:"trashPath"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// listTrashedCleanups returns trashed sources that are neither restored nor purged.
+// If before is non-zero only entries trashed before that time are returned.
+func (db *DB) listTrashedCleanups(before time.Time) ([]CleanupRow, error) {
+	query := `SELECT id, hash, src_path, action, trash_path, created_at FROM source_cleanup WHERE action = 'trash' AND restored_at IS NULL AND purged_at IS NULL`
+	var args []interface{}
+	if !before.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, before.Format(time.RFC3339))
+	}
+	return db.scanCleanupRows(db.Query(query+` ORDER BY id`, args...))
+}
+
+// listExpiredTrash returns trashed sources whose retention has passed by now.
+// Entries logged before expiry times were stored use legacyBefore instead.
+func (db *DB) listExpiredTrash(now, legacyBefore time.Time) ([]CleanupRow, error) {
+	return db.scanCleanupRows(db.Query(`SELECT id, hash, src_path, action, trash_path, created_at FROM source_cleanup
+WHERE action = 'trash' AND restored_at IS NULL AND purged_at IS NULL
+AND ((expires_at <> '' AND expires_at <= ?) OR (expires_at = '' AND created_at < ?)) ORDER BY id`,
+		now.UTC().Format(time.RFC3339), legacyBefore.Format(time.RFC3339)))
+}
+
+func (db *DB) scanCleanupRows(rows *sql.Rows, err error) ([]CleanupRow, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []CleanupRow
+	for rows.Next() {
+		var r CleanupRow
+		if err := rows.Scan(&r.ID, &r.Hash, &r.SrcPath, &r.Action, &r.TrashPath, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (db *DB) markCleanupRestored(id int64) error {
+	_, err := db.Exec(`UPDATE source_cleanup SET restored_at = ? WHERE id = ?`, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
+func (db *DB) markCleanupPurged(id int64) error {
+	_, err := db.Exec(`UPDATE source_cleanup SET purged_at = ? WHERE id = ?`, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
 func (db *DB) insertIncomingRecord(fi FileInfo) (int64, error) {
+	return db.upsertIncomingStage(fi, stageHashed)
+}
+
+// errIncomingBusy is returned when another file with the same hash is mid-copy
+var errIncomingBusy = errors.New("another file with the same content is being copied")
+
+// upsertIncomingStage writes the ledger row for a file at the given stage.
+// Rows of another file with the same hash that are mid-copy are left alone
+// and errIncomingBusy is returned.
+func (db *DB) upsertIncomingStage(fi FileInfo, stage string) (int64, error) {
 	now := time.Now().Format(time.RFC3339)
 	// Convert copied bool to int (0 or 1)
 	copiedInt := 0
 	if fi.copied {
 		copiedInt = 1
 	}
+	// An upgrade names the library row it replaces, so recovery can finish or undo it
+	var replacesID int64
+	if fi.replaces != nil {
+		replacesID = fi.replaces.id
+	}
 	// Upsert by hash using ON CONFLICT to guarantee single row per hash
-	_, err := db.Exec(
-		`INSERT INTO incoming (hash, name, size, modified_at, src_path, copied, file_type, created_at, updated_at)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	res, err := db.Exec(
+		`INSERT INTO incoming (hash, name, size, modified_at, src_path, copied, file_type, stage, dest_path, run_id, replaces_id, trash_path, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?)
 ON CONFLICT(hash) DO UPDATE SET
   name=excluded.name,
   size=excluded.size,
@@ -132,8 +382,14 @@ ON CONFLICT(hash) DO UPDATE SET
   src_path=excluded.src_path,
   copied=excluded.copied,
   file_type=excluded.file_type,
+  stage=excluded.stage,
+  dest_path=excluded.dest_path,
+  run_id=excluded.run_id,
+  replaces_id=excluded.replaces_id,
+  trash_path='',
   error=NULL,
-  updated_at=excluded.updated_at`,
+  updated_at=excluded.updated_at
+WHERE incoming.stage NOT IN ('copying', 'copied') OR incoming.src_path = excluded.src_path`,
 		fi.hash,
 		fi.name,
 		fi.size,
@@ -141,12 +397,21 @@ ON CONFLICT(hash) DO UPDATE SET
 		fi.srcPath,
 		copiedInt,
 		fi.fileType,
+		stage,
+		fi.destPath,
+		fi.runID,
+		replacesID,
 		now,
 		now,
 	)
 	if err != nil {
 		return 0, err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, errIncomingBusy
+	}
 	// Return the id of the (now) current row for this hash
 	var id int64
 	if err := db.QueryRow(`SELECT id FROM incoming WHERE hash = ?`, fi.hash).Scan(&id); err != nil {
@@ -155,12 +420,269 @@ ON CONFLICT(hash) DO UPDATE SET
 	return id, nil
 }
 
+// setIncomingStage advances a ledger row to the next stage
+func (db *DB) setIncomingStage(id int64, stage string) error {
+	_, err := db.Exec(`UPDATE incoming SET stage=?, updated_at=? WHERE id=?`, stage, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
+// LedgerRow is an incoming row that was mid-flight when its run stopped
+type LedgerRow struct {
+	ID         int64
+	Hash       string
+	SrcPath    string
+	DestPath   string
+	Stage      string
+	ReplacesID int64  // library row an upgrade replaces, 0 for a new file
+	TrashPath  string // where the replaced version is moved to, once chosen
+	FileInfo   FileInfo
+}
+
+// listInFlightIncoming returns rows of a run that are between hashing and being deleted
+func (db *DB) listInFlightIncoming(runID int64) ([]LedgerRow, error) {
+	rows, err := db.Query(`SELECT id, hash, name, size, modified_at, src_path, dest_path, file_type, stage, replaces_id, trash_path FROM incoming WHERE run_id = ? AND stage IN ('copying', 'copied', 'recorded') ORDER BY id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LedgerRow
+	for rows.Next() {
+		var r LedgerRow
+		var modifiedAt string
+		if err := rows.Scan(&r.ID, &r.Hash, &r.FileInfo.name, &r.FileInfo.size, &modifiedAt, &r.SrcPath, &r.DestPath, &r.FileInfo.fileType, &r.Stage, &r.ReplacesID, &r.TrashPath); err != nil {
+			return nil, err
+		}
+		r.FileInfo.modifiedAt, _ = time.Parse(time.RFC3339, modifiedAt)
+		r.FileInfo.modifiedAtStr = r.FileInfo.modifiedAt.Format("2006-January-02")
+		r.FileInfo.hash = r.Hash
+		r.FileInfo.srcPath = r.SrcPath
+		r.FileInfo.destPath = r.DestPath
+		r.FileInfo.tags = []string{}
+		r.FileInfo.runID = runID
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// setIncomingTrashPath records where an upgrade moves the version it replaces, before it is moved
+func (db *DB) setIncomingTrashPath(id int64, trashPath string) error {
+	_, err := db.Exec(`UPDATE incoming SET trash_path=?, updated_at=? WHERE id=?`, trashPath, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
+// deleteRecordedIncoming drops ledger rows of a run whose outcoming row has been written
+func (db *DB) deleteRecordedIncoming(runID int64) error {
+	_, err := db.Exec(`DELETE FROM incoming WHERE run_id = ? AND stage = 'recorded'`, runID)
+	return err
+}
+
+// RunTotals are the counters of a scan run
+type RunTotals struct {
+	Found    int64 `json:"found"`    // files seen by the walk, including filtered ones
+	Copied   int64 `json:"copied"`   // files brought into the library
+	Skipped  int64 `json:"skipped"`  // files already in the library
+	Filtered int64 `json:"filtered"` // files skipped by the scan filters
+	Failed   int64 `json:"failed"`
+	Bytes    int64 `json:"bytes"` // bytes brought into the library
+}
+
+// ScanRunRow is a scan run with its checkpoint and totals
+type ScanRunRow struct {
+	ID        int64     `json:"id"`
+	Src       string    `json:"src"`
+	Dest      string    `json:"dest"`
+	Config    string    `json:"config"`
+	Status    string    `json:"status"`
+	StartedAt string    `json:"startedAt"`
+	UpdatedAt string    `json:"updatedAt"`
+	EndedAt   string    `json:"endedAt"`
+	Processed int64     `json:"processed"`
+	LastPath  string    `json:"lastPath"`
+	Totals    RunTotals `json:"totals"`
+	Error     string    `json:"error"`
+	Owner     string    `json:"owner"` // host:pid of the process that last ran it
+}
+
+// hashCacheKey identifies a version of a source file without reading it
+type hashCacheKey struct {
+	path  string
+	size  int64
+	mtime int64 // UnixNano
+	inode uint64
+}
+
+// lookupHashCache returns the cached hash for key if the file has not changed since it was stored
+func (db *DB) lookupHashCache(key hashCacheKey) (string, bool, error) {
+	var hash string
+	err := db.QueryRow(`SELECT hash FROM hash_cache WHERE path = ? AND size = ? AND mtime = ? AND inode = ?`,
+		key.path, key.size, key.mtime, int64(key.inode)).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+func (db *DB) storeHashCache(key hashCacheKey, hash string) error {
+	_, err := db.Exec(`INSERT INTO hash_cache (path, size, mtime, inode, hash, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(path) DO UPDATE SET size=excluded.size, mtime=excluded.mtime, inode=excluded.inode, hash=excluded.hash, updated_at=excluded.updated_at`,
+		key.path, key.size, key.mtime, int64(key.inode), hash, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// deleteHashCache forgets a source path, e.g. once it has been moved to trash or deleted
+func (db *DB) deleteHashCache(path string) error {
+	_, err := db.Exec(`DELETE FROM hash_cache WHERE path = ?`, path)
+	return err
+}
+
+// ScanRunError is a file that failed during a run
+type ScanRunError struct {
+	SrcPath   string `json:"srcPath"`
+	Error     string `json:"error"`
+	CreatedAt string `json:"createdAt"`
+}
+
+const scanRunColumns = `id, src, dest, config, status, started_at, updated_at, ended_at, processed, last_path, found, copied, skipped, filtered, failed, bytes, error, owner`
+
+func scanScanRun(row interface{ Scan(...interface{}) error }) (ScanRunRow, error) {
+	var r ScanRunRow
+	err := row.Scan(&r.ID, &r.Src, &r.Dest, &r.Config, &r.Status, &r.StartedAt, &r.UpdatedAt, &r.EndedAt, &r.Processed, &r.LastPath,
+		&r.Totals.Found, &r.Totals.Copied, &r.Totals.Skipped, &r.Totals.Filtered, &r.Totals.Failed, &r.Totals.Bytes, &r.Error, &r.Owner)
+	return r, err
+}
+
+func (db *DB) createScanRun(src, dest, configJSON, owner string) (int64, error) {
+	now := time.Now().Format(time.RFC3339)
+	res, err := db.Exec(`INSERT INTO scan_runs (src, dest, config, status, started_at, updated_at, owner) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		src, dest, configJSON, runRunning, now, now, owner)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// checkpointScanRun records that every file up to lastPath (in walk order) is done, with the totals so far
+func (db *DB) checkpointScanRun(id, processed int64, lastPath string, t RunTotals) error {
+	_, err := db.Exec(`UPDATE scan_runs SET processed=?, last_path=?, found=?, copied=?, skipped=?, filtered=?, failed=?, bytes=?, updated_at=? WHERE id=?`,
+		processed, lastPath, t.Found, t.Copied, t.Skipped, t.Filtered, t.Failed, t.Bytes, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
+// reopenScanRun sets an interrupted run running again under owner. It returns
+// false if the run is no longer interrupted, e.g. another process resumed it.
+func (db *DB) reopenScanRun(id int64, owner string) (bool, error) {
+	res, err := db.Exec(`UPDATE scan_runs SET status=?, owner=?, updated_at=? WHERE id=? AND status=?`,
+		runRunning, owner, time.Now().Format(time.RFC3339), id, runInterrupted)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// touchScanRun refreshes the updated_at of a running run, showing its process is alive
+func (db *DB) touchScanRun(id int64) error {
+	_, err := db.Exec(`UPDATE scan_runs SET updated_at=? WHERE id=? AND status=?`, time.Now().Format(time.RFC3339), id, runRunning)
+	return err
+}
+
+func (db *DB) setScanRunStatus(id int64, status string) error {
+	_, err := db.Exec(`UPDATE scan_runs SET status=?, updated_at=? WHERE id=?`, status, time.Now().Format(time.RFC3339), id)
+	return err
+}
+
+// endScanRun stores the final status of a run and the error that stopped it, if any
+func (db *DB) endScanRun(id int64, status, errMsg string) error {
+	now := time.Now().Format(time.RFC3339)
+	_, err := db.Exec(`UPDATE scan_runs SET status=?, error=?, ended_at=?, updated_at=? WHERE id=?`, status, errMsg, now, now, id)
+	return err
+}
+
+func (db *DB) insertScanRunError(runID int64, srcPath, msg string) error {
+	_, err := db.Exec(`INSERT INTO scan_run_errors (run_id, src_path, error, created_at) VALUES (?, ?, ?, ?)`,
+		runID, srcPath, msg, time.Now().Format(time.RFC3339))
+	return err
+}
+
+func (db *DB) listScanRunErrors(runID int64) ([]ScanRunError, error) {
+	rows, err := db.Query(`SELECT src_path, error, created_at FROM scan_run_errors WHERE run_id = ? ORDER BY id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ScanRunError{}
+	for rows.Next() {
+		var e ScanRunError
+		if err := rows.Scan(&e.SrcPath, &e.Error, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// listScanRuns returns the run history, newest first
+func (db *DB) listScanRuns(offset, limit int64) ([]ScanRunRow, error) {
+	rows, err := db.Query(`SELECT `+scanRunColumns+` FROM scan_runs ORDER BY id DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ScanRunRow
+	for rows.Next() {
+		r, err := scanScanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (db *DB) getScanRun(id int64) (*ScanRunRow, error) {
+	r, err := scanScanRun(db.QueryRow(`SELECT `+scanRunColumns+` FROM scan_runs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// listScanRunsByStatus returns runs with one of the given statuses, newest first
+func (db *DB) listScanRunsByStatus(statuses ...string) ([]ScanRunRow, error) {
+	placeholders := make([]string, len(statuses))
+	args := make([]interface{}, len(statuses))
+	for i, st := range statuses {
+		placeholders[i] = "?"
+		args[i] = st
+	}
+	rows, err := db.Query(`SELECT `+scanRunColumns+` FROM scan_runs WHERE status IN (`+strings.Join(placeholders, ",")+`) ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ScanRunRow
+	for rows.Next() {
+		r, err := scanScanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
 func (db *DB) markIncomingFailure(id int64, reason string) error {
 	// Retry logic for SQLITE_BUSY errors
 	maxRetries := 3
 	var err error
 	for i := 0; i < maxRetries; i++ {
-		_, err = db.Exec(`UPDATE incoming SET copied=0, error=?, updated_at=? WHERE id=?`, reason, time.Now().Format(time.RFC3339), id)
+		_, err = db.Exec(`UPDATE incoming SET copied=0, stage=?, error=?, updated_at=? WHERE id=?`, stageFailed, reason, time.Now().Format(time.RFC3339), id)
 		if err == nil {
 			return nil
 		}
@@ -211,7 +733,12 @@ func (db *DB) insertOutcomingRecord(fi FileInfo) (int64, error) {
 		tagsStr = ""
 	}
 
-	stmt := `INSERT INTO outcoming (name, size, modified_at, src_path, dest_path, copied_at, hash, file_type, metadata, thumbnail_path, tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	importMethod := fi.importMethod
+	if importMethod == "" {
+		importMethod = LinkCopy
+	}
+
+	stmt := `INSERT INTO outcoming (name, size, modified_at, src_path, dest_path, copied_at, hash, file_type, metadata, thumbnail_path, tags, import_method, run_id, partial_hash, phash, album) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	res, err := db.Exec(stmt,
 		fi.name,
 		fi.size,
@@ -224,6 +751,11 @@ func (db *DB) insertOutcomingRecord(fi FileInfo) (int64, error) {
 		fi.metadata,
 		fi.thumbnailPath,
 		tagsStr,
+		importMethod,
+		fi.runID,
+		fi.partialHash,
+		fi.phash,
+		fi.album,
 	)
 	if err != nil {
 		return 0, err
@@ -231,10 +763,233 @@ func (db *DB) insertOutcomingRecord(fi FileInfo) (int64, error) {
 	return res.LastInsertId()
 }
 
+// setMissingAlbum sets the album of a library row that has none
+func (db *DB) setMissingAlbum(id int64, album string) error {
+	if album == "" {
+		return nil
+	}
+	_, err := db.Exec(`UPDATE outcoming SET album = ? WHERE id = ? AND album = ''`, album, id)
+	return err
+}
+
+// prefilterCandidate is a library file of a given size
+type prefilterCandidate struct {
+	id          int64
+	hash        string
+	destPath    string
+	partialHash string
+}
+
+func (db *DB) listOutcomingBySize(size int64) ([]prefilterCandidate, error) {
+	rows, err := db.Query(`SELECT id, hash, dest_path, partial_hash FROM outcoming WHERE size = ?`, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []prefilterCandidate
+	for rows.Next() {
+		var c prefilterCandidate
+		if err := rows.Scan(&c.id, &c.hash, &c.destPath, &c.partialHash); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (db *DB) setOutcomingPartialHash(id int64, partial string) error {
+	_, err := db.Exec(`UPDATE outcoming SET partial_hash = ? WHERE id = ?`, partial, id)
+	return err
+}
+
+// listPerceptualHashes returns the perceptual hash of every library image that has one
+func (db *DB) listPerceptualHashes() (map[int64]uint64, error) {
+	rows, err := db.Query(`SELECT id, phash FROM outcoming WHERE phash <> ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]uint64)
+	for rows.Next() {
+		var id int64
+		var s string
+		if err := rows.Scan(&id, &s); err != nil {
+			return nil, err
+		}
+		if h, ok := parsePHash(s); ok {
+			out[id] = h
+		}
+	}
+	return out, rows.Err()
+}
+
+// listOutcomingWithoutPHash returns id -> thumbnail path of images with a thumbnail but no perceptual hash
+func (db *DB) listOutcomingWithoutPHash() (map[int64]string, error) {
+	rows, err := db.Query(`SELECT id, thumbnail_path FROM outcoming WHERE phash = '' AND IFNULL(thumbnail_path,'') <> ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var thumb string
+		if err := rows.Scan(&id, &thumb); err != nil {
+			return nil, err
+		}
+		out[id] = thumb
+	}
+	return out, rows.Err()
+}
+
+func (db *DB) setOutcomingPHash(id int64, phash string) error {
+	_, err := db.Exec(`UPDATE outcoming SET phash = ? WHERE id = ?`, phash, id)
+	return err
+}
+
+// listExactDuplicateIDs returns the ids of library rows sharing a content hash, one slice per hash.
+// The unique index on hash normally prevents this; libraries where it could not be created may have them.
+func (db *DB) listExactDuplicateIDs() ([][]int64, error) {
+	rows, err := db.Query(`SELECT hash, id FROM outcoming WHERE hash IN (SELECT hash FROM outcoming WHERE hash <> '' GROUP BY hash HAVING COUNT(*) > 1) ORDER BY hash, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out [][]int64
+	last := ""
+	for rows.Next() {
+		var hash string
+		var id int64
+		if err := rows.Scan(&hash, &id); err != nil {
+			return nil, err
+		}
+		if hash != last || len(out) == 0 {
+			out = append(out, nil)
+			last = hash
+		}
+		out[len(out)-1] = append(out[len(out)-1], id)
+	}
+	return out, rows.Err()
+}
+
+// listSameContentIDs returns the ids of the library rows with the same content hash as row id, including id
+func (db *DB) listSameContentIDs(id int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM outcoming WHERE hash <> '' AND hash = (SELECT hash FROM outcoming WHERE id = ?) ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []int64
+	for rows.Next() {
+		var other int64
+		if err := rows.Scan(&other); err != nil {
+			return nil, err
+		}
+		out = append(out, other)
+	}
+	return out, rows.Err()
+}
+
+// retireDuplicate records that the library row id was trashed in favour of keeperID and deletes the row.
+// Earlier resolutions that kept id now point at keeperID.
+func (db *DB) retireDuplicate(id, keeperID int64, trashPath string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO duplicate_resolutions (outcoming_id, keeper_id, hash, name, src_path, dest_path, trash_path, tags, created_at)
+SELECT id, ?, hash, name, src_path, dest_path, ?, IFNULL(tags,''), ? FROM outcoming WHERE id = ?`,
+		keeperID, trashPath, time.Now().Format(time.RFC3339), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`UPDATE duplicate_resolutions SET keeper_id = ? WHERE keeper_id = ?`, keeperID, id); err != nil {
+		return err
+	}
+	// Sidecars of the trashed copy stay in the library and now belong to the keeper
+	if _, err := tx.Exec(`UPDATE OR IGNORE attachments SET outcoming_id = ? WHERE outcoming_id = ?`, keeperID, id); err != nil {
+		return err
+	}
+	if err := deleteOutcomingTx(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upgradeOutcomingRecord points library row id at a better copy of its file. The
+// replaced version is kept in duplicate_resolutions with reason "upgrade", so the
+// row keeps its id, tags and run while later scans still skip the old content.
+func (db *DB) upgradeOutcomingRecord(id int64, fi FileInfo, trashPath string) error {
+	importMethod := fi.importMethod
+	if importMethod == "" {
+		importMethod = LinkCopy
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Format(time.RFC3339)
+	res, err := tx.Exec(`INSERT INTO duplicate_resolutions (outcoming_id, keeper_id, hash, name, src_path, dest_path, trash_path, tags, reason, created_at)
+SELECT id, id, hash, name, src_path, dest_path, ?, IFNULL(tags,''), 'upgrade', ? FROM outcoming WHERE id = ?`, trashPath, now, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec(`UPDATE outcoming SET name=?, size=?, modified_at=?, src_path=?, dest_path=?, copied_at=?, hash=?, file_type=?, metadata=?, thumbnail_path=?, import_method=?, partial_hash=?, phash=? WHERE id=?`,
+		fi.name, fi.size, fi.modifiedAt.Format(time.RFC3339), fi.srcPath, fi.destPath, now, fi.hash, fi.fileType,
+		fi.metadata, fi.thumbnailPath, importMethod, fi.partialHash, fi.phash, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplacedVersion is an earlier file of a library row, trashed as a duplicate or replaced by an upgrade
+type ReplacedVersion struct {
+	ID          int64  `json:"id"`
+	OutcomingID int64  `json:"outcomingId"`
+	Reason      string `json:"reason"`
+	Hash        string `json:"hash"`
+	Name        string `json:"name"`
+	SrcPath     string `json:"srcPath"`
+	DestPath    string `json:"destPath"`
+	TrashPath   string `json:"trashPath"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// listReplacedVersions returns the versions folded into library row id, newest first
+func (db *DB) listReplacedVersions(id int64) ([]ReplacedVersion, error) {
+	rows, err := db.Query(`SELECT id, outcoming_id, reason, hash, name, src_path, dest_path, trash_path, created_at FROM duplicate_resolutions WHERE keeper_id = ? ORDER BY id DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ReplacedVersion
+	for rows.Next() {
+		var v ReplacedVersion
+		if err := rows.Scan(&v.ID, &v.OutcomingID, &v.Reason, &v.Hash, &v.Name, &v.SrcPath, &v.DestPath, &v.TrashPath, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
 func (db *DB) findOutcomingByHash(hash string) (int64, string, bool, error) {
 	var id int64
 	var destPath string
 	err := db.QueryRow(`SELECT id, dest_path FROM outcoming WHERE hash = ? LIMIT 1`, hash).Scan(&id, &destPath)
+	if err == sql.ErrNoRows {
+		// A library file trashed as a duplicate is still known through its keeper
+		err = db.QueryRow(`SELECT o.id, o.dest_path FROM duplicate_resolutions d JOIN outcoming o ON o.id = d.keeper_id WHERE d.hash = ? ORDER BY d.id DESC LIMIT 1`, hash).Scan(&id, &destPath)
+	}
 	if err == sql.ErrNoRows {
 		return 0, "", false, nil
 	}
@@ -255,6 +1010,8 @@ type IncomingRow struct {
 	Copied     bool   `json:"copied"`
 	FileType   string `json:"fileType"`
 	Error      string `json:"error"`
+	Stage      string `json:"stage"`
+	RunID      int64  `json:"runId"`
 	UpdatedAt  string `json:"updatedAt"`
 }
 
@@ -270,10 +1027,16 @@ type OutcomingRow struct {
 	Metadata      string   `json:"metadata"`
 	ThumbnailPath string   `json:"thumbnailPath,omitempty"`
 	Tags          []string `json:"tags,omitempty"`
+	Album         string   `json:"album,omitempty"`
+	ImportMethod  string   `json:"importMethod"`
+	RunID         int64    `json:"runId"`
+	PHash         string   `json:"phash"`
+	StackID       int64    `json:"stackId,omitempty"`
+	Stack         *Stack   `json:"stack,omitempty"` // filled in by the API for stacked rows
 }
 
 func (db *DB) listIncomingRows(offset, limit int64) ([]IncomingRow, error) {
-	rows, err := db.Query(`SELECT id, name, size, modified_at, src_path, hash, copied, file_type, IFNULL(error,''), updated_at FROM incoming ORDER BY id LIMIT ? OFFSET ?`, limit, offset)
+	rows, err := db.Query(`SELECT id, name, size, modified_at, src_path, hash, copied, file_type, IFNULL(error,''), stage, run_id, updated_at FROM incoming ORDER BY id LIMIT ? OFFSET ?`, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -282,7 +1045,7 @@ func (db *DB) listIncomingRows(offset, limit int64) ([]IncomingRow, error) {
 	for rows.Next() {
 		var r IncomingRow
 		var copiedInt int
-		if err := rows.Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.Hash, &copiedInt, &r.FileType, &r.Error, &r.UpdatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.Hash, &copiedInt, &r.FileType, &r.Error, &r.Stage, &r.RunID, &r.UpdatedAt); err != nil {
 			return nil, err
 		}
 		r.Copied = copiedInt == 1
@@ -291,8 +1054,11 @@ func (db *DB) listIncomingRows(offset, limit int64) ([]IncomingRow, error) {
 	return out, rows.Err()
 }
 
-func (db *DB) listOutcomingRows(offset, limit int64) ([]OutcomingRow, error) {
-	rows, err := db.Query(`SELECT id, name, size, modified_at, src_path, dest_path, copied_at, file_type, metadata, IFNULL(thumbnail_path,''), IFNULL(tags,'') FROM outcoming ORDER BY id LIMIT ? OFFSET ?`, limit, offset)
+// listOutcomingRows pages through the library; a non-zero runID limits it to files brought in by that run.
+// With coversOnly, stacked files other than the cover of their stack are left out.
+func (db *DB) listOutcomingRows(offset, limit, runID int64, coversOnly bool) ([]OutcomingRow, error) {
+	rows, err := db.Query(`SELECT id, name, size, modified_at, src_path, dest_path, copied_at, file_type, metadata, IFNULL(thumbnail_path,''), IFNULL(tags,''), album, import_method, run_id, phash, stack_id FROM outcoming
+WHERE (? = 0 OR run_id = ?) AND (? = 0 OR stack_id = 0 OR id IN (SELECT cover_id FROM stacks)) ORDER BY id LIMIT ? OFFSET ?`, runID, runID, coversOnly, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -303,7 +1069,7 @@ func (db *DB) listOutcomingRows(offset, limit int64) ([]OutcomingRow, error) {
 		var r OutcomingRow
 		var thumbnailPath string
 		var tagsStr string
-		if err := rows.Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.DestPath, &r.CopiedAt, &r.FileType, &r.Metadata, &thumbnailPath, &tagsStr); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.DestPath, &r.CopiedAt, &r.FileType, &r.Metadata, &thumbnailPath, &tagsStr, &r.Album, &r.ImportMethod, &r.RunID, &r.PHash, &r.StackID); err != nil {
 			return nil, err
 		}
 		// Use stored thumbnail path from database
@@ -325,8 +1091,8 @@ func (db *DB) getOutcomingByIDRow(id int64) (*OutcomingRow, error) {
 	var r OutcomingRow
 	var thumbnailPath string
 	var tagsStr string
-	err := db.QueryRow(`SELECT id, name, size, modified_at, src_path, dest_path, copied_at, file_type, metadata, IFNULL(thumbnail_path,''), IFNULL(tags,'') FROM outcoming WHERE id = ?`, id).
-		Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.DestPath, &r.CopiedAt, &r.FileType, &r.Metadata, &thumbnailPath, &tagsStr)
+	err := db.QueryRow(`SELECT id, name, size, modified_at, src_path, dest_path, copied_at, file_type, metadata, IFNULL(thumbnail_path,''), IFNULL(tags,''), album, import_method, run_id, phash, stack_id FROM outcoming WHERE id = ?`, id).
+		Scan(&r.ID, &r.Name, &r.Size, &r.ModifiedAt, &r.SrcPath, &r.DestPath, &r.CopiedAt, &r.FileType, &r.Metadata, &thumbnailPath, &tagsStr, &r.Album, &r.ImportMethod, &r.RunID, &r.PHash, &r.StackID)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -366,3 +1132,312 @@ func (db *DB) updateTags(id int64, tags []string) error {
 	}
 	return nil
 }
+
+// addTags adds the tags row id does not have yet
+func (db *DB) addTags(id int64, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	row, err := db.getOutcomingByIDRow(id)
+	if err != nil || row == nil {
+		return err
+	}
+	merged := append([]string(nil), row.Tags...)
+	have := map[string]bool{}
+	for _, t := range merged {
+		have[t] = true
+	}
+	for _, t := range tags {
+		if t != "" && !have[t] {
+			have[t] = true
+			merged = append(merged, t)
+		}
+	}
+	if len(merged) == len(row.Tags) {
+		return nil
+	}
+	return db.updateTags(id, merged)
+}
+
+// Stack is a group of library files shown as one item: RAW+JPEG, Live Photo, edited versions
+type Stack struct {
+	ID        int64   `json:"id"`
+	Key       string  `json:"key"`
+	CoverID   int64   `json:"coverId"`
+	MemberIDs []int64 `json:"memberIds"`
+}
+
+// addToStack puts library row id into the stack with the given key, creating
+// the stack if needed. The row becomes the cover if asked to or if the stack has none.
+// Rows that already belong to another stack are left alone.
+func (db *DB) addToStack(key string, id int64, cover bool) error {
+	if _, err := db.Exec(`INSERT OR IGNORE INTO stacks (stack_key, created_at) VALUES (?, ?)`, key, time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	var stackID int64
+	if err := db.QueryRow(`SELECT id FROM stacks WHERE stack_key = ?`, key).Scan(&stackID); err != nil {
+		return err
+	}
+	// A row already stacked elsewhere stays where it is
+	res, err := db.Exec(`UPDATE outcoming SET stack_id = ? WHERE id = ? AND stack_id IN (0, ?)`, stackID, id, stackID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = db.Exec(`UPDATE stacks SET cover_id = ? WHERE id = ? AND (? OR cover_id = 0)`, id, stackID, cover)
+	return err
+}
+
+// stackLibraryDir returns the library folder of a stack that already has members
+func (db *DB) stackLibraryDir(key string) (string, bool, error) {
+	var destPath string
+	err := db.QueryRow(`SELECT o.dest_path FROM stacks s JOIN outcoming o ON o.stack_id = s.id WHERE s.stack_key = ? ORDER BY o.id = s.cover_id DESC, o.id LIMIT 1`, key).Scan(&destPath)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.Dir(destPath), true, nil
+}
+
+// getStack returns a stack with its member ids, or nil
+func (db *DB) getStack(id int64) (*Stack, error) {
+	st := Stack{ID: id, MemberIDs: []int64{}}
+	err := db.QueryRow(`SELECT stack_key, cover_id FROM stacks WHERE id = ?`, id).Scan(&st.Key, &st.CoverID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT id FROM outcoming WHERE stack_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member int64
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		st.MemberIDs = append(st.MemberIDs, member)
+	}
+	return &st, rows.Err()
+}
+
+// setStackCover makes library row coverID the cover of its stack
+func (db *DB) setStackCover(stackID, coverID int64) error {
+	res, err := db.Exec(`UPDATE stacks SET cover_id = ? WHERE id = ? AND EXISTS (SELECT 1 FROM outcoming WHERE id = ? AND stack_id = ?)`, coverID, stackID, coverID, stackID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// deleteOutcomingRow removes a library row. If it was the cover of a stack the
+// oldest remaining member takes over; a stack left empty is dropped.
+func (db *DB) deleteOutcomingRow(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := deleteOutcomingTx(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteOutcomingTx(tx *sql.Tx, id int64) error {
+	var stackID int64
+	if err := tx.QueryRow(`SELECT stack_id FROM outcoming WHERE id = ?`, id).Scan(&stackID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM outcoming WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM attachments WHERE outcoming_id = ?`, id); err != nil {
+		return err
+	}
+	if stackID != 0 {
+		if _, err := tx.Exec(`UPDATE stacks SET cover_id = IFNULL((SELECT MIN(id) FROM outcoming WHERE stack_id = ?), 0) WHERE id = ? AND cover_id = ?`, stackID, stackID, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM stacks WHERE id = ? AND NOT EXISTS (SELECT 1 FROM outcoming WHERE stack_id = ?)`, stackID, stackID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attachment is a sidecar file stored next to a library file
+type Attachment struct {
+	ID          int64  `json:"id"`
+	OutcomingID int64  `json:"outcomingId"`
+	Kind        string `json:"kind"`
+	SrcPath     string `json:"srcPath"`
+	DestPath    string `json:"destPath"`
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+// insertAttachment records a sidecar of library row id. Returns false if it was already attached.
+func (db *DB) insertAttachment(id int64, sc sidecarFile) (bool, error) {
+	res, err := db.Exec(`INSERT OR IGNORE INTO attachments (outcoming_id, kind, src_path, dest_path, hash, size, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, sc.kind, sc.srcPath, sc.destPath, sc.hash, sc.size, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// listAttachments returns the sidecars of library row id
+func (db *DB) listAttachments(id int64) ([]Attachment, error) {
+	rows, err := db.Query(`SELECT id, outcoming_id, kind, src_path, dest_path, hash, size, created_at FROM attachments WHERE outcoming_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.OutcomingID, &a.Kind, &a.SrcPath, &a.DestPath, &a.Hash, &a.Size, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// mergeOutcomingSidecarMetadata adds sidecar metadata to the stored metadata of library row id
+func (db *DB) mergeOutcomingSidecarMetadata(id int64, metas []*SidecarMetadata) error {
+	var metadata sql.NullString
+	if err := db.QueryRow(`SELECT metadata FROM outcoming WHERE id = ?`, id).Scan(&metadata); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE outcoming SET metadata = ? WHERE id = ?`, mergeSidecarMetadata(metadata.String, metas), id)
+	return err
+}
+
+const sourceProfileColumns = `id, name, src, filters, layout, tags, mode, created_at, updated_at`
+
+func scanSourceProfile(row interface{ Scan(...interface{}) error }) (SourceProfile, error) {
+	var p SourceProfile
+	var filters, tags string
+	if err := row.Scan(&p.ID, &p.Name, &p.Src, &filters, &p.Layout, &tags, &p.Mode, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return p, err
+	}
+	_ = json.Unmarshal([]byte(filters), &p.Filters)
+	p.Tags = []string{}
+	if tags != "" {
+		p.Tags = strings.Split(tags, ",")
+	}
+	return p, nil
+}
+
+// listSourceProfiles returns every source profile by name
+func (db *DB) listSourceProfiles() ([]SourceProfile, error) {
+	rows, err := db.Query(`SELECT ` + sourceProfileColumns + ` FROM source_profiles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SourceProfile{}
+	for rows.Next() {
+		p, err := scanSourceProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// getSourceProfile returns a source profile by id, or nil if there is none
+func (db *DB) getSourceProfile(id int64) (*SourceProfile, error) {
+	p, err := scanSourceProfile(db.QueryRow(`SELECT `+sourceProfileColumns+` FROM source_profiles WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getSourceProfileByName returns a source profile by name, or nil if there is none
+func (db *DB) getSourceProfileByName(name string) (*SourceProfile, error) {
+	p, err := scanSourceProfile(db.QueryRow(`SELECT `+sourceProfileColumns+` FROM source_profiles WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// insertSourceProfile stores a new source profile and sets its id and timestamps
+func (db *DB) insertSourceProfile(p *SourceProfile) error {
+	filters, err := json.Marshal(p.Filters)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	res, err := db.Exec(`INSERT INTO source_profiles (name, src, filters, layout, tags, mode, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Name, p.Src, string(filters), p.Layout, strings.Join(p.Tags, ","), p.Mode, now, now)
+	if err != nil {
+		return err
+	}
+	p.ID, err = res.LastInsertId()
+	p.CreatedAt, p.UpdatedAt = now, now
+	return err
+}
+
+// updateSourceProfile replaces the settings of source profile p.ID.
+// Returns sql.ErrNoRows if there is no such profile.
+func (db *DB) updateSourceProfile(p *SourceProfile) error {
+	filters, err := json.Marshal(p.Filters)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	res, err := db.Exec(`UPDATE source_profiles SET name=?, src=?, filters=?, layout=?, tags=?, mode=?, updated_at=? WHERE id=?`,
+		p.Name, p.Src, string(filters), p.Layout, strings.Join(p.Tags, ","), p.Mode, now, p.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	p.UpdatedAt = now
+	return nil
+}
+
+// deleteSourceProfile removes source profile id. Returns sql.ErrNoRows if there is no such profile.
+func (db *DB) deleteSourceProfile(id int64) error {
+	res, err := db.Exec(`DELETE FROM source_profiles WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duplicate group kinds
+const (
+	DupExact = "exact" // same content hash
+	DupNear  = "near"  // perceptual hashes within the Hamming distance
+)
+
+// DuplicateFile is a library file of a duplicate group with the facts used to compare it
+type DuplicateFile struct {
+	OutcomingRow
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	HasExif    bool      `json:"hasExif"`
+	ExifFields int       `json:"exifFields"` // how many of date, make, model, orientation and GPS are set
+	TakenAt    time.Time `json:"takenAt"`    // EXIF capture time, else the file's modification time
+	Distance   int       `json:"distance"`
+}
+
+// DuplicateGroup is a set of library files that are the same picture
+type DuplicateGroup struct {
+	Kind    string          `json:"kind"`
+	Files   []DuplicateFile `json:"files"`
+	Differs []string        `json:"differs"` // resolution, size, exif, date
+	Best    int64           `json:"best"`    // keeper chosen by the keep-best policy
+}
+
+// DuplicateResolution is the outcome of resolving one group
+type DuplicateResolution struct {
+	KeeperID int64              `json:"keeperId"`
+	Trashed  []TrashedDuplicate `json:"trashed"`
+	Tags     []string           `json:"tags"`
+	Errors   []string           `json:"errors,omitempty"`
+}
+
+// TrashedDuplicate is a library file moved to the library trash
+type TrashedDuplicate struct {
+	ID        int64  `json:"id"`
+	DestPath  string `json:"destPath"`
+	TrashPath string `json:"trashPath"`
+}
+
+// describeDuplicate reads the resolution of a library file and summarises its stored EXIF
+func describeDuplicate(row OutcomingRow, distance int) DuplicateFile {
+	f := DuplicateFile{OutcomingRow: row, Distance: distance}
+	if file, _, err := openSource(row.DestPath); err == nil {
+		if cfg, _, err := image.DecodeConfig(file); err == nil {
+			f.Width, f.Height = cfg.Width, cfg.Height
+		}
+		file.Close()
+	}
+	var ed ExifData
+	if json.Unmarshal([]byte(row.Metadata), &ed) == nil {
+		for _, set := range []bool{!ed.DateTimeOriginal.IsZero(), ed.CameraMake != "", ed.CameraModel != "", ed.Orientation != 0, ed.HasLocation} {
+			if set {
+				f.ExifFields++
+			}
+		}
+	}
+	f.HasExif = f.ExifFields > 0
+	f.TakenAt = ed.DateTimeOriginal
+	if f.TakenAt.IsZero() {
+		f.TakenAt, _ = time.Parse(time.RFC3339, row.ModifiedAt)
+	}
+	return f
+}
+
+// keepBetter reports whether a is a better keeper than b: largest resolution,
+// then has EXIF, then earliest date. Larger files and older rows break ties.
+func keepBetter(a, b DuplicateFile) bool {
+	if pa, pb := a.Width*a.Height, b.Width*b.Height; pa != pb {
+		return pa > pb
+	}
+	if a.HasExif != b.HasExif {
+		return a.HasExif
+	}
+	if !a.TakenAt.Equal(b.TakenAt) {
+		return a.TakenAt.Before(b.TakenAt)
+	}
+	if a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.ID < b.ID
+}
+
+// newDuplicateGroup fills in which facts differ and the keep-best choice
+func newDuplicateGroup(kind string, files []DuplicateFile) DuplicateGroup {
+	g := DuplicateGroup{Kind: kind, Files: files, Differs: []string{}}
+	first := files[0]
+	differs := map[string]bool{}
+	best := first
+	for _, f := range files[1:] {
+		if f.Width != first.Width || f.Height != first.Height {
+			differs["resolution"] = true
+		}
+		if f.Size != first.Size {
+			differs["size"] = true
+		}
+		if f.ExifFields != first.ExifFields {
+			differs["exif"] = true
+		}
+		if !f.TakenAt.Equal(first.TakenAt) {
+			differs["date"] = true
+		}
+		if keepBetter(f, best) {
+			best = f
+		}
+	}
+	for _, name := range []string{"resolution", "size", "exif", "date"} {
+		if differs[name] {
+			g.Differs = append(g.Differs, name)
+		}
+	}
+	g.Best = best.ID
+	return g
+}
+
+// groupKey identifies a group by its members, so the same files are not listed twice
+func groupKey(ids []int64) string {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	parts := make([]string, len(sorted))
+	for i, id := range sorted {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// listDuplicateGroups returns exact and/or near duplicate groups of the library.
+// kind is DupExact, DupNear or "" for both; a near group holding exactly the files
+// of an exact group is left out.
+func listDuplicateGroups(db *DB, destFolder, kind string, maxDist int) ([]DuplicateGroup, error) {
+	var groups []DuplicateGroup
+	seen := map[string]bool{}
+	if kind == "" || kind == DupExact {
+		exact, err := db.listExactDuplicateIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ids := range exact {
+			var files []DuplicateFile
+			for _, id := range ids {
+				row, err := db.getOutcomingByIDRow(id)
+				if err != nil {
+					return nil, err
+				}
+				if row != nil {
+					files = append(files, describeDuplicate(*row, 0))
+				}
+			}
+			if len(files) > 1 {
+				groups = append(groups, newDuplicateGroup(DupExact, files))
+				seen[groupKey(ids)] = true
+			}
+		}
+	}
+	if kind == "" || kind == DupNear {
+		near, err := findNearDuplicates(db, destFolder, maxDist)
+		if err != nil {
+			return nil, err
+		}
+		for _, ng := range near {
+			var ids []int64
+			files := make([]DuplicateFile, 0, len(ng.Files))
+			for _, nf := range ng.Files {
+				ids = append(ids, nf.ID)
+				files = append(files, describeDuplicate(nf.OutcomingRow, nf.Distance))
+			}
+			if !seen[groupKey(ids)] {
+				groups = append(groups, newDuplicateGroup(DupNear, files))
+			}
+		}
+	}
+	return groups, nil
+}
+
+// libraryTrashTarget maps a library file to <dest>/.photoManager-trash/<YYYY-MM-DD>/<path relative to dest>
+func libraryTrashTarget(destFolder, destPath string, now time.Time) string {
+	rel, err := filepath.Rel(destFolder, destPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(destPath)
+	}
+	target := filepath.Join(destFolder, trashDirName, now.Format("2006-01-02"), rel)
+	// Trashed files keep their library names, so only the exact name can clash
+	if !pathExists(target) {
+		return target
+	}
+	ext := filepath.Ext(target)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(target, ext), now.UnixNano(), ext)
+}
+
+// errNotDuplicate is returned when a file to resolve is not a duplicate of the keeper
+var errNotDuplicate = errors.New("not a duplicate of the keeper")
+
+// resolveDuplicates keeps keeperID and moves the other library files to the
+// library trash. Every id must share the keeper's content hash or be in its
+// near-duplicate group at maxDist; otherwise nothing is trashed and an error
+// wrapping errNotDuplicate is returned.
+func resolveDuplicates(db *DB, destFolder string, keeperID int64, ids []int64, maxDist int) (*DuplicateResolution, error) {
+	keeper, err := db.getOutcomingByIDRow(keeperID)
+	if err != nil {
+		return nil, err
+	}
+	if keeper == nil {
+		return nil, fmt.Errorf("keeper %d not found", keeperID)
+	}
+	group, err := duplicatesOf(db, destFolder, *keeper, ids, maxDist)
+	if err != nil {
+		return &DuplicateResolution{KeeperID: keeperID, Trashed: []TrashedDuplicate{}}, err
+	}
+	for _, id := range ids {
+		if id != keeperID && !group[id] {
+			return nil, fmt.Errorf("library file %d: %w %d", id, errNotDuplicate, keeperID)
+		}
+	}
+	return trashDuplicates(db, destFolder, keeper, ids)
+}
+
+// duplicatesOf returns the ids among ids that share keeper's content hash or
+// are in its near-duplicate group at maxDist. The near groups are only built
+// when some id is not an exact duplicate.
+func duplicatesOf(db *DB, destFolder string, keeper OutcomingRow, ids []int64, maxDist int) (map[int64]bool, error) {
+	group := map[int64]bool{}
+	same, err := db.listSameContentIDs(keeper.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range same {
+		group[id] = true
+	}
+	complete := true
+	for _, id := range ids {
+		if id != keeper.ID && !group[id] {
+			complete = false
+		}
+	}
+	if complete {
+		return group, nil
+	}
+	near, err := findNearDuplicates(db, destFolder, maxDist)
+	if err != nil {
+		return nil, err
+	}
+	for _, ng := range near {
+		for _, f := range ng.Files {
+			if f.ID != keeper.ID {
+				continue
+			}
+			for _, member := range ng.Files {
+				group[member.ID] = true
+			}
+		}
+	}
+	return group, nil
+}
+
+// trashDuplicates keeps keeper and moves the library files ids to the
+// library trash. Their tags are merged into the keeper and their rows are
+// replaced by duplicate_resolutions entries, so later scans still skip their content.
+func trashDuplicates(db *DB, destFolder string, keeper *OutcomingRow, ids []int64) (*DuplicateResolution, error) {
+	keeperID := keeper.ID
+	res := &DuplicateResolution{KeeperID: keeperID, Trashed: []TrashedDuplicate{}}
+	tags := append([]string(nil), keeper.Tags...)
+	have := map[string]bool{}
+	for _, t := range tags {
+		have[t] = true
+	}
+	for _, id := range ids {
+		if id == keeperID {
+			continue
+		}
+		row, err := db.getOutcomingByIDRow(id)
+		if err != nil {
+			return res, err
+		}
+		if row == nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%d: not found", id))
+			continue
+		}
+		trashPath := ""
+		if destExists(row.DestPath) {
+			trashPath = libraryTrashTarget(destFolder, row.DestPath, time.Now())
+			if err := ensureDirectory(filepath.Dir(trashPath)); err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%d: %v", id, err))
+				continue
+			}
+			if err := moveFile(row.DestPath, trashPath); err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%d: failed to trash %s: %v", id, row.DestPath, err))
+				continue
+			}
+		}
+		if err := db.retireDuplicate(id, keeperID, trashPath); err != nil {
+			return res, err
+		}
+		if row.ThumbnailPath != "" {
+			_ = os.Remove(filepath.Join(destFolder, filepath.FromSlash(row.ThumbnailPath)))
+		}
+		for _, t := range row.Tags {
+			if t != "" && !have[t] {
+				have[t] = true
+				tags = append(tags, t)
+			}
+		}
+		fmt.Println("trashed duplicate", row.DestPath, "->", trashPath, "keeping", keeper.DestPath)
+		res.Trashed = append(res.Trashed, TrashedDuplicate{ID: id, DestPath: row.DestPath, TrashPath: trashPath})
+	}
+	if len(tags) > len(keeper.Tags) {
+		if err := db.updateTags(keeperID, tags); err != nil {
+			return res, err
+		}
+	}
+	res.Tags = tags
+	if res.Tags == nil {
+		res.Tags = []string{}
+	}
+	return res, nil
+}
+
+// autoResolveDuplicates resolves every group of the given kind with the keep-best
+// policy. Exact groups are resolved first so near groups are built from what is left.
+func autoResolveDuplicates(db *DB, destFolder, kind string, maxDist int) ([]DuplicateResolution, error) {
+	out := []DuplicateResolution{}
+	for _, k := range []string{DupExact, DupNear} {
+		if kind != "" && kind != k {
+			continue
+		}
+		groups, err := listDuplicateGroups(db, destFolder, k, maxDist)
+		if err != nil {
+			return out, err
+		}
+		for _, g := range groups {
+			ids := make([]int64, 0, len(g.Files))
+			for _, f := range g.Files {
+				ids = append(ids, f.ID)
+			}
+			keeper, err := db.getOutcomingByIDRow(g.Best)
+			if err != nil {
+				return out, err
+			}
+			if keeper == nil {
+				continue
+			}
+			// The group was just built, so its files need no checking
+			res, err := trashDuplicates(db, destFolder, keeper, ids)
+			if res != nil {
+				out = append(out, *res)
+			}
+			if err != nil {
+				return out, err
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveDuplicatesRefusesOtherFiles(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("content of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runTestScan(t, ProcessingConfig{SrcFolder: src, DestFolder: dest})
+
+	db, err := initializeDB(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.listOutcomingRows(0, 10, 0, false)
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("library rows %d: %v", len(rows), err)
+	}
+	keeper, other := rows[0], rows[1]
+
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(fmt.Sprintf(`{"keeperId": %d, "ids": [%d, %d]}`, keeper.ID, keeper.ID, other.ID))
+	handleResolveDuplicates(rec, httptest.NewRequest(http.MethodPost, "/api/duplicates/resolve", body), db, dest)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	if _, err := os.Stat(other.DestPath); err != nil {
+		t.Errorf("unrelated library file was trashed: %v", err)
+	}
+	if row, err := db.getOutcomingByIDRow(other.ID); err != nil || row == nil {
+		t.Errorf("unrelated library row was retired: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// freeSpace reports nothing; free space is not portable here, so space checks are skipped
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
@@ -27,17 +26,22 @@ func init() {
 // ExtractExif reads common EXIF fields from an image file (pure Go).
 // Supports JPEG and TIFF-based formats with EXIF blocks. Returns best-effort data.
 func ExtractExif(path string) (*ExifData, error) {
-	if _, err := os.Stat(path); err != nil {
+	return readExif(path, nil)
+}
+
+// readExif is ExtractExif reading the file through throttle if set
+func readExif(path string, throttle *ioThrottle) (*ExifData, error) {
+	if _, err := statSource(path); err != nil {
 		return nil, err
 	}
 
-	f, err := os.Open(path)
+	f, _, err := openSource(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	x, err := exif.Decode(f)
+	x, err := exif.Decode(throttle.reader(f))
 	if err != nil {
 		return nil, err
 	}
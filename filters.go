@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ScanFilters decides which files and directories a scan looks at.
+// Patterns are globs matched case-insensitively against the file name and the
+// slash-separated path relative to SrcFolder; a "re:" prefix makes it a regular
+// expression matched against the relative path.
+type ScanFilters struct {
+	Include     []string `json:"include"`     // if set, only matching files are imported
+	Exclude     []string `json:"exclude"`     // matching files are skipped
+	ExcludeDirs []string `json:"excludeDirs"` // matching directories are not descended into
+	MinSize     int64    `json:"minSize"`     // bytes, 0 = no limit
+	MaxSize     int64    `json:"maxSize"`     // bytes, 0 = no limit
+	SkipHidden  bool     `json:"skipHidden"`  // skip dot-files and dot-directories
+	KeepJunk    bool     `json:"keepJunk"`    // disable the built-in junk list
+}
+
+// junkFiles are OS and download leftovers that never belong in a photo library
+var junkFiles = []string{
+	".DS_Store", "._*", "Thumbs.db", "ehthumbs.db", "desktop.ini", "Icon\r", ".localized",
+	"*.part", "*.partial", "*.crdownload", "*.download", "*.tmp", "~$*", ".photoManager-*.tmp",
+}
+
+// junkDirs are OS metadata directories that are pruned from the walk
+var junkDirs = []string{
+	".Trashes", ".Trash", ".Spotlight-V100", ".fseventsd", ".TemporaryItems", ".DocumentRevisions-V100",
+	"$RECYCLE.BIN", "System Volume Information", "@eaDir", ".thumbnails", "__MACOSX",
+}
+
+// scanFilter is the compiled form of ScanFilters
+type scanFilter struct {
+	root        string
+	include     []pathMatcher
+	exclude     []pathMatcher
+	excludeDirs []pathMatcher
+	minSize     int64
+	maxSize     int64
+	skipHidden  bool
+}
+
+// pathMatcher matches a glob or a regular expression
+type pathMatcher struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compilePatterns(patterns []string) ([]pathMatcher, error) {
+	out := make([]pathMatcher, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, "re:") {
+			re, err := regexp.Compile(p[3:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", p, err)
+			}
+			out = append(out, pathMatcher{re: re})
+			continue
+		}
+		glob := strings.ToLower(p)
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", p, err)
+		}
+		out = append(out, pathMatcher{glob: glob})
+	}
+	return out, nil
+}
+
+func (m pathMatcher) match(name, rel string) bool {
+	if m.re != nil {
+		return m.re.MatchString(rel)
+	}
+	if ok, _ := filepath.Match(m.glob, strings.ToLower(name)); ok {
+		return true
+	}
+	ok, _ := filepath.Match(m.glob, strings.ToLower(rel))
+	return ok
+}
+
+func matchAny(matchers []pathMatcher, name, rel string) bool {
+	for _, m := range matchers {
+		if m.match(name, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileFilters validates and compiles the filters for a scan rooted at root
+func compileFilters(root string, f ScanFilters) (*scanFilter, error) {
+	sf := &scanFilter{root: root, minSize: f.MinSize, maxSize: f.MaxSize, skipHidden: f.SkipHidden}
+	if f.MinSize < 0 || f.MaxSize < 0 || (f.MaxSize > 0 && f.MinSize > f.MaxSize) {
+		return nil, fmt.Errorf("invalid size limits: min %d, max %d", f.MinSize, f.MaxSize)
+	}
+	var err error
+	if sf.include, err = compilePatterns(f.Include); err != nil {
+		return nil, err
+	}
+	exclude := f.Exclude
+	excludeDirs := f.ExcludeDirs
+	if !f.KeepJunk {
+		exclude = append(append([]string{}, exclude...), junkFiles...)
+		excludeDirs = append(append([]string{}, excludeDirs...), junkDirs...)
+	}
+	if sf.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	if sf.excludeDirs, err = compilePatterns(excludeDirs); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (f *scanFilter) relPath(path string) string {
+	// Members of an archive passed as the source are relative to the archive
+	if strings.HasPrefix(path, f.root+archiveSep) {
+		return strings.TrimPrefix(path, f.root+archiveSep)
+	}
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// skipDir reports whether the walk should not descend into a directory
+func (f *scanFilter) skipDir(path string, info os.FileInfo) bool {
+	if path == f.root {
+		return false
+	}
+	name := info.Name()
+	if f.skipHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+	return matchAny(f.excludeDirs, name, f.relPath(path))
+}
+
+// skipFile returns a non-empty reason if a regular file should not be imported
+func (f *scanFilter) skipFile(path string, info os.FileInfo) string {
+	if !info.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	name, rel := info.Name(), f.relPath(path)
+	if f.skipHidden && strings.HasPrefix(name, ".") {
+		return "hidden"
+	}
+	if matchAny(f.exclude, name, rel) {
+		return "excluded"
+	}
+	if len(f.include) > 0 && !matchAny(f.include, name, rel) {
+		return "not included"
+	}
+	if f.minSize > 0 && info.Size() < f.minSize {
+		return "smaller than minimum size"
+	}
+	if f.maxSize > 0 && info.Size() > f.maxSize {
+		return "larger than maximum size"
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Folder tagging modes
+const (
+	FolderTagsNone  = ""      // folder names are not used
+	FolderTagsTags  = "tags"  // every folder name becomes a tag
+	FolderTagsAlbum = "album" // the top folder name becomes the album
+	FolderTagsBoth  = "both"  // both of the above
+)
+
+// FolderTags turns the folders a file is in, relative to SrcFolder, into tags
+// or an album: 2015 - Italy trip/Day 2/IMG_1.jpg gives the tags "Italy trip"
+// and "Day 2" and the album "Italy trip".
+type FolderTags struct {
+	Mode      string   `json:"mode"`      // tags, album or both; "" is off
+	Depth     int      `json:"depth"`     // folders used, counted from SrcFolder; 0 = all
+	Stopwords []string `json:"stopwords"` // folder names left out, as case-insensitive globs, on top of the built-in list
+	KeepDates bool     `json:"keepDates"` // keep dates at the start or end of folder names
+}
+
+// folderStopwords are folder names that say nothing about the photos in them,
+// including the 100APPLE, 101MSDCF folders of cameras
+var folderStopwords = []string{
+	"dcim", `re:(?i)^\d{3}[a-z0-9_]{5}$`, "camera", "camera roll", "camera uploads", "photos", "pictures", "images",
+	"videos", "movies", "media", "import*", "export*", "new folder*", "untitled folder*", "misc", "unsorted",
+	"backup*", "google photos", "takeout", "all photos", "screenshots",
+}
+
+// folderDayOrMonth is what is left of 2015/06/12 folders below the year
+var folderDayOrMonth = regexp.MustCompile(`^\d{1,2}$`)
+
+// folderDates match a date a folder name starts or ends with: 2015, 2015-06,
+// 2015_06_12, 20150612, (2015). The separators around it go with it.
+var (
+	folderDatePrefix = regexp.MustCompile(`^\(?(19|20)\d{2}(\d{4}|[-_.](0?[1-9]|1[0-2])([-_.](0?[1-9]|[12]\d|3[01]))?)?\)?([\s\-_.,:]+|$)`)
+	folderDateSuffix = regexp.MustCompile(`(^|[\s\-_.,]+)\(?(19|20)\d{2}(\d{4}|[-_.](0?[1-9]|1[0-2])([-_.](0?[1-9]|[12]\d|3[01]))?)?\)?$`)
+)
+
+// folderTagger is the compiled form of FolderTags
+type folderTagger struct {
+	tags      bool
+	album     bool
+	depth     int
+	stopwords []pathMatcher
+	keepDates bool
+}
+
+// compileFolderTags validates the folder tagging settings; nil when it is off
+func compileFolderTags(f FolderTags) (*folderTagger, error) {
+	t := &folderTagger{depth: f.Depth, keepDates: f.KeepDates}
+	switch f.Mode {
+	case FolderTagsNone:
+		return nil, nil
+	case FolderTagsTags:
+		t.tags = true
+	case FolderTagsAlbum:
+		t.album = true
+	case FolderTagsBoth:
+		t.tags, t.album = true, true
+	default:
+		return nil, fmt.Errorf("invalid folder tags mode %q (want %s, %s or %s)", f.Mode, FolderTagsTags, FolderTagsAlbum, FolderTagsBoth)
+	}
+	if f.Depth < 0 {
+		return nil, fmt.Errorf("invalid folder depth %d", f.Depth)
+	}
+	var err error
+	if t.stopwords, err = compilePatterns(append(append([]string{}, f.Stopwords...), folderStopwords...)); err != nil {
+		return nil, fmt.Errorf("invalid stopword: %w", err)
+	}
+	return t, nil
+}
+
+// names returns the usable folder names of a path relative to the source, top first
+func (t *folderTagger) names(rel string) []string {
+	dir := pathDir(rel)
+	if dir == "." || dir == "" {
+		return nil
+	}
+	segments := strings.Split(dir, "/")
+	if t.depth > 0 && len(segments) > t.depth {
+		segments = segments[:t.depth]
+	}
+	var names []string
+	for _, s := range segments {
+		// An archive counts as the folder it unpacks to
+		if archiveKind(s) != "" {
+			s = strings.TrimSuffix(s, filepath.Ext(s))
+			s = strings.TrimSuffix(s, ".tar")
+		}
+		if name := t.clean(s); name != "" {
+			names = appendMissing(names, name)
+		}
+	}
+	return names
+}
+
+// clean turns a folder name into a tag, "" if there is nothing left of it
+func (t *folderTagger) clean(name string) string {
+	if !t.keepDates {
+		name = folderDatePrefix.ReplaceAllString(name, "")
+		name = folderDateSuffix.ReplaceAllString(name, "")
+		name = folderDayOrMonth.ReplaceAllString(name, "")
+	}
+	// Tags are stored comma-separated
+	name = strings.Join(strings.Fields(strings.ReplaceAll(name, ",", " ")), " ")
+	name = strings.Trim(name, "-_.:")
+	if name == "" || matchAny(t.stopwords, name, name) {
+		return ""
+	}
+	return name
+}
+
+// derive returns the tags and the album the folders of a source file give
+func (t *folderTagger) derive(config ProcessingConfig, path string) ([]string, string) {
+	if t == nil {
+		return nil, ""
+	}
+	rel := filepath.ToSlash(path)
+	if config.filter != nil {
+		rel = config.filter.relPath(path)
+	}
+	names := t.names(rel)
+	if len(names) == 0 {
+		return nil, ""
+	}
+	var tags []string
+	album := ""
+	if t.tags {
+		tags = names
+	}
+	if t.album {
+		album = names[0]
+	}
+	return tags, album
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFolderDateRegexps(t *testing.T) {
+	tests := []struct {
+		name, prefixCut, suffixCut string
+	}{
+		{"2015 - Italy trip", "Italy trip", "2015 - Italy trip"},
+		{"2015-06 Italy", "Italy", "2015-06 Italy"},
+		{"2015_06_12_Italy", "Italy", "2015_06_12_Italy"},
+		{"20150612 Italy", "Italy", "20150612 Italy"},
+		{"(2015) Italy", "Italy", "(2015) Italy"},
+		{"2015.6.1, Italy", "Italy", "2015.6.1, Italy"},
+		{"Italy 2015", "Italy 2015", "Italy"},
+		{"Italy - 2015-06", "Italy - 2015-06", "Italy"},
+		{"Italy (2015)", "Italy (2015)", "Italy"},
+		{"Italy_20150612", "Italy_20150612", "Italy"},
+		{"2015", "", ""},
+		{"2015-06-12", "", ""},
+		// Not dates: other centuries, six digits, months and days out of range, digits inside words
+		{"1850 Italy", "1850 Italy", "1850 Italy"},
+		{"201506 Italy", "201506 Italy", "201506 Italy"},
+		{"Italy 2015-13", "Italy 2015-13", "Italy 2015-13"},
+		{"Italy 2015-06-32", "Italy 2015-06-32", "Italy 2015-06-32"},
+		{"2015Italy", "2015Italy", "2015Italy"},
+		{"Route2015", "Route2015", "Route2015"},
+	}
+	for _, tt := range tests {
+		if got := folderDatePrefix.ReplaceAllString(tt.name, ""); got != tt.prefixCut {
+			t.Errorf("prefix of %q cut to %q, want %q", tt.name, got, tt.prefixCut)
+		}
+		if got := folderDateSuffix.ReplaceAllString(tt.name, ""); got != tt.suffixCut {
+			t.Errorf("suffix of %q cut to %q, want %q", tt.name, got, tt.suffixCut)
+		}
+	}
+}
+
+func TestFolderTaggerNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		tags  FolderTags
+		rel   string
+		names []string
+	}{
+		{"dated trip", FolderTags{Mode: FolderTagsTags}, "2015 - Italy trip/Day 2/IMG_1.jpg", []string{"Italy trip", "Day 2"}},
+		{"date folders dropped", FolderTags{Mode: FolderTagsTags}, "2015/06/12/IMG_1.jpg", nil},
+		{"dates kept", FolderTags{Mode: FolderTagsTags, KeepDates: true}, "2015 - Italy/IMG_1.jpg", []string{"2015 - Italy"}},
+		{"camera folders", FolderTags{Mode: FolderTagsTags}, "Italy/DCIM/100APPLE/IMG_1.jpg", []string{"Italy"}},
+		{"dated camera folder kept", FolderTags{Mode: FolderTagsTags}, "Italy/20150612/IMG_1.jpg", []string{"Italy"}},
+		{"own stopwords", FolderTags{Mode: FolderTagsTags, Stopwords: []string{"to sort*"}}, "To Sort 2/Italy/IMG_1.jpg", []string{"Italy"}},
+		{"depth", FolderTags{Mode: FolderTagsTags, Depth: 1}, "Italy/Day 2/IMG_1.jpg", []string{"Italy"}},
+		{"commas", FolderTags{Mode: FolderTagsTags}, "Rome, Italy/IMG_1.jpg", []string{"Rome Italy"}},
+		{"archive", FolderTags{Mode: FolderTagsTags}, "Italy.tar.gz!/Day 2/IMG_1.jpg", []string{"Italy", "Day 2"}},
+		{"no folder", FolderTags{Mode: FolderTagsTags}, "IMG_1.jpg", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagger, err := compileFolderTags(tt.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tagger.names(tt.rel); !reflect.DeepEqual(got, tt.names) {
+				t.Errorf("names(%q) = %q, want %q", tt.rel, got, tt.names)
+			}
+		})
+	}
+}
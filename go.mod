@@ -1,6 +1,6 @@
 module photoManager
 
-go 1.17
+go 1.20
 
 require (
 	github.com/disintegration/imaging v1.6.2
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func newHashCacheKey(path string, info os.FileInfo) hashCacheKey {
+	return hashCacheKey{
+		path:  path,
+		size:  info.Size(),
+		mtime: info.ModTime().UnixNano(),
+		inode: fileInode(info),
+	}
+}
+
+// cachedHash returns the hash stored in the hash cache if the file's path,
+// size, mtime and inode are unchanged. ForceRehash disables the cache.
+func cachedHash(db *DB, config ProcessingConfig, key hashCacheKey) (string, bool) {
+	if config.ForceRehash {
+		return "", false
+	}
+	hash, ok, err := db.lookupHashCache(key)
+	if err != nil {
+		fmt.Println("hash cache lookup failed for", key.path, ":", err)
+		return "", false
+	}
+	return hash, ok
+}
+
+// rememberHash stores a freshly computed hash; dry-runs never write to the cache
+func rememberHash(db *DB, config ProcessingConfig, key hashCacheKey, hash string) {
+	if config.DryRun {
+		return
+	}
+	if err := db.storeHashCache(key, hash); err != nil {
+		fmt.Println("hash cache update failed for", key.path, ":", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCacheSkipsUnchangedFiles(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("content of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := ProcessingConfig{SrcFolder: src, DestFolder: dest}
+	if st := runTestScan(t, config); st.HashMisses != 2 || st.HashHits != 0 {
+		t.Fatalf("first scan: %d hits, %d misses; want 0, 2", st.HashHits, st.HashMisses)
+	}
+	if st := runTestScan(t, config); st.HashMisses != 0 || st.HashHits != 2 {
+		t.Errorf("unchanged scan: %d hits, %d misses; want 2, 0", st.HashHits, st.HashMisses)
+	}
+
+	// A changed file is read again, whatever its size
+	changed := filepath.Join(src, "IMG_0002.JPG")
+	if err := os.WriteFile(changed, []byte("content of IMG_0003.JPG"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if st := runTestScan(t, config); st.HashMisses != 1 || st.HashHits != 1 || st.Copied != 1 {
+		t.Errorf("after a change: %d hits, %d misses, %d copied; want 1, 1, 1", st.HashHits, st.HashMisses, st.Copied)
+	}
+
+	config.ForceRehash = true
+	if st := runTestScan(t, config); st.HashHits != 0 {
+		t.Errorf("forced rehash: %d hits, want 0", st.HashHits)
+	}
+}
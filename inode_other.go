@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+// fileInode returns 0; inode numbers are not portable here, so the hash cache keys on path, size and mtime only
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
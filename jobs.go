@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job kinds
+const (
+	JobScan   = "scan"    // regular scan of a source folder
+	JobDryRun = "dry-run" // scan that only produces a plan
+	JobPlan   = "plan"    // execution of a reviewed plan
+	JobResume = "resume"  // continuation of an interrupted scan run
+	JobWatch  = "watch"   // batch of files picked up by watch mode
+	JobRouted = "routed"  // files a rule sent here from a scan of another library
+)
+
+// maxFinishedJobs is how many finished jobs are kept for /api/jobs
+const maxFinishedJobs = 100
+
+// errJobCancelled is returned by the walk once a job has been cancelled
+var errJobCancelled = errors.New("cancelled")
+
+// Job is a single scan with its own status. Jobs on the same destination run one at a time.
+type Job struct {
+	ID        int64
+	Kind      string
+	Src       string
+	Dest      string
+	CreatedAt time.Time
+
+	tracker  *scanTracker
+	throttle *ioThrottle // paces the job's copy and hash reads
+	ctx      context.Context
+	cancel   context.CancelFunc
+	run      func(job *Job)
+	done     chan struct{}
+
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed when a paused job is resumed
+}
+
+// JobInfo is the API view of a job
+type JobInfo struct {
+	ID        int64          `json:"id"`
+	Kind      string         `json:"kind"`
+	Src       string         `json:"src"`
+	Dest      string         `json:"dest"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Paused    bool           `json:"paused"`
+	Throttle  ThrottleLimits `json:"throttle"`
+	Status    ScanStatus     `json:"status"`
+}
+
+// Info returns a snapshot of the job
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	paused := j.paused
+	j.mu.Unlock()
+	status := j.tracker.snapshot()
+	status.JobID = j.ID
+	return JobInfo{
+		ID:        j.ID,
+		Kind:      j.Kind,
+		Src:       j.Src,
+		Dest:      j.Dest,
+		CreatedAt: j.CreatedAt,
+		Paused:    paused,
+		Throttle:  j.throttle.Limits(),
+		Status:    status,
+	}
+}
+
+// Done is closed once the job has finished, failed or been cancelled
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// finished reports whether the job has stopped running
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel stops the job. Files already being copied are finished; a queued job never starts.
+func (j *Job) Cancel() {
+	j.cancel()
+	j.setPaused(false)
+}
+
+// SetThrottle changes the read limits of the job; it applies to files already in flight
+func (j *Job) SetThrottle(limits ThrottleLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	j.throttle.set(limits)
+	return nil
+}
+
+// Pause stops handing new files to the workers until Resume is called
+func (j *Job) Pause() {
+	j.setPaused(true)
+}
+
+// Resume continues a paused job
+func (j *Job) Resume() {
+	j.setPaused(false)
+}
+
+func (j *Job) setPaused(paused bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if paused == j.paused {
+		return
+	}
+	j.paused = paused
+	if paused {
+		j.resumed = make(chan struct{})
+	} else {
+		close(j.resumed)
+	}
+	j.tracker.setPaused(paused)
+}
+
+// wait blocks while the job is paused and returns errJobCancelled once it is cancelled
+func (j *Job) wait() error {
+	for {
+		if j.ctx.Err() != nil {
+			return errJobCancelled
+		}
+		j.mu.Lock()
+		paused, resumed := j.paused, j.resumed
+		j.mu.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-j.ctx.Done():
+		}
+	}
+}
+
+// jobKind derives the kind of job a config describes
+func jobKind(config ProcessingConfig) string {
+	switch {
+	case config.DryRun:
+		return JobDryRun
+	case config.executingPlan():
+		return JobPlan
+	case config.runID != 0:
+		return JobResume
+	case config.routedFrom != 0:
+		return JobRouted
+	case config.files != nil:
+		return JobWatch
+	}
+	return JobScan
+}
+
+// jobManager owns every job of this process and the per-destination queues
+type jobManager struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   []*Job
+	queues map[string][]*Job // pending jobs per destination; the head is running
+}
+
+var jobs = &jobManager{queues: make(map[string][]*Job)}
+
+// submit creates a job for config and queues it behind other jobs on the same destination
+func (m *jobManager) submit(config ProcessingConfig, run func(job *Job)) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	job := &Job{
+		ID:        m.nextID,
+		Kind:      jobKind(config),
+		Src:       config.SrcFolder,
+		Dest:      config.DestFolder,
+		CreatedAt: time.Now(),
+		tracker:   newScanTracker(),
+		throttle:  newIOThrottle(ctx, config.Throttle),
+		ctx:       ctx,
+		cancel:    cancel,
+		run:       run,
+		done:      make(chan struct{}),
+	}
+	m.jobs = append(m.jobs, job)
+	m.prune()
+
+	key := filepath.Clean(config.DestFolder)
+	m.queues[key] = append(m.queues[key], job)
+	if len(m.queues[key]) == 1 {
+		go m.drain(key)
+	}
+	return job
+}
+
+// drain runs the jobs queued for a destination one after the other
+func (m *jobManager) drain(key string) {
+	for {
+		m.mu.Lock()
+		queue := m.queues[key]
+		if len(queue) == 0 {
+			delete(m.queues, key)
+			m.mu.Unlock()
+			return
+		}
+		job := queue[0]
+		m.mu.Unlock()
+
+		if job.ctx.Err() != nil {
+			job.tracker.finish(errJobCancelled)
+		} else {
+			job.run(job)
+		}
+		job.cancel()
+		close(job.done)
+
+		m.mu.Lock()
+		m.queues[key] = m.queues[key][1:]
+		m.mu.Unlock()
+	}
+}
+
+// prune drops the oldest finished jobs beyond maxFinishedJobs. Caller holds m.mu.
+func (m *jobManager) prune() {
+	finished := 0
+	for _, j := range m.jobs {
+		if j.finished() {
+			finished++
+		}
+	}
+	if finished <= maxFinishedJobs {
+		return
+	}
+	kept := m.jobs[:0]
+	for _, j := range m.jobs {
+		if finished > maxFinishedJobs && j.finished() {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	m.jobs = kept
+}
+
+// get returns a job by ID, or nil
+func (m *jobManager) get(id int64) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// list returns all known jobs, newest first
+func (m *jobManager) list() []*Job {
+	m.mu.Lock()
+	out := append([]*Job(nil), m.jobs...)
+	m.mu.Unlock()
+	sort.Slice(out, func(a, b int) bool { return out[a].ID > out[b].ID })
+	return out
+}
+
+// latest returns the most recently submitted job, or nil
+func (m *jobManager) latest() *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.jobs) == 0 {
+		return nil
+	}
+	return m.jobs[len(m.jobs)-1]
+}
+
+// latestPlan returns the plan of the most recent finished dry-run, if any
+func (m *jobManager) latestPlan() *ImportPlan {
+	for _, j := range m.list() {
+		if plan := j.tracker.lastPlan(); plan != nil {
+			return plan
+		}
+	}
+	return nil
+}
+
+// cancelAll cancels every queued or running job and waits for them to stop
+func (m *jobManager) cancelAll() {
+	for _, j := range m.list() {
+		j.Cancel()
+	}
+	for _, j := range m.list() {
+		<-j.done
+	}
+}
+
+// String identifies the job in logs
+func (j *Job) String() string {
+	return fmt.Sprintf("job %d (%s %s -> %s)", j.ID, j.Kind, j.Src, j.Dest)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobsQueuePerDestination(t *testing.T) {
+	dest := t.TempDir()
+	release := make(chan struct{})
+	started := make(chan int64, 3)
+	run := func(job *Job) {
+		started <- job.ID
+		<-release
+	}
+	first := jobs.submit(ProcessingConfig{DestFolder: dest}, run)
+	second := jobs.submit(ProcessingConfig{DestFolder: dest}, run)
+	other := jobs.submit(ProcessingConfig{DestFolder: t.TempDir()}, run)
+
+	// The first job of each destination starts; the second waits its turn
+	got := map[int64]bool{<-started: true, <-started: true}
+	if !got[first.ID] || !got[other.ID] {
+		t.Fatalf("started %v, want jobs %d and %d", got, first.ID, other.ID)
+	}
+	select {
+	case id := <-started:
+		t.Fatalf("job %d started while %d was running on the same destination", id, first.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A queued job that is cancelled never runs
+	second.Cancel()
+	close(release)
+	<-first.Done()
+	<-second.Done()
+	<-other.Done()
+	if st := second.tracker.snapshot(); st.Status != "cancelled" {
+		t.Errorf("cancelled queued job ended %q", st.Status)
+	}
+	select {
+	case id := <-started:
+		t.Errorf("job %d ran after being cancelled", id)
+	default:
+	}
+}
+
+func TestJobPauseAndCancel(t *testing.T) {
+	waited := make(chan error)
+	proceed := make(chan struct{})
+	job := jobs.submit(ProcessingConfig{DestFolder: t.TempDir()}, func(job *Job) {
+		job.tracker.begin()
+		for range proceed {
+			waited <- job.wait()
+		}
+	})
+	defer func() {
+		close(proceed)
+		<-job.Done()
+	}()
+
+	proceed <- struct{}{}
+	if err := <-waited; err != nil {
+		t.Fatalf("a running job returned %v", err)
+	}
+
+	job.Pause()
+	proceed <- struct{}{}
+	select {
+	case err := <-waited:
+		t.Fatalf("a paused job went on: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := job.tracker.snapshot(); st.Status != "paused" {
+		t.Errorf("paused job is %q", st.Status)
+	}
+	job.Resume()
+	if err := <-waited; err != nil {
+		t.Fatalf("a resumed job returned %v", err)
+	}
+
+	job.Pause()
+	proceed <- struct{}{}
+	job.Cancel()
+	if err := <-waited; err != errJobCancelled {
+		t.Errorf("a cancelled paused job returned %v, want %v", err, errJobCancelled)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDestTemplate reproduces the original <dest>/<YYYY>/<Month>/<name> layout
+const defaultDestTemplate = "{year}/{monthName}/{name}"
+
+// layoutValues holds everything a destination template can refer to
+type layoutValues struct {
+	date     time.Time
+	name     string
+	fileType string
+	make     string
+	model    string
+	hash     string
+}
+
+// destTemplate returns the configured destination template or the default one
+func (c ProcessingConfig) destTemplate() string {
+	if c.DestTemplate != "" {
+		return c.DestTemplate
+	}
+	return defaultDestTemplate
+}
+
+// captureDate returns EXIF DateTimeOriginal for the source file, falling back to its mtime
+func captureDate(path string, info os.FileInfo) (time.Time, *ExifData) {
+	if isImageExt(strings.ToLower(filepath.Ext(path))) {
+		if ed, err := ExtractExif(path); err == nil && ed != nil {
+			if !ed.DateTimeOriginal.IsZero() {
+				return ed.DateTimeOriginal, ed
+			}
+			return info.ModTime(), ed
+		}
+	}
+	return info.ModTime(), nil
+}
+
+// fileDate returns the capture date the layout files a source file under, with its EXIF if any
+func fileDate(config ProcessingConfig, path string, info os.FileInfo) (time.Time, *ExifData) {
+	date, ed := captureDate(path, info)
+	// Takeout strips or rewrites EXIF dates; its JSON has the real capture time
+	if config.takeout != nil {
+		if gm := config.takeout.metadata(path); gm != nil {
+			if t, ok := gm.takenAt(); ok {
+				date = t.Local()
+			}
+		}
+	}
+	return date, ed
+}
+
+// buildDestPath renders the destination template for a file and joins it onto destFolder
+func buildDestPath(config ProcessingConfig, path string, info os.FileInfo, hash string) (string, error) {
+	date, ed := fileDate(config, path, info)
+	values := layoutValues{
+		date:     date,
+		name:     info.Name(),
+		fileType: getFileType(path),
+		hash:     hash,
+	}
+	if ed != nil {
+		values.make = ed.CameraMake
+		values.model = ed.CameraModel
+	}
+	tmpl := config.destTemplate()
+	// A rule may file it under a subtree of the library
+	if d := config.decisions.get(config, path, info); d != nil && d.Subtree != "" {
+		tmpl = strings.TrimSuffix(filepath.ToSlash(d.Subtree), "/") + "/" + tmpl
+	}
+	rel, err := renderDestTemplate(tmpl, values)
+	if err != nil {
+		return "", err
+	}
+	// Metadata values feed the path too; whatever they hold, it stays in the library
+	dest := filepath.Join(config.DestFolder, rel)
+	if !isLocalPath(rel) || !insideFolder(config.DestFolder, dest) {
+		return "", fmt.Errorf("destination %q of %s is outside the library", rel, path)
+	}
+	return dest, nil
+}
+
+// validateDestTemplate checks that every token in the template is known and
+// that it renders to a path inside the library
+func validateDestTemplate(tmpl string) error {
+	rel, err := renderDestTemplate(tmpl, layoutValues{date: time.Now(), name: "x", hash: "0"})
+	if err != nil {
+		return err
+	}
+	if !isLocalPath(rel) {
+		return fmt.Errorf("template %q must stay inside the library", tmpl)
+	}
+	return nil
+}
+
+// isLocalPath reports whether a relative path stays inside the folder it is joined onto
+func isLocalPath(rel string) bool {
+	if rel == "" || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(filepath.ToSlash(rel), "/") {
+		return false
+	}
+	clean := path.Clean(filepath.ToSlash(rel))
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// insideFolder reports whether p is folder or lies under it
+func insideFolder(folder, p string) bool {
+	rel, err := filepath.Rel(folder, p)
+	return err == nil && (rel == "." || isLocalPath(rel))
+}
+
+// renderDestTemplate expands {token} and {token:arg} placeholders.
+//
+// Supported tokens:
+//
+//	{year} {month} {day} {hour} {minute}  numeric date parts; {month:02} zero-pads to 2 digits
+//	{monthName}                           English month name (January ...)
+//	{name} {base} {ext}                   original file name, name without extension, extension without dot
+//	{type}                                image, video or other
+//	{make} {camera}                       camera make and model ("Unknown" when missing)
+//	{hash:N}                              first N characters of the SHA-256 hash (default 8)
+func renderDestTemplate(tmpl string, v layoutValues) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start == -1 {
+			b.WriteString(tmpl)
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated token in template %q", tmpl)
+		}
+		end += start
+		b.WriteString(tmpl[:start])
+
+		token, arg := tmpl[start+1:end], ""
+		if i := strings.IndexByte(token, ':'); i != -1 {
+			token, arg = token[:i], token[i+1:]
+		}
+		value, err := layoutToken(token, arg, v)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		tmpl = tmpl[end+1:]
+	}
+	return filepath.FromSlash(b.String()), nil
+}
+
+func layoutToken(token, arg string, v layoutValues) (string, error) {
+	switch token {
+	case "year":
+		return padNumber(v.date.Year(), arg)
+	case "month":
+		return padNumber(int(v.date.Month()), arg)
+	case "day":
+		return padNumber(v.date.Day(), arg)
+	case "hour":
+		return padNumber(v.date.Hour(), arg)
+	case "minute":
+		return padNumber(v.date.Minute(), arg)
+	case "monthName":
+		return v.date.Month().String(), nil
+	case "name":
+		return v.name, nil
+	case "base":
+		return strings.TrimSuffix(v.name, filepath.Ext(v.name)), nil
+	case "ext":
+		return strings.TrimPrefix(strings.ToLower(filepath.Ext(v.name)), "."), nil
+	case "type":
+		return v.fileType, nil
+	case "make":
+		return sanitizePathSegment(v.make), nil
+	case "camera":
+		return sanitizePathSegment(v.model), nil
+	case "hash":
+		n := 8
+		if arg != "" {
+			parsed, err := strconv.Atoi(arg)
+			if err != nil || parsed <= 0 {
+				return "", fmt.Errorf("invalid hash length %q", arg)
+			}
+			n = parsed
+		}
+		if n > len(v.hash) {
+			n = len(v.hash)
+		}
+		return v.hash[:n], nil
+	}
+	return "", fmt.Errorf("unknown template token %q", token)
+}
+
+// padNumber formats n zero-padded to the width given in arg (e.g. "02")
+func padNumber(n int, arg string) (string, error) {
+	if arg == "" {
+		return strconv.Itoa(n), nil
+	}
+	width, err := strconv.Atoi(arg)
+	if err != nil || width <= 0 {
+		return "", fmt.Errorf("invalid number width %q", arg)
+	}
+	return fmt.Sprintf("%0*d", width, n), nil
+}
+
+// sanitizePathSegment makes a metadata value safe to use as a single directory name
+func sanitizePathSegment(s string) string {
+	s = strings.TrimSpace(strings.Trim(s, "\x00"))
+	if s == "" {
+		return "Unknown"
+	}
+	s = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(s)
+	if s == "." || s == ".." {
+		return "Unknown"
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderDestTemplate(t *testing.T) {
+	v := layoutValues{
+		date:     time.Date(2019, time.March, 7, 9, 5, 0, 0, time.UTC),
+		name:     "IMG_0001.JPG",
+		fileType: "image",
+		make:     "Canon",
+		model:    "EOS 5D/Mark IV",
+		hash:     "0123456789abcdef",
+	}
+	tests := []struct {
+		tmpl, want string
+	}{
+		{defaultDestTemplate, "2019/March/IMG_0001.JPG"},
+		{"{year}/{month:02}-{monthName}/{day:02}/{name}", "2019/03-March/07/IMG_0001.JPG"},
+		{"{year}{month}{day}_{hour:02}{minute:02}", "201937_0905"},
+		{"{type}/{base}.{ext}", "image/IMG_0001.jpg"},
+		{"{make}/{camera}/{name}", "Canon/EOS 5D_Mark IV/IMG_0001.JPG"},
+		{"{hash}", "01234567"},
+		{"{hash:4}/{name}", "0123/IMG_0001.JPG"},
+		{"{hash:64}", "0123456789abcdef"},
+		{"no tokens", "no tokens"},
+	}
+	for _, tt := range tests {
+		got, err := renderDestTemplate(tt.tmpl, v)
+		if err != nil {
+			t.Errorf("renderDestTemplate(%q): %v", tt.tmpl, err)
+			continue
+		}
+		if want := filepath.FromSlash(tt.want); got != want {
+			t.Errorf("renderDestTemplate(%q) = %q, want %q", tt.tmpl, got, want)
+		}
+	}
+}
+
+func TestRenderDestTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		"{year",
+		"{unknown}",
+		"{hash:0}",
+		"{hash:x}",
+		"{month:-2}",
+	} {
+		if _, err := renderDestTemplate(tmpl, layoutValues{hash: "00"}); err == nil {
+			t.Errorf("renderDestTemplate(%q) succeeded", tmpl)
+		}
+	}
+}
+
+func TestSanitizePathSegment(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "Unknown"},
+		{"  ", "Unknown"},
+		{"Canon\x00", "Canon"},
+		{"a/b\\c:d", "a_b_c_d"},
+		{"..", "Unknown"},
+	}
+	for _, tt := range tests {
+		if got := sanitizePathSegment(tt.in); got != tt.want {
+			t.Errorf("sanitizePathSegment(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDestTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		ok   bool
+	}{
+		{defaultDestTemplate, true},
+		{"{year}/../{name}", true},
+		{"../{name}", false},
+		{"{year}/../../{name}", false},
+		{"/abs/{name}", false},
+		{"{unknown}", false},
+	}
+	for _, tt := range tests {
+		if err := validateDestTemplate(tt.tmpl); (err == nil) != tt.ok {
+			t.Errorf("validateDestTemplate(%q) = %v, want ok %v", tt.tmpl, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Import strategies for ProcessingConfig.LinkMode
+const (
+	LinkCopy     = "copy"     // regular verified copy
+	LinkHardlink = "hardlink" // hard link to the source, same filesystem only
+	LinkReflink  = "reflink"  // copy-on-write clone (FICLONE on Linux btrfs/xfs)
+)
+
+// errReflinkUnsupported is returned by cloneFile on platforms without reflink support
+var errReflinkUnsupported = errors.New("reflink not supported on this platform")
+
+func (c ProcessingConfig) linkMode() string {
+	if c.LinkMode != "" {
+		return c.LinkMode
+	}
+	return LinkCopy
+}
+
+func validateLinkMode(s string) error {
+	switch s {
+	case LinkCopy, LinkHardlink, LinkReflink:
+		return nil
+	}
+	return fmt.Errorf("unknown link mode %q (expected %s, %s or %s)", s, LinkCopy, LinkHardlink, LinkReflink)
+}
+
+// importFile places srcPath at dstPath using the configured link mode and
+// returns the strategy that was actually used. Linking falls back to a copy
+// when it is not possible (different devices, unsupported filesystem, ...).
+func importFile(config ProcessingConfig, srcPath, dstPath, hash string) (string, error) {
+	mode := config.linkMode()
+	// Archive members can only be copied out
+	if isArchiveMember(srcPath) {
+		mode = LinkCopy
+	}
+	switch mode {
+	case LinkHardlink:
+		err := os.Link(srcPath, dstPath)
+		if err == nil {
+			syncDir(filepath.Dir(dstPath))
+			return LinkHardlink, nil
+		}
+		if os.IsExist(err) {
+			return "", fmt.Errorf("hardlink failed: %w", err)
+		}
+		fmt.Println("hardlink not possible for", srcPath, ", copying instead:", err)
+	case LinkReflink:
+		err := reflinkFile(srcPath, dstPath, hash, config.throttle())
+		if err == nil {
+			return LinkReflink, nil
+		}
+		if os.IsExist(err) {
+			return "", fmt.Errorf("reflink failed: %w", err)
+		}
+		fmt.Println("reflink not possible for", srcPath, ", copying instead:", err)
+	}
+	if err := copyFile(srcPath, dstPath, hash, nil, 0, config.throttle()); err != nil {
+		return "", err
+	}
+	return LinkCopy, nil
+}
+
+// reflinkFile clones srcPath into a temp file next to dstPath, verifies it
+// through throttle and moves it into place
+func reflinkFile(srcPath, dstPath, hash string, throttle *ioThrottle) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".photoManager-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if err := cloneFile(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if hash != "" {
+		written, err := readFileHash(tmpPath, throttle)
+		if err != nil {
+			return err
+		}
+		if written != hash {
+			return fmt.Errorf("hash mismatch: expected %s, got %s", hash, written)
+		}
+	}
+	if err := preserveAttributes(tmpPath, srcInfo); err != nil {
+		return err
+	}
+	if err := renameNoReplace(tmpPath, dstPath); err != nil {
+		return err
+	}
+	committed = true
+	syncDir(filepath.Dir(dstPath))
+	return nil
+}
@@ -3,25 +3,123 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	defaultDest = "/Users/sudeshpa/personal/photos/outcoming"
-	defaultSrc  = "/Users/sudeshpa/personal/photos/incoming"
+	srcRoot     string
+	destRoot    string
 	printList   bool
 	clearDB     bool
 	serveMode   bool
+	workers     int
+	layout      string
+	onCollision string
+	cleanup     string
+	trashDir    string
+	trashDays   int
+	restore     bool
+	linkMode    string
+	dryRun      bool
+	planOut     string
+	planIn      string
+	filters     ScanFilters
+	include     string
+	exclude     string
+	excludeDirs string
+	watchMode   bool
+	watchOpts   WatchOptions
+	resume      bool
+	reconcile   bool
+	listRuns    bool
+	showRun     int64
+	rehash      bool
+	nearDups    bool
+	nearDist    int
+	listDups    bool
+	resolveDups bool
+	upgrade     string
+	takeout     bool
+	tags        string
+	profileList string
+	profiles    bool
+	rulesFile   string
+	explainPath string
+	folderTags  string
+	folderDepth int
+	stopwords   string
+	keepDates   bool
+	spaceCheck  string
+	diskReserve int64
+	bwLimit     int64
+	iopsLimit   int64
 )
 
 func main() {
+	home, _ := os.UserHomeDir()
+	flag.StringVar(&srcRoot, "src", filepath.Join(home, "personal", "photos", "incoming"), "Source directory to scan, or a single archive")
+	flag.StringVar(&destRoot, "dest", filepath.Join(home, "personal", "photos", "outcoming"), "Destination base directory (the library)")
 	flag.BoolVar(&printList, "print", false, "Print processed files at the end")
-	flag.BoolVar(&clearDB, "clear-db", false, "Delete all records from incoming and outcoming tables and exit")
+	flag.BoolVar(&clearDB, "clear-db", false, "Delete all records from the incoming, outcoming, stacks and attachments tables and exit")
 	flag.BoolVar(&serveMode, "serve", false, "Run HTTP API server and wait for requests")
+	flag.IntVar(&workers, "workers", 0, "Number of concurrent workers (default: number of CPUs)")
+	flag.StringVar(&layout, "layout", defaultDestTemplate, "Destination path template, e.g. {year}/{month:02}-{monthName}/{camera}/{name}")
+	flag.StringVar(&onCollision, "on-collision", CollisionSuffix, "What to do when the destination name is taken: suffix, hash or fail")
+	flag.StringVar(&cleanup, "cleanup", CleanupNone, "What to do with sources after a verified import: none, trash or delete")
+	flag.StringVar(&trashDir, "trash", "", "Trash folder for -cleanup=trash (default: <src>/"+trashDirName+")")
+	flag.IntVar(&trashDays, "trash-retention-days", 30, "Days to keep trashed sources before purging them")
+	flag.BoolVar(&restore, "restore-trash", false, "Move every trashed source back to its original path and exit")
+	flag.StringVar(&linkMode, "link", LinkCopy, "How files enter the library: copy, hardlink or reflink (falls back to copy)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Walk and hash only; print the import plan instead of copying")
+	flag.StringVar(&planOut, "plan-out", "", "Write the dry-run plan to this file (.json or .csv)")
+	flag.StringVar(&planIn, "execute-plan", "", "Execute a JSON plan written by -dry-run -plan-out")
+	flag.StringVar(&include, "include", "", "Comma-separated globs (or re:<regex>) of files to import; default all")
+	flag.StringVar(&exclude, "exclude", "", "Comma-separated globs (or re:<regex>) of files to skip")
+	flag.StringVar(&excludeDirs, "exclude-dir", "", "Comma-separated globs (or re:<regex>) of directories not to descend into")
+	flag.Int64Var(&filters.MinSize, "min-size", 0, "Skip files smaller than this many bytes")
+	flag.Int64Var(&filters.MaxSize, "max-size", 0, "Skip files larger than this many bytes")
+	flag.BoolVar(&filters.SkipHidden, "skip-hidden", false, "Skip hidden files and directories")
+	flag.BoolVar(&filters.KeepJunk, "keep-junk", false, "Import junk files such as .DS_Store, Thumbs.db and partial downloads")
+	flag.BoolVar(&watchMode, "watch", false, "Keep running and import files as they are dropped into -src")
+	flag.DurationVar(&watchOpts.StableFor, "watch-settle", 5*time.Second, "How long a file's size must stay unchanged before it is imported")
+	flag.DurationVar(&watchOpts.PollInterval, "watch-poll", 10*time.Second, "Rescan interval when inotify is unavailable")
+	flag.BoolVar(&watchOpts.ForcePolling, "watch-polling", false, "Use polling even where inotify is available")
+	flag.BoolVar(&resume, "resume", false, "Resume the most recent interrupted scan from its last checkpoint")
+	flag.BoolVar(&reconcile, "reconcile", false, "Repair the ledger of interrupted scans, list them and exit")
+	flag.BoolVar(&listRuns, "runs", false, "List the scan run history with per-run totals and exit")
+	flag.Int64Var(&showRun, "run", 0, "Show one scan run with its errors and imported files and exit")
+	flag.StringVar(&upgrade, "upgrade", UpgradeNone, "What to do with a better copy of a library image: none (import as a new file) or replace (in place)")
+	flag.BoolVar(&takeout, "takeout", false, "Treat -src as a Google Photos Takeout export and take dates, locations, captions and albums from its JSON files")
+	flag.StringVar(&tags, "tags", "", "Comma-separated tags to add to every imported file")
+	flag.StringVar(&profileList, "profile", "", "Comma-separated source profiles to scan in one job instead of -src")
+	flag.BoolVar(&profiles, "profiles", false, "List the source profiles of the library and exit")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of rules that tag, route or skip files")
+	flag.StringVar(&explainPath, "explain", "", "Show what -rules do with this source file and exit")
+	flag.StringVar(&folderTags, "folder-tags", FolderTagsNone, "Turn source folder names into tags, an album or both: tags, album or both")
+	flag.IntVar(&folderDepth, "folder-depth", 0, "Number of source folders -folder-tags uses, counted from -src (0 = all)")
+	flag.StringVar(&stopwords, "folder-stopwords", "", "Comma-separated globs of folder names -folder-tags leaves out")
+	flag.BoolVar(&keepDates, "folder-keep-dates", false, "Keep the dates folder names start or end with in -folder-tags")
+	flag.StringVar(&spaceCheck, "space-check", SpaceFail, "What to do when the import may not fit on -dest: fail, warn or off")
+	flag.Int64Var(&diskReserve, "disk-reserve", defaultDiskReserve, "Bytes of free space to leave on -dest")
+	flag.Int64Var(&bwLimit, "bwlimit", 0, "Limit copy and hash reads to this many bytes per second (0 = unlimited)")
+	flag.Int64Var(&iopsLimit, "iops", 0, "Limit copy and hash reads to this many operations per second (0 = unlimited)")
+	flag.BoolVar(&rehash, "rehash", false, "Ignore the hash cache and read every source file again")
+	flag.BoolVar(&nearDups, "near-dups", false, "Report groups of visually similar images in the library and exit")
+	flag.IntVar(&nearDist, "near-distance", defaultNearDistance, "Maximum Hamming distance between perceptual hashes for -near-dups")
+	flag.BoolVar(&listDups, "dups", false, "List exact and near-duplicate groups with their differences and the suggested keeper, then exit")
+	flag.BoolVar(&resolveDups, "resolve-dups", false, "Keep the best file of every duplicate group, trash the rest and merge their tags, then exit")
 	flag.Parse()
+	filters.Include = splitList(include)
+	filters.Exclude = splitList(exclude)
+	filters.ExcludeDirs = splitList(excludeDirs)
 
 	if serveMode {
-		dbPath := filepath.Join(defaultDest, "photoManager.db")
+		dbPath := filepath.Join(destRoot, "photoManager.db")
 		if err := StartServer("127.0.0.1:7070", dbPath); err != nil {
 			fmt.Println("server error:", err)
 		}
@@ -29,7 +127,7 @@ func main() {
 	}
 
 	if clearDB {
-		dbPath := filepath.Join(defaultDest, "photoManager.db")
+		dbPath := filepath.Join(destRoot, "photoManager.db")
 		db, err := openAndInitDB(dbPath)
 		if err != nil {
 			fmt.Println("Failed to open DB:", err)
@@ -39,15 +137,370 @@ func main() {
 		if err := db.clearDBTables(); err != nil {
 			fmt.Println("Failed to clear DB:", err)
 		} else {
-			fmt.Println("Cleared DB tables: incoming, outcoming")
+			fmt.Println("Cleared DB tables:", strings.Join(clearedTables, ", "))
 		}
 		return
 	}
 
+	if restore {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		n, err := restoreTrash(db)
+		if err != nil {
+			fmt.Println("Failed to restore trash:", err)
+		}
+		fmt.Println("Restored", n, "trashed sources")
+		return
+	}
+
+	if nearDups {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		groups, err := findNearDuplicates(db, destRoot, nearDist)
+		if err != nil {
+			fmt.Println("Failed to find near-duplicates:", err)
+			return
+		}
+		for i, g := range groups {
+			fmt.Printf("Group %d (%d images)\n", i+1, len(g.Files))
+			for _, f := range g.Files {
+				fmt.Printf("  [%2d] #%d %s (%d bytes)\n", f.Distance, f.ID, f.DestPath, f.Size)
+			}
+		}
+		fmt.Println(len(groups), "near-duplicate groups within distance", nearDist)
+		return
+	}
+
+	if listDups || resolveDups {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		if resolveDups {
+			resolved, err := autoResolveDuplicates(db, destRoot, "", nearDist)
+			trashed := 0
+			for _, res := range resolved {
+				trashed += len(res.Trashed)
+				for _, e := range res.Errors {
+					fmt.Println("  error:", e)
+				}
+			}
+			fmt.Println("Resolved", len(resolved), "duplicate groups,", trashed, "files moved to", filepath.Join(destRoot, trashDirName))
+			if err != nil {
+				fmt.Println("Failed to resolve duplicates:", err)
+			}
+			return
+		}
+		groups, err := listDuplicateGroups(db, destRoot, "", nearDist)
+		if err != nil {
+			fmt.Println("Failed to find duplicates:", err)
+			return
+		}
+		for i, g := range groups {
+			fmt.Printf("Group %d: %s, %d files, differs in %s\n", i+1, g.Kind, len(g.Files), strings.Join(g.Differs, ", "))
+			for _, f := range g.Files {
+				mark := " "
+				if f.ID == g.Best {
+					mark = "*"
+				}
+				fmt.Printf("  %s #%d %s %dx%d %d bytes, %d EXIF fields, %s\n", mark, f.ID, f.DestPath, f.Width, f.Height, f.Size, f.ExifFields, f.TakenAt.Format("2006-01-02 15:04"))
+			}
+		}
+		fmt.Println(len(groups), "duplicate groups; * marks the file -resolve-dups keeps")
+		return
+	}
+
+	if listRuns || showRun > 0 {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		if err := printRuns(db, showRun); err != nil {
+			fmt.Println("Failed to read scan history:", err)
+		}
+		return
+	}
+
+	if profiles {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		list, err := db.listSourceProfiles()
+		if err != nil {
+			fmt.Println("Failed to list source profiles:", err)
+			return
+		}
+		for _, p := range list {
+			fmt.Printf("#%d %s: %s (%s)", p.ID, p.Name, p.Src, p.Mode)
+			if p.Layout != "" {
+				fmt.Printf(", layout %s", p.Layout)
+			}
+			if len(p.Tags) > 0 {
+				fmt.Printf(", tags %s", strings.Join(p.Tags, ","))
+			}
+			fmt.Println()
+		}
+		fmt.Println(len(list), "source profiles")
+		return
+	}
+
+	if reconcile {
+		db, err := initializeDB(destRoot)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		if _, err := reconcileInterruptedRuns(db); err != nil {
+			fmt.Println("Failed to reconcile:", err)
+			return
+		}
+		runs, err := db.listScanRunsByStatus(runInterrupted)
+		if err != nil {
+			fmt.Println("Failed to list interrupted scans:", err)
+			return
+		}
+		for _, run := range runs {
+			fmt.Printf("Run %d: %s -> %s, %d files done, last %s (updated %s)\n", run.ID, run.Src, run.Dest, run.Processed, run.LastPath, run.UpdatedAt)
+		}
+		fmt.Println(len(runs), "interrupted scans")
+		return
+	}
+
 	config := ProcessingConfig{
-		SrcFolder:  defaultSrc,
-		DestFolder: defaultDest,
+		SrcFolder:      srcRoot,
+		DestFolder:     destRoot,
+		Workers:        workers,
+		DestTemplate:   layout,
+		OnCollision:    onCollision,
+		Cleanup:        cleanup,
+		TrashFolder:    trashDir,
+		TrashRetention: time.Duration(trashDays) * 24 * time.Hour,
+		LinkMode:       linkMode,
+		DryRun:         dryRun,
+		PlanFile:       planOut,
+		Filters:        filters,
+		ForceRehash:    rehash,
+		Upgrade:        upgrade,
+		Takeout:        takeout,
+		Tags:           splitList(tags),
+		RulesFile:      rulesFile,
+		FolderTags: FolderTags{
+			Mode:      folderTags,
+			Depth:     folderDepth,
+			Stopwords: splitList(stopwords),
+			KeepDates: keepDates,
+		},
+		SpaceCheck:  spaceCheck,
+		DiskReserve: diskReserve,
+		Throttle:    ThrottleLimits{Bandwidth: bwLimit, IOPS: iopsLimit},
+	}
+
+	if explainPath != "" {
+		if err := printExplanation(config, explainPath); err != nil {
+			fmt.Println("Failed to explain rules:", err)
+		}
+		return
+	}
+
+	if watchMode {
+		w, err := newWatcher(config, watchOpts)
+		if err != nil {
+			fmt.Println("Failed to start watcher:", err)
+			return
+		}
+		w.Start()
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case <-quit:
+			fmt.Println("Stopping watcher")
+			w.Stop()
+		case <-w.Done():
+		}
+		return
+	}
+
+	var job *Job
+	var err error
+	if resume {
+		db, derr := initializeDB(destRoot)
+		if derr != nil {
+			return
+		}
+		job, _, err = resumeScanRun(db, 0)
+		db.Close()
+	} else if planIn != "" {
+		plan, perr := loadPlan(planIn)
+		if perr != nil {
+			fmt.Println("Failed to load plan:", perr)
+			return
+		}
+		job, err = executePlan(plan, config)
+	} else if profileList != "" {
+		db, derr := initializeDB(destRoot)
+		if derr != nil {
+			return
+		}
+		configs, perr := profileConfigs(db, splitList(profileList), config)
+		db.Close()
+		if perr != nil {
+			fmt.Println("Failed to load source profiles:", perr)
+			return
+		}
+		job, err = startSources(configs)
+	} else {
+		job, err = startProcessing(config)
+	}
+	if err != nil {
+		fmt.Println("File processing failed:", err)
+		return
+	}
+
+	// Ctrl-C cancels the scan once in-flight files are done; it can be resumed with -resume
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-quit:
+		fmt.Println("Cancelling scan, finishing files in flight")
+		jobs.cancelAll()
+	case <-job.Done():
+	}
+	// Files a rule routed to other libraries are imported by jobs of their own
+	for _, j := range jobs.list() {
+		if j.Kind != JobRouted {
+			continue
+		}
+		select {
+		case <-quit:
+			fmt.Println("Cancelling routed scans, finishing files in flight")
+			jobs.cancelAll()
+		case <-j.Done():
+		}
+	}
+
+	status := job.Info().Status
+	fmt.Printf("Scan %s: %d files, %d copied (%d upgrades), %d skipped, %d failed\n", status.Status, status.TotalFiles, status.Copied, status.Upgraded, status.Skipped, status.Failed)
+	fmt.Printf("Hash cache: %d hits, %d misses (%.0f%% hit rate)\n", status.HashHits, status.HashMisses, status.HashHitRate*100)
+	for _, s := range status.Sources {
+		fmt.Printf("  %s (%s): %s, %d files, %d copied, %d skipped, %d filtered, %d failed\n", s.Profile, s.Src, s.Status, s.TotalFiles, s.Copied, s.Skipped, s.Filtered, s.Failed)
+	}
+	if status.Routed > 0 {
+		fmt.Printf("Routed %d files to other libraries\n", status.Routed)
+	}
+	if status.Sidecars > 0 || status.Orphans > 0 {
+		fmt.Printf("Sidecars: %d placed, %d orphans left in the source\n", status.Sidecars, status.Orphans)
+	}
+	if plan := job.tracker.lastPlan(); dryRun && plan != nil {
+		t := plan.Totals
+		fmt.Printf("Plan: %d new, %d upgrades (%d bytes), %d duplicates (%d bytes), %d collisions, %d unsupported, %d errors, %d sidecars, %d orphan sidecars, %d routed\n",
+			t.NewFiles, t.Upgrades, t.NewBytes, t.Duplicates, t.DuplicateBytes, t.Collisions, t.Unsupported, t.Errors, t.Sidecars, t.OrphanSidecars, t.Routed)
+	}
+}
+
+// printExplanation prints how the rules judge one source file and where it would go
+func printExplanation(config ProcessingConfig, path string) error {
+	if config.RulesFile == "" {
+		return fmt.Errorf("-explain needs -rules")
+	}
+	set, err := loadRules(config.RulesFile)
+	if err != nil {
+		return err
+	}
+	ex, err := explainRulesFor(config, set, path)
+	if err != nil {
+		return err
+	}
+	for _, r := range ex.Rules {
+		switch {
+		case !r.Evaluated:
+			fmt.Printf("  %s: not evaluated\n", r.Name)
+		case r.Matched:
+			fmt.Printf("  %s: matched\n", r.Name)
+		default:
+			fmt.Printf("  %s: %s\n", r.Name, strings.Join(r.Failed, "; "))
+		}
+	}
+	d := ex.Decision
+	switch {
+	case d.Skip:
+		fmt.Println(path, "is skipped")
+	default:
+		fmt.Println(path, "->", ex.DestPath)
+		if len(d.Tags) > 0 {
+			fmt.Println("tags:", strings.Join(d.Tags, ","))
+		}
+	}
+	return nil
+}
+
+// printRuns prints the scan run history, or the details of one run if id is set
+func printRuns(db *DB, id int64) error {
+	if id == 0 {
+		runs, err := db.listScanRuns(0, 50)
+		if err != nil {
+			return err
+		}
+		for _, r := range runs {
+			t := r.Totals
+			fmt.Printf("#%d %s %s -> %s  started %s  ended %s\n", r.ID, r.Status, r.Src, r.Dest, r.StartedAt, r.EndedAt)
+			fmt.Printf("    found %d, copied %d (%d bytes), skipped %d, filtered %d, failed %d\n", t.Found, t.Copied, t.Bytes, t.Skipped, t.Filtered, t.Failed)
+		}
+		return nil
+	}
+
+	run, err := db.getScanRun(id)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return fmt.Errorf("scan run %d not found", id)
+	}
+	t := run.Totals
+	fmt.Printf("Run %d: %s\n  src:     %s\n  dest:    %s\n  started: %s\n  ended:   %s\n  config:  %s\n", run.ID, run.Status, run.Src, run.Dest, run.StartedAt, run.EndedAt, run.Config)
+	fmt.Printf("  found %d, copied %d (%d bytes), skipped %d, filtered %d, failed %d\n", t.Found, t.Copied, t.Bytes, t.Skipped, t.Filtered, t.Failed)
+	if run.Error != "" {
+		fmt.Println("  error:", run.Error)
+	}
+	errs, err := db.listScanRunErrors(id)
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		fmt.Println("  failed:", e.SrcPath, "-", e.Error)
+	}
+	var offset int64
+	for {
+		rows, err := db.listOutcomingRows(offset, 500, id, false)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			fmt.Println("  imported:", r.SrcPath, "->", r.DestPath)
+		}
+		if len(rows) < 500 {
+			return nil
+		}
+		offset += int64(len(rows))
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
-	fileProcessing(config)
-	fmt.Println("File processing started in background")
+	return out
 }
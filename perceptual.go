@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// defaultNearDistance is the default Hamming distance between two 64-bit
+// dHashes for the images to count as near-duplicates
+const defaultNearDistance = 10
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its right
+// neighbour. Re-encoding, resizing and stripped metadata barely change it.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func formatPHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parsePHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil && len(s) == 16
+}
+
+// perceptualHashFile decodes an image (usually a thumbnail) and returns its dHash
+func perceptualHashFile(path string) (string, error) {
+	img, err := imaging.Open(path)
+	if err != nil {
+		return "", err
+	}
+	return formatPHash(dHash(img)), nil
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// bkTree indexes hashes by Hamming distance so that near neighbours can be
+// found without comparing every pair
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []int64
+	children map[int]*bkNode
+}
+
+func (t *bkTree) add(hash uint64, id int64) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, ids: []int64{id}}
+		return
+	}
+	node := t.root
+	for {
+		d := hammingDistance(hash, node.hash)
+		if d == 0 {
+			node.ids = append(node.ids, id)
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[d] = &bkNode{hash: hash, ids: []int64{id}}
+			return
+		}
+		node = child
+	}
+}
+
+// within calls fn for every indexed id whose hash is at most maxDist from hash
+func (t *bkTree) within(hash uint64, maxDist int, fn func(id int64)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := hammingDistance(hash, node.hash)
+		if d <= maxDist {
+			for _, id := range node.ids {
+				fn(id)
+			}
+		}
+		for cd, child := range node.children {
+			if cd >= d-maxDist && cd <= d+maxDist {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// NearDuplicateFile is one member of a near-duplicate group
+type NearDuplicateFile struct {
+	OutcomingRow
+	Distance int `json:"distance"` // Hamming distance to the first file of the group
+}
+
+// NearDuplicateGroup is a set of library images that look alike
+type NearDuplicateGroup struct {
+	Files []NearDuplicateFile `json:"files"`
+}
+
+// findNearDuplicates groups library images whose perceptual hashes are within
+// maxDist of each other (transitively). Images imported before perceptual
+// hashes existed are hashed from their thumbnails first.
+func findNearDuplicates(db *DB, destFolder string, maxDist int) ([]NearDuplicateGroup, error) {
+	if err := backfillPerceptualHashes(db, destFolder); err != nil {
+		return nil, err
+	}
+	hashes, err := db.listPerceptualHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &bkTree{}
+	for id, h := range hashes {
+		tree.add(h, id)
+	}
+
+	// Union-find over all pairs within maxDist
+	parent := make(map[int64]int64, len(hashes))
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		p, ok := parent[id]
+		if !ok || p == id {
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	for id, h := range hashes {
+		tree.within(h, maxDist, func(other int64) {
+			if a, b := find(id), find(other); a != b {
+				if a > b {
+					a, b = b, a
+				}
+				parent[b] = a
+			}
+		})
+	}
+
+	members := make(map[int64][]int64)
+	for id := range hashes {
+		root := find(id)
+		members[root] = append(members[root], id)
+	}
+
+	var groups []NearDuplicateGroup
+	for _, ids := range members {
+		if len(ids) < 2 {
+			continue
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		var group NearDuplicateGroup
+		for _, id := range ids {
+			row, err := db.getOutcomingByIDRow(id)
+			if err != nil {
+				return nil, err
+			}
+			if row == nil {
+				continue
+			}
+			group.Files = append(group.Files, NearDuplicateFile{
+				OutcomingRow: *row,
+				Distance:     hammingDistance(hashes[ids[0]], hashes[id]),
+			})
+		}
+		if len(group.Files) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(a, b int) bool { return groups[a].Files[0].ID < groups[b].Files[0].ID })
+	return groups, nil
+}
+
+// backfillPerceptualHashes computes missing perceptual hashes from existing thumbnails
+func backfillPerceptualHashes(db *DB, destFolder string) error {
+	missing, err := db.listOutcomingWithoutPHash()
+	if err != nil {
+		return err
+	}
+	for id, thumb := range missing {
+		phash, err := perceptualHashFile(filepath.Join(destFolder, filepath.FromSlash(thumb)))
+		if err != nil {
+			continue
+		}
+		if err := db.setOutcomingPHash(id, phash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// scanJob is a single file handed from the directory walk to the worker pool
+type scanJob struct {
+	seq  int64
+	path string
+	info os.FileInfo
+}
+
+// scanResult is what a worker hands back to the ordered writer
+type scanResult struct {
+	seq      int64
+	fileInfo FileInfo
+}
+
+// hashClaims tracks hashes already picked up during the current scan so that
+// two identical files processed by different workers are not both copied
+type hashClaims struct {
+	mu     sync.Mutex
+	hashes map[string]*hashClaim
+}
+
+// hashClaim is held by the first file of a content until its import settles
+type hashClaim struct {
+	owner    string        // source path of the claimant
+	done     chan struct{} // closed once the claimant settled
+	imported bool
+	destPath string
+}
+
+func newHashClaims() *hashClaims {
+	return &hashClaims{hashes: make(map[string]*hashClaim)}
+}
+
+// claim returns true if the caller is the first one to see this hash
+func (c *hashClaims) claim(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hashes[hash] != nil {
+		return false
+	}
+	c.hashes[hash] = &hashClaim{done: make(chan struct{})}
+	return true
+}
+
+// claimContent returns true if owner is to import the content hash. Otherwise
+// it waits for the file that is: once that one is imported it returns false
+// with its source and destination, and if it failed the next waiter takes the
+// claim over.
+func (c *hashClaims) claimContent(hash, owner string) (bool, string, string) {
+	for {
+		c.mu.Lock()
+		h := c.hashes[hash]
+		if h == nil {
+			c.hashes[hash] = &hashClaim{owner: owner, done: make(chan struct{})}
+			c.mu.Unlock()
+			return true, "", ""
+		}
+		c.mu.Unlock()
+		<-h.done
+		if h.imported {
+			return false, h.owner, h.destPath
+		}
+	}
+}
+
+// await waits for the file importing hash, if one has claimed it, and returns
+// its source and destination once it is imported. It never claims the hash.
+func (c *hashClaims) await(hash string) (string, string, bool) {
+	c.mu.Lock()
+	h := c.hashes[hash]
+	c.mu.Unlock()
+	if h == nil {
+		return "", "", false
+	}
+	<-h.done
+	return h.owner, h.destPath, h.imported
+}
+
+// settle ends the claim fileInfo holds on its content, if any; a failed import releases it
+func (c *hashClaims) settle(fileInfo FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.hashes[fileInfo.hash]
+	if h == nil || h.owner != fileInfo.srcPath {
+		return
+	}
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	h.imported = fileInfo.err == nil && fileInfo.destPath != ""
+	h.destPath = fileInfo.destPath
+	if !h.imported {
+		delete(c.hashes, fileInfo.hash)
+	}
+	close(h.done)
+}
+
+// scanState is shared by all workers of a single scan
+type scanState struct {
+	claims   *hashClaims
+	dests    *destReservations
+	upgrades *upgradeIndex
+	stacks   *stackIndex
+	sidecars *sidecarIndex
+}
+
+func newScanState(config ProcessingConfig) *scanState {
+	return &scanState{
+		claims:   newHashClaims(),
+		dests:    newDestReservations(),
+		upgrades: &upgradeIndex{},
+		stacks:   newStackIndex(config.throttle()),
+		sidecars: newSidecarIndex(config.takeout),
+	}
+}
+
+// workerCount returns the configured number of workers, defaulting to the number of CPUs
+func (c ProcessingConfig) workerCount() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// runPipeline feeds the walked files through a bounded pool of workers
+// (hash -> dedupe check -> copy -> derive) and writes the results to the DB
+// in walk order. The walk blocks once too many files are in flight, and
+// emit returns an error once the job is cancelled so the walk can stop.
+func runPipeline(db *DB, config ProcessingConfig, incomingIDsToDelete *[]int64, fileInfoChan chan<- FileInfo, walk func(emit func(path string, info os.FileInfo) error) error) error {
+	workers := config.workerCount()
+	jobs := make(chan scanJob, workers)
+	results := make(chan scanResult, workers)
+	// window bounds the number of files between the walk and the writer
+	window := make(chan struct{}, workers*4)
+	state := newScanState(config)
+
+	var workerWg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
+			for job := range jobs {
+				results <- scanResult{seq: job.seq, fileInfo: processJob(db, config, state, job)}
+			}
+		}()
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		pending := make(map[int64]FileInfo)
+		waiting := make(waitingDuplicates)
+		var deferredCleanup []FileInfo
+		var next int64
+		checkpoint := newRunCheckpoint(config)
+		for res := range results {
+			pending[res.seq] = res.fileInfo
+			for {
+				fileInfo, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if config.DryRun {
+					config.plan.add(fileInfo)
+				} else {
+					fileInfo = recordResult(db, fileInfo, incomingIDsToDelete, waiting)
+					// A duplicate can be recorded before the file it duplicates; retry those at the end
+					if !cleanupAfterImport(db, config, fileInfo) && fileInfo.err == nil && fileInfo.copied {
+						deferredCleanup = append(deferredCleanup, fileInfo)
+					}
+					checkpoint.advance(db, config, fileInfo)
+				}
+				fileInfoChan <- fileInfo
+				config.archives.release(fileInfo.srcPath)
+				<-window
+			}
+		}
+		for _, fileInfo := range deferredCleanup {
+			cleanupAfterImport(db, config, fileInfo)
+		}
+		for _, dups := range waiting {
+			for _, fileInfo := range dups {
+				fmt.Println("the library copy of", fileInfo.srcPath, "was not recorded; its tags and sidecars were not added")
+			}
+		}
+		checkpoint.save(db, config)
+	}()
+
+	var seq int64
+	walkErr := walk(func(path string, info os.FileInfo) error {
+		// Blocks while the job is paused; stops the walk once it is cancelled
+		if err := config.job.wait(); err != nil {
+			return err
+		}
+		window <- struct{}{}
+		jobs <- scanJob{seq: seq, path: path, info: info}
+		seq++
+		return nil
+	})
+
+	close(jobs)
+	workerWg.Wait()
+	close(results)
+	<-writerDone
+	return walkErr
+}
+
+// processJob hashes, dedupes, copies and derives thumbnail/metadata for a single file.
+// It does not write to the DB; failures are returned on FileInfo.err.
+func processJob(db *DB, config ProcessingConfig, state *scanState, job scanJob) FileInfo {
+	path, info := job.path, job.info
+	modTime := info.ModTime()
+
+	fileInfo := FileInfo{
+		name:          info.Name(),
+		size:          info.Size(),
+		modifiedAt:    modTime,
+		modifiedAtStr: modTime.Format("2006-January-02"),
+		srcPath:       path,
+		fileType:      getFileType(path),
+		tags:          append([]string{}, config.Tags...),
+		runID:         config.runID,
+	}
+	// Files waiting on this one's content go ahead once it is settled
+	defer func() { state.claims.settle(fileInfo) }()
+
+	if err := hashSource(db, config, info, &fileInfo); err != nil {
+		fileInfo.err = fmt.Errorf("failed to compute hash for %s: %w", path, err)
+		return fileInfo
+	}
+	hash := fileInfo.hash
+	assignStack(state, &fileInfo)
+	fileInfo.sidecars = sidecarsOf(state, path)
+	if config.takeout != nil {
+		if album := config.takeout.album(path); album != "" {
+			fileInfo.tags = append(fileInfo.tags, album)
+		}
+	}
+	if tags, album := config.folders.derive(config, path); tags != nil || album != "" {
+		fileInfo.tags = appendMissing(fileInfo.tags, tags...)
+		fileInfo.album = album
+	}
+	if d := config.decisions.get(config, path, info); d != nil {
+		fileInfo.tags = appendMissing(fileInfo.tags, d.Tags...)
+	}
+
+	if entry := config.plannedEntry(path); entry != nil {
+		// Executing a reviewed plan: follow it exactly or fail
+		if err := applyPlanEntry(db, config.plan, state, entry, &fileInfo); err != nil {
+			fileInfo.err = fmt.Errorf("plan mismatch for %s: %w", path, err)
+			return fileInfo
+		}
+	} else if err := chooseDestination(db, config, state, info, &fileInfo); err != nil {
+		fileInfo.err = err
+		return fileInfo
+	}
+
+	// Dry-run stops once we know what would happen
+	if fileInfo.copied || config.DryRun {
+		// A duplicate still brings along sidecars its library copy does not have yet
+		if fileInfo.copied && !config.DryRun {
+			placeSidecars(config, state, &fileInfo)
+		}
+		return fileInfo
+	}
+	dstPath := fileInfo.destPath
+
+	if err := ensureSpace(config, &fileInfo); err != nil {
+		state.dests.release(dstPath)
+		fileInfo.err = err
+		return fileInfo
+	}
+
+	if err := ensureDirectory(filepath.Dir(dstPath)); err != nil {
+		state.dests.release(dstPath)
+		fileInfo.err = fmt.Errorf("mkdir failed: %w", err)
+		return fileInfo
+	}
+
+	// Log the copy in the ledger first so a crash mid-copy can be rolled back
+	incomingID, err := db.upsertIncomingStage(fileInfo, stageCopying)
+	if err != nil {
+		state.dests.release(dstPath)
+		fileInfo.err = fmt.Errorf("failed to write ledger for %s: %w", path, err)
+		return fileInfo
+	}
+	fileInfo.incomingID = incomingID
+
+	// The version being upgraded goes to the library trash first; it comes back if the copy fails
+	if fileInfo.replaces != nil {
+		if err := trashReplacedVersion(db, config, incomingID, fileInfo.replaces); err != nil {
+			state.dests.release(dstPath)
+			fileInfo.err = fmt.Errorf("failed to replace %s: %w", fileInfo.replaces.destPath, err)
+			return fileInfo
+		}
+	}
+
+	method, err := importFile(config, path, dstPath, hash)
+	if err != nil {
+		state.dests.release(dstPath)
+		if fileInfo.replaces != nil {
+			restoreReplacedVersion(fileInfo.replaces)
+		}
+		fileInfo.err = fmt.Errorf("failed to copy file %s: %w", path, err)
+		return fileInfo
+	}
+	fileInfo.importMethod = method
+
+	// Fingerprint new files so later scans can prefilter against them; the
+	// verified library copy is read since archive members cannot seek
+	if fileInfo.partialHash == "" {
+		if partial, err := partialFileHash(dstPath, fileInfo.size, config.throttle()); err == nil {
+			fileInfo.partialHash = partial
+		}
+	}
+	if err := db.setIncomingStage(incomingID, stageCopied); err != nil {
+		fmt.Println("failed to advance ledger for", path, ":", err)
+	}
+	if fileInfo.replaces != nil {
+		dropReplacedThumbnail(config, fileInfo.replaces)
+	}
+
+	// Generate thumbnail from the copied file
+	thumbnailPath, phash, terr := processThumbnail(dstPath, config.DestFolder)
+	if terr != nil {
+		// Don't fail the copy operation if thumbnail generation fails
+		fmt.Println("thumbnail generation failed for", dstPath, ":", terr)
+	}
+	fileInfo.thumbnailPath = thumbnailPath
+	fileInfo.phash = phash
+
+	// Build metadata (EXIF for images, XMP/EXIF for videos) and store JSON in DB
+	fileInfo.metadata = BuildMetadataJSON(dstPath)
+
+	// Sidecars follow the file to its final name and enrich its metadata
+	placeSidecars(config, state, &fileInfo)
+	metas := make([]*SidecarMetadata, 0, len(fileInfo.sidecars))
+	for _, sc := range fileInfo.sidecars {
+		metas = append(metas, sc.meta)
+	}
+	fileInfo.metadata = mergeSidecarMetadata(fileInfo.metadata, metas)
+	if config.takeout != nil {
+		fileInfo.metadata = applyTakeoutMetadata(fileInfo.metadata, config.takeout.metadata(path))
+	}
+
+	return fileInfo
+}
+
+// chooseDestination decides whether a hashed file is a duplicate and, if not,
+// reserves a collision-free destination path for it
+func chooseDestination(db *DB, config ProcessingConfig, state *scanState, info os.FileInfo, fileInfo *FileInfo) error {
+	path, hash := fileInfo.srcPath, fileInfo.hash
+
+	// Check if already in outcoming by hash to determine copied status
+	_, existingDest, exists, err := db.findOutcomingByHash(hash)
+	if err != nil {
+		return fmt.Errorf("failed to find outcoming by hash for %s: %w", path, err)
+	}
+	// Another worker may already be copying the same content in this scan;
+	// its copy is the library copy unless it fails
+	if !exists {
+		if first, claimant, claimantDest := state.claims.claimContent(hash, path); !first {
+			exists, existingDest = true, claimantDest
+			fileInfo.claimant = claimant
+		}
+	}
+	fileInfo.copied = exists
+	if exists {
+		fileInfo.destPath = existingDest
+		return nil
+	}
+
+	// A better copy of a library image replaces it in place
+	if config.upgradeMode() == UpgradeReplace {
+		row, err := findUpgradeTarget(db, config, state, *fileInfo)
+		if err != nil {
+			return fmt.Errorf("failed to look for an upgrade target for %s: %w", path, err)
+		}
+		if row != nil {
+			if ok, err := claimUpgrade(config, state, *row, fileInfo); err != nil {
+				return fmt.Errorf("collision for %s: %w", path, err)
+			} else if ok {
+				return nil
+			}
+		}
+	}
+
+	dstPath, err := buildDestPath(config, path, info, hash)
+	if err != nil {
+		return fmt.Errorf("failed to build destination path for %s: %w", path, err)
+	}
+	// Members of a stack share the folder of its original
+	if fileInfo.stackKey != "" {
+		if dstPath, err = stackDestPath(db, config, state, *fileInfo, dstPath); err != nil {
+			return err
+		}
+	}
+
+	// Never overwrite an existing library file; pick a free name or fail
+	resolved, err := resolveCollision(config, state.dests, dstPath, hash)
+	if err != nil {
+		fileInfo.collision = true
+		fileInfo.destPath = dstPath
+		return fmt.Errorf("collision for %s: %w", path, err)
+	}
+	fileInfo.collision = resolved != dstPath
+	fileInfo.destPath = resolved
+	return nil
+}
+
+// waitingDuplicates holds, by hash, the duplicates recorded before the file of
+// the same scan they duplicate. Only the writer goroutine uses it.
+type waitingDuplicates map[string][]FileInfo
+
+// recordResult writes the incoming/outcoming rows for a processed file.
+// It is only called from the writer goroutine so DB writes happen in walk order.
+func recordResult(db *DB, fileInfo FileInfo, incomingIDsToDelete *[]int64, waiting waitingDuplicates) FileInfo {
+	if fileInfo.hash == "" {
+		// Nothing to key the incoming row on (hashing failed)
+		fmt.Println(fileInfo.err)
+		return fileInfo
+	}
+
+	incomingID := fileInfo.incomingID
+	var err error
+	// The ledger row of content copied in this scan belongs to its claimant
+	if incomingID == 0 && fileInfo.claimant == "" {
+		incomingID, err = db.insertIncomingRecord(fileInfo)
+	}
+	if err != nil {
+		if fileInfo.err == nil {
+			fileInfo.err = fmt.Errorf("failed to insert incoming record for %s: %w", fileInfo.srcPath, err)
+		}
+		fmt.Println(fileInfo.err)
+		return fileInfo
+	}
+
+	if fileInfo.err != nil {
+		fmt.Println(fileInfo.err)
+		_ = db.markIncomingFailure(incomingID, fileInfo.err.Error())
+		return fileInfo
+	}
+
+	// If already copied, nothing else to record; the library copy may still join
+	// the file's stack and take new sidecars and tags
+	if fileInfo.copied {
+		if fileInfo.stackKey != "" || len(fileInfo.sidecars) > 0 || len(fileInfo.tags) > 0 || fileInfo.album != "" {
+			id, _, ok, err := db.findOutcomingByHash(fileInfo.hash)
+			switch {
+			case err != nil:
+				fmt.Println("failed to find the library copy of", fileInfo.srcPath, ":", err)
+			case ok:
+				updateLibraryCopy(db, id, fileInfo)
+			case fileInfo.claimant != "":
+				// The file it duplicates comes later in walk order
+				waiting[fileInfo.hash] = append(waiting[fileInfo.hash], fileInfo)
+			}
+		}
+		return fileInfo
+	}
+
+	var outcomingID int64
+	if fileInfo.replaces != nil {
+		err = db.upgradeOutcomingRecord(fileInfo.replaces.id, fileInfo, fileInfo.replaces.trashPath)
+	} else {
+		outcomingID, err = db.insertOutcomingRecord(fileInfo)
+	}
+	if err != nil {
+		fileInfo.err = fmt.Errorf("failed to insert outcoming record for %s: %w", fileInfo.srcPath, err)
+		fmt.Println(fileInfo.err)
+		_ = db.markIncomingFailure(incomingID, fileInfo.err.Error())
+		return fileInfo
+	}
+	if err := db.setIncomingStage(incomingID, stageRecorded); err != nil {
+		fmt.Println("failed to advance ledger for", fileInfo.srcPath, ":", err)
+	}
+	if outcomingID != 0 && fileInfo.stackKey != "" {
+		if err := db.addToStack(fileInfo.stackKey, outcomingID, fileInfo.stackCover); err != nil {
+			fmt.Println("failed to stack", fileInfo.srcPath, ":", err)
+		}
+	}
+	if fileInfo.replaces != nil {
+		outcomingID = fileInfo.replaces.id
+	}
+	// The sidecar metadata is already part of the row
+	recordSidecars(db, outcomingID, fileInfo, false)
+	for _, dup := range waiting[fileInfo.hash] {
+		updateLibraryCopy(db, outcomingID, dup)
+	}
+	delete(waiting, fileInfo.hash)
+
+	*incomingIDsToDelete = append(*incomingIDsToDelete, incomingID)
+	return fileInfo
+}
+
+// updateLibraryCopy adds what a duplicate brings along (tags, album, stack and
+// sidecars) to the library row id of its content
+func updateLibraryCopy(db *DB, id int64, fileInfo FileInfo) {
+	if err := db.addTags(id, fileInfo.tags); err != nil {
+		fmt.Println("failed to tag", fileInfo.srcPath, ":", err)
+	}
+	if err := db.setMissingAlbum(id, fileInfo.album); err != nil {
+		fmt.Println("failed to set the album of", fileInfo.srcPath, ":", err)
+	}
+	if fileInfo.stackKey != "" {
+		if err := db.addToStack(fileInfo.stackKey, id, fileInfo.stackCover); err != nil {
+			fmt.Println("failed to stack", fileInfo.srcPath, ":", err)
+		}
+	}
+	recordSidecars(db, id, fileInfo, true)
+}
+
+// cleanupAfterImport runs the configured source cleanup for a recorded file and logs failures
+func cleanupAfterImport(db *DB, config ProcessingConfig, fileInfo FileInfo) bool {
+	done, err := cleanupSource(db, config, fileInfo)
+	if err != nil {
+		fmt.Println("source cleanup skipped for", fileInfo.srcPath, ":", err)
+	}
+	if done {
+		cleanupSidecars(db, config, fileInfo)
+	}
+	return done
+}
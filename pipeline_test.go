@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestScan imports src into dest through the job queue and returns the final status
+func runTestScan(t *testing.T, config ProcessingConfig) ScanStatus {
+	t.Helper()
+	job, err := startProcessing(config)
+	return waitTestJob(t, job, err)
+}
+
+// waitTestJob waits for a queued scan and returns its final status
+func waitTestJob(t *testing.T, job *Job, err error) ScanStatus {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-job.Done()
+	status := job.tracker.snapshot()
+	if status.Status != "completed" {
+		t.Fatalf("scan ended %s: %s", status.Status, status.Error)
+	}
+	return status
+}
+
+// writeDuplicatePairs writes n pairs of files with the same content next to
+// each other, so the workers race for each content
+func writeDuplicatePairs(t *testing.T, src string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("content of pair %d;", i)), 1<<14)
+		for _, suffix := range []string{"a", "b"} {
+			p := filepath.Join(src, fmt.Sprintf("IMG_%04d%s.JPG", i, suffix))
+			if err := os.WriteFile(p, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestScanDuplicatePairsConcurrently(t *testing.T) {
+	for run := 0; run < 5; run++ {
+		src, dest := t.TempDir(), t.TempDir()
+		writeDuplicatePairs(t, src, 20)
+		status := runTestScan(t, ProcessingConfig{SrcFolder: src, DestFolder: dest, Workers: 8})
+		if status.Failed != 0 || status.Copied != 20 || status.Skipped != 20 {
+			t.Fatalf("run %d: copied %d, skipped %d, failed %d; want 20, 20, 0", run, status.Copied, status.Skipped, status.Failed)
+		}
+	}
+}
+
+// writeDuplicateFolders writes n pairs of files with the same content to the
+// folders pairN/left and pairN/right
+func writeDuplicateFolders(t *testing.T, src string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("content of pair %d;", i)), 1<<14)
+		for _, side := range []string{"left", "right"} {
+			p := filepath.Join(src, fmt.Sprintf("pair%04d", i), side, "IMG_0001.JPG")
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// checkBothSidesTagged checks that the n library files of dest carry the
+// folder tags of both files of their pair
+func checkBothSidesTagged(t *testing.T, dest string, n int) {
+	t.Helper()
+	db, err := initializeDB(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.listOutcomingRows(0, int64(n)*2, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != n {
+		t.Fatalf("%d library files, want %d", len(rows), n)
+	}
+	for _, row := range rows {
+		tags := strings.Join(row.Tags, ",")
+		if !strings.Contains(tags, "left") || !strings.Contains(tags, "right") {
+			t.Errorf("%s is tagged %q, want both sides", row.DestPath, tags)
+		}
+	}
+}
+
+func TestScanDuplicatesTagLibraryCopy(t *testing.T) {
+	for run := 0; run < 5; run++ {
+		src, dest := t.TempDir(), t.TempDir()
+		writeDuplicateFolders(t, src, 20)
+		config := ProcessingConfig{SrcFolder: src, DestFolder: dest, Workers: 8, FolderTags: FolderTags{Mode: FolderTagsTags}}
+		if status := runTestScan(t, config); status.Failed != 0 {
+			t.Fatalf("run %d: %d files failed", run, status.Failed)
+		}
+		checkBothSidesTagged(t, dest, 20)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plan entry actions
+const (
+	PlanCopy      = "copy"           // new file, will be imported to DestPath
+	PlanDuplicate = "duplicate"      // already in the library at DestPath
+	PlanUpgrade   = "upgrade"        // better copy of the library file Replaces, will be imported to DestPath in its place
+	PlanCollision = "collision"      // destination taken and OnCollision is fail
+	PlanError     = "error"          // file could not be read or hashed
+	PlanOrphan    = "orphan-sidecar" // sidecar without a media file, not imported
+	PlanRouted    = "routed"         // a rule sends the file to the library at DestPath
+)
+
+// PlanEntry describes what an import would do with a single source file
+type PlanEntry struct {
+	Action      string   `json:"action"`
+	SrcPath     string   `json:"srcPath"`
+	DestPath    string   `json:"destPath"`
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	FileType    string   `json:"fileType"`
+	Collision   bool     `json:"collision"`   // DestPath was renamed to avoid an existing file
+	Unsupported bool     `json:"unsupported"` // not a recognised image or video type
+	Error       string   `json:"error,omitempty"`
+	Replaces    string   `json:"replaces,omitempty"`   // library file an upgrade replaces
+	ReplacesID  int64    `json:"replacesId,omitempty"` // outcoming id kept by an upgrade
+	Sidecars    []string `json:"sidecars,omitempty"`   // sidecars placed next to DestPath with the file
+}
+
+// PlanTotals summarises a plan
+type PlanTotals struct {
+	Files          int64 `json:"files"`
+	NewFiles       int64 `json:"newFiles"`
+	NewBytes       int64 `json:"newBytes"`
+	Upgrades       int64 `json:"upgrades"`
+	Duplicates     int64 `json:"duplicates"`
+	DuplicateBytes int64 `json:"duplicateBytes"`
+	Collisions     int64 `json:"collisions"`
+	Unsupported    int64 `json:"unsupported"`
+	Errors         int64 `json:"errors"`
+	Sidecars       int64 `json:"sidecars"`
+	OrphanSidecars int64 `json:"orphanSidecars"`
+	Routed         int64 `json:"routed"`
+}
+
+// ImportPlan is the reviewable output of a dry-run scan
+type ImportPlan struct {
+	mu        sync.Mutex
+	Src       string      `json:"src"`
+	Dest      string      `json:"dest"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Totals    PlanTotals  `json:"totals"`
+	Entries   []PlanEntry `json:"entries"`
+
+	bySrc map[string]*PlanEntry
+}
+
+func newImportPlan(config ProcessingConfig) *ImportPlan {
+	return &ImportPlan{
+		Src:       config.SrcFolder,
+		Dest:      config.DestFolder,
+		CreatedAt: time.Now(),
+		Entries:   []PlanEntry{},
+	}
+}
+
+// add records the outcome of a dry-run for one file
+func (p *ImportPlan) add(fileInfo FileInfo) {
+	entry := PlanEntry{
+		SrcPath:     fileInfo.srcPath,
+		DestPath:    fileInfo.destPath,
+		Hash:        fileInfo.hash,
+		Size:        fileInfo.size,
+		FileType:    fileInfo.fileType,
+		Collision:   fileInfo.collision,
+		Unsupported: fileInfo.fileType == "other",
+	}
+	for _, sc := range fileInfo.sidecars {
+		entry.Sidecars = append(entry.Sidecars, sc.srcPath)
+	}
+	switch {
+	case fileInfo.err != nil && fileInfo.collision:
+		entry.Action = PlanCollision
+		entry.Error = fileInfo.err.Error()
+	case fileInfo.err != nil:
+		entry.Action = PlanError
+		entry.Error = fileInfo.err.Error()
+	case fileInfo.copied:
+		entry.Action = PlanDuplicate
+	case fileInfo.replaces != nil:
+		entry.Action = PlanUpgrade
+		entry.Replaces = fileInfo.replaces.destPath
+		entry.ReplacesID = fileInfo.replaces.id
+	default:
+		entry.Action = PlanCopy
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Entries = append(p.Entries, entry)
+	p.Totals.Files++
+	switch entry.Action {
+	case PlanCopy:
+		p.Totals.NewFiles++
+		p.Totals.NewBytes += entry.Size
+	case PlanUpgrade:
+		p.Totals.Upgrades++
+		p.Totals.NewBytes += entry.Size
+	case PlanDuplicate:
+		p.Totals.Duplicates++
+		p.Totals.DuplicateBytes += entry.Size
+	case PlanError:
+		p.Totals.Errors++
+	}
+	if entry.Collision {
+		p.Totals.Collisions++
+	}
+	if entry.Unsupported {
+		p.Totals.Unsupported++
+	}
+	if entry.Action != PlanError && entry.Action != PlanCollision {
+		p.Totals.Sidecars += int64(len(entry.Sidecars))
+	}
+}
+
+// addOrphanSidecar records a sidecar the import leaves behind because it has no media file
+func (p *ImportPlan) addOrphanSidecar(srcPath string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Entries = append(p.Entries, PlanEntry{Action: PlanOrphan, SrcPath: srcPath, Size: size, FileType: "other"})
+	p.Totals.OrphanSidecars++
+}
+
+// addRouted records a file a rule sends to another library; it is not executable here
+func (p *ImportPlan) addRouted(srcPath string, size int64, library string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Entries = append(p.Entries, PlanEntry{Action: PlanRouted, SrcPath: srcPath, DestPath: library, Size: size, FileType: getFileType(srcPath)})
+	p.Totals.Routed++
+}
+
+// finalize fills in the destination of duplicates of files copied in the same plan
+func (p *ImportPlan) finalize() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	copies := make(map[string]string)
+	for _, e := range p.Entries {
+		if e.Action == PlanCopy || e.Action == PlanUpgrade {
+			copies[e.Hash] = e.DestPath
+		}
+	}
+	for i := range p.Entries {
+		if e := &p.Entries[i]; e.Action == PlanDuplicate && e.DestPath == "" {
+			e.DestPath = copies[e.Hash]
+		}
+	}
+}
+
+// entryFor returns the planned entry for a source path, or nil if it is not part of the plan
+func (p *ImportPlan) entryFor(srcPath string) *PlanEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bySrc == nil {
+		p.bySrc = make(map[string]*PlanEntry, len(p.Entries))
+		for i := range p.Entries {
+			p.bySrc[p.Entries[i].SrcPath] = &p.Entries[i]
+		}
+	}
+	return p.bySrc[srcPath]
+}
+
+// copyEntryForHash returns the copy or upgrade entry with the given hash, if any
+func (p *ImportPlan) copyEntryForHash(hash string) *PlanEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.Entries {
+		if a := p.Entries[i].Action; (a == PlanCopy || a == PlanUpgrade) && p.Entries[i].Hash == hash {
+			return &p.Entries[i]
+		}
+	}
+	return nil
+}
+
+// executable reports whether an entry is carried out when the plan is executed
+func (e PlanEntry) executable() bool {
+	return e.Action == PlanCopy || e.Action == PlanDuplicate || e.Action == PlanUpgrade
+}
+
+// writeJSON writes the plan as indented JSON
+func (p *ImportPlan) writeJSON(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// writeCSV writes one row per plan entry
+func (p *ImportPlan) writeCSV(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"action", "srcPath", "destPath", "hash", "size", "fileType", "collision", "unsupported", "error", "replaces", "sidecars"}); err != nil {
+		return err
+	}
+	for _, e := range p.Entries {
+		if err := cw.Write([]string{
+			e.Action, e.SrcPath, e.DestPath, e.Hash,
+			strconv.FormatInt(e.Size, 10), e.FileType,
+			strconv.FormatBool(e.Collision), strconv.FormatBool(e.Unsupported), e.Error, e.Replaces,
+			strings.Join(e.Sidecars, ";"),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// plansDirName is the folder under the library that API clients save plans in
+const plansDirName = ".photoManager-plans"
+
+// libraryPlanFile returns where a plan named by an API client is saved: a
+// plain file name in the plans folder of the library
+func libraryPlanFile(dest, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return "", fmt.Errorf("planFile must be a file name; plans are saved in %s", filepath.Join(dest, plansDirName))
+	}
+	return filepath.Join(dest, plansDirName, name), nil
+}
+
+// savePlan writes the plan to path as CSV if it ends in .csv, JSON otherwise
+func savePlan(plan *ImportPlan, path string) error {
+	if err := ensureDirectory(filepath.Dir(path)); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return plan.writeCSV(f)
+	}
+	return plan.writeJSON(f)
+}
+
+// loadPlan reads a JSON plan previously written by savePlan. CSV plans are
+// for review only: they lack the settings a plan is executed with.
+func loadPlan(path string) (*ImportPlan, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return nil, fmt.Errorf("%s: CSV plans cannot be executed, save the plan as JSON", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodePlan(f)
+}
+
+func decodePlan(r io.Reader) (*ImportPlan, error) {
+	var plan ImportPlan
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("invalid plan: %w", err)
+	}
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// validate checks a plan before it is executed. Plans may have been edited,
+// so every file the plan writes or replaces must lie in its library.
+func (p *ImportPlan) validate() error {
+	if p.Src == "" || p.Dest == "" {
+		return fmt.Errorf("invalid plan: src and dest are required")
+	}
+	for _, e := range p.Entries {
+		if e.Action != PlanCopy && e.Action != PlanUpgrade {
+			continue
+		}
+		if !insideFolder(p.Dest, e.DestPath) || filepath.Clean(e.DestPath) == filepath.Clean(p.Dest) {
+			return fmt.Errorf("invalid plan: destination %s of %s is outside %s", e.DestPath, e.SrcPath, p.Dest)
+		}
+		if e.Action == PlanUpgrade && !insideFolder(p.Dest, e.Replaces) {
+			return fmt.Errorf("invalid plan: replaced file %s is outside %s", e.Replaces, p.Dest)
+		}
+	}
+	return nil
+}
+
+// walkPlan emits the executable entries of a plan in plan order. Tar members
+// are in the order of their archive and are read by streaming through it.
+func walkPlan(config ProcessingConfig, plan *ImportPlan, emit func(path string, info os.FileInfo) error) error {
+	var tarName string
+	var cursor *tarCursor
+	defer func() {
+		if cursor != nil {
+			cursor.close()
+		}
+	}()
+	for _, e := range plan.Entries {
+		if !e.executable() {
+			continue
+		}
+		if archive, member, ok := splitArchivePath(e.SrcPath); ok && archiveKind(archive) == ArchiveTar {
+			if cursor == nil || tarName != archive {
+				if cursor != nil {
+					cursor.close()
+				}
+				// Sidecars and Takeout JSON are found through the listing
+				err := config.archives.indexTar(archive)
+				var c *tarCursor
+				if err == nil {
+					c, err = openTar(archive)
+				}
+				if err != nil {
+					fmt.Println("planned archive missing, skipping:", e.SrcPath, err)
+					cursor = nil
+					continue
+				}
+				tarName, cursor = archive, c
+			}
+			hdr, err := cursor.seek(member)
+			if err != nil {
+				fmt.Println("planned source missing, skipping:", e.SrcPath, err)
+				cursor.close()
+				cursor = nil
+				continue
+			}
+			if err := config.archives.spool(e.SrcPath, cursor.tr, hdr); err != nil {
+				fmt.Println("skipping", e.SrcPath, ":", err)
+				continue
+			}
+			if err := emit(e.SrcPath, memberInfo{FileInfo: hdr.FileInfo(), name: path.Base(member)}); err != nil {
+				config.archives.release(e.SrcPath)
+				return err
+			}
+			continue
+		}
+		info, err := statSource(e.SrcPath)
+		if err != nil {
+			fmt.Println("planned source missing, skipping:", e.SrcPath, err)
+			continue
+		}
+		if err := emit(e.SrcPath, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executePlan runs a saved plan; settings such as LinkMode and Cleanup come from config
+func executePlan(plan *ImportPlan, config ProcessingConfig) (*Job, error) {
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+	config.SrcFolder = plan.Src
+	config.DestFolder = plan.Dest
+	config.DryRun = false
+	config.plan = plan
+	return startProcessing(config)
+}
+
+// applyPlanEntry checks a freshly hashed file against its planned entry and
+// fixes its destination, so execution does exactly what the plan said or fails.
+func applyPlanEntry(db *DB, plan *ImportPlan, state *scanState, entry *PlanEntry, fileInfo *FileInfo) error {
+	if fileInfo.hash != entry.Hash {
+		return fmt.Errorf("source changed since planning (hash %s, planned %s)", fileInfo.hash, entry.Hash)
+	}
+	_, existingDest, exists, err := db.findOutcomingByHash(fileInfo.hash)
+	if err != nil {
+		return err
+	}
+	switch entry.Action {
+	case PlanDuplicate:
+		if !exists {
+			// Duplicate of a file copied in this same plan; wait for that copy
+			// if it is underway, its library row is updated once recorded
+			original := plan.copyEntryForHash(fileInfo.hash)
+			if original == nil {
+				return fmt.Errorf("planned duplicate is no longer in the library")
+			}
+			existingDest = original.DestPath
+			if owner, dest, ok := state.claims.await(fileInfo.hash); ok {
+				existingDest = dest
+				fileInfo.claimant = owner
+			} else {
+				fileInfo.claimant = original.SrcPath
+			}
+		}
+		fileInfo.copied = true
+		fileInfo.destPath = existingDest
+	case PlanCopy:
+		if exists {
+			return fmt.Errorf("planned copy is already in the library at %s", existingDest)
+		}
+		if first, _, _ := state.claims.claimContent(fileInfo.hash, fileInfo.srcPath); !first {
+			return fmt.Errorf("planned copy is already being imported")
+		}
+		if !state.dests.reserve(entry.DestPath) {
+			return fmt.Errorf("planned destination %s is already taken", entry.DestPath)
+		}
+		fileInfo.destPath = entry.DestPath
+	case PlanUpgrade:
+		if exists {
+			return fmt.Errorf("planned upgrade is already in the library at %s", existingDest)
+		}
+		row, err := db.getOutcomingByIDRow(entry.ReplacesID)
+		if err != nil {
+			return err
+		}
+		if row == nil || row.DestPath != entry.Replaces {
+			return fmt.Errorf("library file %s changed since planning", entry.Replaces)
+		}
+		if !state.claims.claim(fmt.Sprintf("upgrade:%d", row.ID)) {
+			return fmt.Errorf("%s is already being upgraded", entry.Replaces)
+		}
+		if first, _, _ := state.claims.claimContent(fileInfo.hash, fileInfo.srcPath); !first {
+			return fmt.Errorf("planned upgrade is already being imported")
+		}
+		if entry.DestPath == row.DestPath {
+			state.dests.hold(entry.DestPath)
+		} else if !state.dests.reserve(entry.DestPath) {
+			return fmt.Errorf("planned destination %s is already taken", entry.DestPath)
+		}
+		fileInfo.destPath = entry.DestPath
+		fileInfo.replaces = &upgradeTarget{id: row.ID, destPath: row.DestPath, thumbnailPath: row.ThumbnailPath}
+	default:
+		return fmt.Errorf("plan entry with action %q is not executable", entry.Action)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestExecutePlanWithDuplicates(t *testing.T) {
+	for run := 0; run < 5; run++ {
+		src, dest := t.TempDir(), t.TempDir()
+		writeDuplicateFolders(t, src, 20)
+		config := ProcessingConfig{SrcFolder: src, DestFolder: dest, Workers: 8, FolderTags: FolderTags{Mode: FolderTagsTags}}
+
+		dry := config
+		dry.DryRun = true
+		job, err := startProcessing(dry)
+		waitTestJob(t, job, err)
+		plan := job.tracker.lastPlan()
+		if plan == nil || plan.Totals.NewFiles != 20 || plan.Totals.Duplicates != 20 {
+			t.Fatalf("run %d: plan %+v, want 20 new files and 20 duplicates", run, plan)
+		}
+
+		job, err = executePlan(plan, config)
+		if status := waitTestJob(t, job, err); status.Failed != 0 || status.Copied != 20 {
+			t.Fatalf("run %d: copied %d, failed %d; want 20, 0", run, status.Copied, status.Failed)
+		}
+		checkBothSidesTagged(t, dest, 20)
+	}
+}
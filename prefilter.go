@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// partialBlockSize is the size of each block read for a partial fingerprint
+const partialBlockSize = 64 * 1024
+
+// prefilterMinSize is the smallest file worth prefiltering; smaller files are simply hashed
+const prefilterMinSize = 1 << 20
+
+// partialFileHash fingerprints a file from its size and its head, middle and
+// tail blocks. Equal files always have equal fingerprints; different files
+// almost always differ, but only the full hash is authoritative.
+func partialFileHash(path string, size int64, throttle *ioThrottle) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(size, 10)))
+	buf := make([]byte, partialBlockSize)
+	for _, off := range []int64{0, size/2 - partialBlockSize/2, size - partialBlockSize} {
+		if off < 0 {
+			off = 0
+		}
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if err := throttle.wait(n); err != nil {
+			return "", err
+		}
+		h.Write(buf[:n])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashSource fills in fileInfo.hash. In order of cost it comes from the hash
+// cache, from the library row of a duplicate found by the size and partial
+// fingerprint prefilter, or from reading the whole file. New files are always
+// fully hashed so outcoming.hash stays authoritative.
+func hashSource(db *DB, config ProcessingConfig, info os.FileInfo, fileInfo *FileInfo) error {
+	path := fileInfo.srcPath
+	key := newHashCacheKey(path, info)
+	if hash, ok := cachedHash(db, config, key); ok {
+		fileInfo.hash = hash
+		fileInfo.hashCached = true
+		return nil
+	}
+
+	dupHash := ""
+	// Archive members cannot be read at an offset, so the prefilter would read them whole anyway
+	if !config.ForceRehash && info.Size() >= prefilterMinSize && !isArchiveMember(path) {
+		var err error
+		dupHash, fileInfo.partialHash, err = prefilterDuplicate(db, path, info.Size(), config.throttle())
+		if err != nil {
+			fmt.Println("prefilter failed for", path, ":", err)
+		}
+		// A source is only removed on the strength of the full hash
+		if dupHash != "" && config.cleanupMode() == CleanupNone {
+			fileInfo.hash = dupHash
+			fileInfo.prefiltered = true
+			return nil
+		}
+	}
+
+	hash, err := readFileHash(path, config.throttle())
+	if err != nil {
+		return err
+	}
+	fileInfo.hash = hash
+	rememberHash(db, config, key, hash)
+	return nil
+}
+
+// prefilterDuplicate looks for a library file with the same size and partial
+// fingerprint. It returns that file's hash if one matches, and the partial
+// fingerprint of path if it had to be computed. Library rows stored before
+// fingerprints existed are backfilled from their dest_path on the way.
+func prefilterDuplicate(db *DB, path string, size int64, throttle *ioThrottle) (string, string, error) {
+	candidates, err := db.listOutcomingBySize(size)
+	if err != nil || len(candidates) == 0 {
+		// No library file of this size: definitely new
+		return "", "", err
+	}
+	partial, err := partialFileHash(path, size, throttle)
+	if err != nil {
+		return "", "", err
+	}
+	for _, c := range candidates {
+		if c.partialHash == "" {
+			p, err := partialFileHash(c.destPath, size, throttle)
+			if err != nil {
+				continue
+			}
+			if err := db.setOutcomingPartialHash(c.id, p); err != nil {
+				fmt.Println("failed to store partial hash for", c.destPath, ":", err)
+			}
+			c.partialHash = p
+		}
+		if c.partialHash == partial {
+			return c.hash, partial, nil
+		}
+	}
+	return "", partial, nil
+}
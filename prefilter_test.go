@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrefilterDuplicates(t *testing.T) {
+	dest := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), prefilterMinSize/8)
+	first := t.TempDir()
+	if err := os.WriteFile(filepath.Join(first, "IMG_0001.JPG"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runTestScan(t, ProcessingConfig{SrcFolder: first, DestFolder: dest})
+
+	// A copy elsewhere is matched by size and fingerprint without a full read
+	second := t.TempDir()
+	if err := os.WriteFile(filepath.Join(second, "IMG_0001.JPG"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if st := runTestScan(t, ProcessingConfig{SrcFolder: second, DestFolder: dest}); st.Prefiltered != 1 || st.Skipped != 1 {
+		t.Errorf("copy: %d prefiltered, %d skipped; want 1, 1", st.Prefiltered, st.Skipped)
+	}
+
+	// Same size and fingerprint, different bytes between the sampled blocks:
+	// with cleanup on, the full hash decides and the file is imported
+	altered := append([]byte(nil), data...)
+	altered[partialBlockSize+10] ^= 0xff
+	third := t.TempDir()
+	src := filepath.Join(third, "IMG_0001.JPG")
+	if err := os.WriteFile(src, altered, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st := runTestScan(t, ProcessingConfig{SrcFolder: third, DestFolder: dest, Cleanup: CleanupDelete})
+	if st.Prefiltered != 0 || st.Copied != 1 {
+		t.Errorf("altered: %d prefiltered, %d copied; want 0, 1", st.Prefiltered, st.Copied)
+	}
+}
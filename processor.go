@@ -3,11 +3,11 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +17,97 @@ import (
 type ProcessingConfig struct {
 	SrcFolder  string
 	DestFolder string
+	Workers    int // number of concurrent workers, defaults to runtime.NumCPU()
+	// DestTemplate lays out files under DestFolder, e.g. "{year}/{month:02}-{monthName}/{camera}/{name}".
+	// Dates come from EXIF DateTimeOriginal, falling back to mtime. See renderDestTemplate for tokens.
+	DestTemplate string
+	// OnCollision decides what happens when the destination name is taken: suffix, hash or fail
+	OnCollision string
+	// Cleanup removes imported sources once their library copy is verified: none, trash or delete
+	Cleanup string
+	// TrashFolder receives trashed sources, defaults to <SrcFolder>/.photoManager-trash
+	TrashFolder string
+	// TrashRetention is how long trashed sources are kept, defaults to 30 days
+	TrashRetention time.Duration
+	// LinkMode selects how files enter the library: copy, hardlink or reflink (falls back to copy)
+	LinkMode string
+	// DryRun walks and hashes but neither copies nor writes to the DB; the result is an ImportPlan
+	DryRun bool
+	// PlanFile, if set, receives the dry-run plan as JSON (or CSV for a .csv name)
+	PlanFile string
+	// Filters selects which files are imported; junk files are skipped unless Filters.KeepJunk
+	Filters ScanFilters
+	// ForceRehash ignores the hash cache and reads every source file again
+	ForceRehash bool
+	// Upgrade decides what happens to a better copy of a library image: none (import it as a new file) or replace
+	Upgrade string
+	// Takeout treats SrcFolder as a Google Photos Takeout export: media take their
+	// date, location, caption and album tag from the JSON files next to them
+	Takeout bool
+	// Tags are added to every file the scan imports, and to library files it finds again
+	Tags []string
+	// Profile names the source profile the scan was started from, "" for ad hoc scans
+	Profile string
+	// RulesFile is a JSON file of rules that tag files, file them under a subtree,
+	// send them to another library or skip them; see Rule
+	RulesFile string
+	// FolderTags turns the source folders of a file into tags or an album
+	FolderTags FolderTags
+	// SpaceCheck decides what happens when the import may not fit on DestFolder: fail, warn or off
+	SpaceCheck string
+	// DiskReserve is the free space, in bytes, imports leave on DestFolder (default 1 GiB)
+	DiskReserve int64
+	// Throttle caps the copy and hash reads of the job; it can be changed while the job runs
+	Throttle ThrottleLimits
+
+	// filter is the compiled form of Filters
+	filter *scanFilter
+	// folders is the compiled form of FolderTags, nil when it is off
+	folders *folderTagger
+	// rules is the compiled form of RulesFile, nil without one
+	rules *ruleSet
+	// decisions holds what the rules decided for each file of this scan, set by scanSource
+	decisions *ruleDecisions
+	// routedFrom is the job whose rules sent the files of this scan to this library
+	routedFrom int64
+	// files, if set, are processed instead of walking SrcFolder (used by watch mode)
+	files []string
+	// archives holds the archives this scan reads open, set by runScan
+	archives *scanArchives
+	// takeout reads the JSON metadata of a Takeout export, set by runScan when Takeout is on
+	takeout *takeoutIndex
+	// plan is filled by a dry-run, or followed exactly when executing a saved plan
+	plan *ImportPlan
+	// job is the job running this scan, set by startProcessing
+	job *Job
+	// runID is the scan_runs row checkpointing this scan (0 for dry-runs)
+	runID int64
+	// resumeAfter is the last checkpointed path of a resumed run; files up to it are skipped
+	resumeAfter string
+	// resumeProcessed and resumeTotals are the counters of the run being resumed
+	resumeProcessed int64
+	resumeTotals    RunTotals
+}
+
+// throttle returns the read limiter of the job running the scan, nil outside of a job
+func (c ProcessingConfig) throttle() *ioThrottle {
+	if c.job == nil {
+		return nil
+	}
+	return c.job.throttle
+}
+
+// executingPlan reports whether this run follows a previously reviewed plan
+func (c ProcessingConfig) executingPlan() bool {
+	return c.plan != nil && !c.DryRun
+}
+
+// plannedEntry returns the plan entry for a source path when executing a plan
+func (c ProcessingConfig) plannedEntry(path string) *PlanEntry {
+	if !c.executingPlan() {
+		return nil
+	}
+	return c.plan.entryFor(path)
 }
 
 // CarrierPayload Carrier Payload
@@ -33,32 +124,245 @@ type FileInfo struct {
 	metadata      string
 	fileType      string
 	tags          []string
+	album         string         // album derived from the source folders, see FolderTags
+	importMethod  string         // copy, hardlink or reflink
+	collision     bool           // destPath had to be renamed (or the copy refused) because the name was taken
+	err           error          // set when processing the file failed
+	incomingID    int64          // ledger row written before the copy started, 0 if none
+	claimant      string         // source file that imported this content earlier in the same scan, if any
+	runID         int64          // scan run the file belongs to
+	hashCached    bool           // hash came from the hash cache instead of reading the file
+	prefiltered   bool           // hash taken from the library duplicate matched by size and partial fingerprint
+	partialHash   string         // head/middle/tail fingerprint, see partialFileHash
+	phash         string         // perceptual hash of images, see dHash
+	replaces      *upgradeTarget // library file this better copy replaces in place, nil for new files
+	stackKey      string         // stack the file belongs to, see stackIndex
+	stackCover    bool           // the file is the cover of its stack
+	sidecars      []sidecarFile  // sidecars travelling with the file, see sidecarIndex
 }
 
 type ScanStatus struct {
-	Status      string    `json:"status"`      // idle, scanning, processing, completed, error
-	TotalFiles  int64     `json:"totalFiles"`  // Total files found
-	Processed   int64     `json:"processed"`   // Files processed
-	Copied      int64     `json:"copied"`      // Files successfully copied
-	Skipped     int64     `json:"skipped"`     // Files skipped (already copied)
-	Failed      int64     `json:"failed"`      // Files that failed
-	StartTime   time.Time `json:"startTime"`   // When sync started
-	EndTime     time.Time `json:"endTime"`     // When sync ended (if completed)
-	CurrentFile string    `json:"currentFile"` // Current file being processed
-	Error       string    `json:"error"`       // Error message if status is error
+	Status         string         `json:"status"`                       // idle, queued, scanning, processing, paused, completed, cancelled, error
+	TotalFiles     int64          `json:"totalFiles"`                   // Total files found
+	Processed      int64          `json:"processed"`                    // Files processed
+	Copied         int64          `json:"copied"`                       // Files successfully copied
+	Skipped        int64          `json:"skipped"`                      // Files skipped (already copied)
+	Filtered       int64          `json:"filtered"`                     // Files skipped by include/exclude/junk filters
+	Failed         int64          `json:"failed"`                       // Files that failed
+	HashHits       int64          `json:"hashCacheHits"`                // Hashes reused from the hash cache
+	HashMisses     int64          `json:"hashCacheMisses"`              // Files that had to be read and hashed
+	Prefiltered    int64          `json:"prefiltered"`                  // Duplicates found by size and partial fingerprint without a full hash
+	HashHitRate    float64        `json:"hashCacheHitRate"`             // HashHits / (HashHits + Prefiltered + HashMisses)
+	Upgraded       int64          `json:"upgraded"`                     // Copied files that replaced a lower-quality library version
+	Routed         int64          `json:"routed"`                       // Files a rule sent to another library
+	Sidecars       int64          `json:"sidecars"`                     // Sidecars placed next to their media file
+	Orphans        int64          `json:"orphanSidecars"`               // Sidecars without a media file, not imported
+	OrphanFiles    []string       `json:"orphanSidecarFiles,omitempty"` // The first maxOrphanReport orphan sidecars
+	StartTime      time.Time      `json:"startTime"`                    // When sync started
+	EndTime        time.Time      `json:"endTime"`                      // When sync ended (if completed)
+	CurrentFile    string         `json:"currentFile"`                  // Current file being processed
+	Error          string         `json:"error"`                        // Error message if status is error
+	JobID          int64          `json:"jobId,omitempty"`              // Job this status belongs to
+	Watch          *WatchStatus   `json:"watch,omitempty"`              // Watch mode state, if a watcher was started
+	Sources        []SourceStatus `json:"sources,omitempty"`            // Per-source counters of a multi-source scan
+	EstimatedBytes int64          `json:"estimatedBytes,omitempty"`     // About how many bytes the scan writes, see estimateWrites
+	FreeBytes      int64          `json:"freeBytes,omitempty"`          // Free space on the destination when the scan started
+	SpaceWarning   string         `json:"spaceWarning,omitempty"`       // Set when the estimate does not fit in the free space
+}
+
+// SourceStatus counts the files of one source of a multi-source scan
+type SourceStatus struct {
+	Profile    string    `json:"profile"`         // Source profile name
+	Src        string    `json:"src"`             // Source folder
+	Status     string    `json:"status"`          // queued, scanning, completed, cancelled, error
+	RunID      int64     `json:"runId,omitempty"` // scan_runs row of the source
+	TotalFiles int64     `json:"totalFiles"`
+	Copied     int64     `json:"copied"`
+	Skipped    int64     `json:"skipped"`
+	Filtered   int64     `json:"filtered"`
+	Failed     int64     `json:"failed"`
+	Upgraded   int64     `json:"upgraded"`
+	Routed     int64     `json:"routed"`
+	Sidecars   int64     `json:"sidecars"`
+	StartTime  time.Time `json:"startTime"`
+	EndTime    time.Time `json:"endTime"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// scanTracker guards the ScanStatus of one job, written by the pipeline and read by the API
+type scanTracker struct {
+	mu     sync.RWMutex
+	status ScanStatus
+	plan   *ImportPlan // plan produced by a dry-run
+	paused bool
+	source int // index in status.Sources of the source being scanned, -1 if none
 }
 
-var scanStatus *ScanStatus = &ScanStatus{
-	Status:     "idle",
-	TotalFiles: 0,
-	Processed:  0,
-	Copied:     0,
-	Skipped:    0,
-	Failed:     0,
+func newScanTracker() *scanTracker {
+	return &scanTracker{status: ScanStatus{Status: "queued"}, source: -1}
+}
+
+// GetScanStatus returns a snapshot of the status of the latest job
+func GetScanStatus() ScanStatus {
+	status := ScanStatus{Status: "idle"}
+	if job := jobs.latest(); job != nil {
+		status = job.Info().Status
+	}
+	status.Watch = currentWatchStatus()
+	return status
+}
+
+func (t *scanTracker) snapshot() ScanStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	status := t.status
+	status.Sources = append([]SourceStatus(nil), t.status.Sources...)
+	return status
+}
+
+// lastPlan returns the plan produced by the job's dry-run, if any
+func (t *scanTracker) lastPlan() *ImportPlan {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.plan
+}
+
+func (t *scanTracker) setPlan(plan *ImportPlan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.plan = plan
+}
+
+// begin resets the counters for a new scan; the sources of a multi-source scan are kept
+func (t *scanTracker) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = ScanStatus{Status: "scanning", StartTime: time.Now(), Sources: t.status.Sources}
+	if t.paused {
+		t.status.Status = "paused"
+	}
 }
 
-func GetScanStatus() *ScanStatus {
-	return scanStatus
+func (t *scanTracker) record(fileInfo FileInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	updateScanStatus(fileInfo, &t.status)
+	if t.paused {
+		t.status.Status = "paused"
+	}
+	if t.source >= 0 {
+		updateSourceStatus(fileInfo, &t.status.Sources[t.source])
+	}
+}
+
+// recordFiltered counts a file that was skipped by the scan filters
+func (t *scanTracker) recordFiltered() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Filtered++
+	if t.source >= 0 {
+		t.status.Sources[t.source].Filtered++
+	}
+}
+
+// recordRouted counts a file that a rule sent to another library
+func (t *scanTracker) recordRouted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Routed++
+	if t.source >= 0 {
+		t.status.Sources[t.source].Routed++
+	}
+}
+
+// setSpace records the space preflight of the scan
+func (t *scanTracker) setSpace(estimate, free int64, warning string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.EstimatedBytes = estimate
+	t.status.FreeBytes = free
+	t.status.SpaceWarning = warning
+}
+
+// setSources lists the sources of a multi-source scan before it starts
+func (t *scanTracker) setSources(sources []SourceStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Sources = sources
+}
+
+// beginSource marks source i of a multi-source scan as the one being scanned
+func (t *scanTracker) beginSource(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.source = i
+	t.status.Sources[i].Status = "scanning"
+	t.status.Sources[i].StartTime = time.Now()
+}
+
+// sourceRun records the scan run of the source being scanned
+func (t *scanTracker) sourceRun(runID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.source >= 0 {
+		t.status.Sources[t.source].RunID = runID
+	}
+}
+
+// endSource marks the source being scanned as completed, cancelled, or as error if err is non-nil
+func (t *scanTracker) endSource(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.source < 0 {
+		return
+	}
+	s := &t.status.Sources[t.source]
+	s.EndTime = time.Now()
+	s.Status, s.Error = endStatus(err)
+	t.source = -1
+}
+
+// recordOrphanSidecar reports a sidecar that has no media file
+func (t *scanTracker) recordOrphanSidecar(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Orphans++
+	if len(t.status.OrphanFiles) < maxOrphanReport {
+		t.status.OrphanFiles = append(t.status.OrphanFiles, path)
+	}
+}
+
+// setPaused flags the job as paused; files already in flight still complete
+func (t *scanTracker) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+	switch {
+	case paused && (t.status.Status == "scanning" || t.status.Status == "processing"):
+		t.status.Status = "paused"
+	case !paused && t.status.Status == "paused":
+		t.status.Status = "processing"
+	}
+}
+
+// finish marks the scan as completed, cancelled, or as error if err is non-nil
+func (t *scanTracker) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.EndTime = time.Now()
+	t.status.CurrentFile = ""
+	t.status.Status, t.status.Error = endStatus(err)
+}
+
+// endStatus returns the final status of a scan that stopped with err, and its error message
+func endStatus(err error) (string, string) {
+	if errors.Is(err, errJobCancelled) {
+		return "cancelled", ""
+	}
+	if err != nil {
+		return "error", err.Error()
+	}
+	return "completed", ""
 }
 
 func updateScanStatus(fileInfo FileInfo, scanStatus *ScanStatus) {
@@ -66,10 +370,45 @@ func updateScanStatus(fileInfo FileInfo, scanStatus *ScanStatus) {
 	scanStatus.TotalFiles++
 	scanStatus.Processed++
 	scanStatus.CurrentFile = fileInfo.name
-	if fileInfo.copied {
+	if fileInfo.hash != "" {
+		if fileInfo.hashCached {
+			scanStatus.HashHits++
+		} else if fileInfo.prefiltered {
+			scanStatus.Prefiltered++
+		} else {
+			scanStatus.HashMisses++
+		}
+		scanStatus.HashHitRate = float64(scanStatus.HashHits) / float64(scanStatus.HashHits+scanStatus.Prefiltered+scanStatus.HashMisses)
+	}
+	if fileInfo.err == nil {
+		scanStatus.Sidecars += int64(len(fileInfo.sidecars))
+	}
+	if fileInfo.err != nil {
+		scanStatus.Failed++
+	} else if fileInfo.copied {
 		scanStatus.Skipped++
 	} else {
 		scanStatus.Copied++
+		if fileInfo.replaces != nil {
+			scanStatus.Upgraded++
+		}
+	}
+}
+
+func updateSourceStatus(fileInfo FileInfo, s *SourceStatus) {
+	s.TotalFiles++
+	if fileInfo.err != nil {
+		s.Failed++
+	} else if fileInfo.copied {
+		s.Skipped++
+	} else {
+		s.Copied++
+		if fileInfo.replaces != nil {
+			s.Upgraded++
+		}
+	}
+	if fileInfo.err == nil {
+		s.Sidecars += int64(len(fileInfo.sidecars))
 	}
 }
 
@@ -98,107 +437,251 @@ FileInfo:
 }
 
 func walkFiles(db *DB, config ProcessingConfig, incomingIDsToDelete *[]int64, fileInfoChan chan<- FileInfo) error {
-	fmt.Println("Walking files from", config.SrcFolder)
-	return filepath.Walk(config.SrcFolder,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			modTime := info.ModTime()
-			dstPath := filepath.Join(config.DestFolder, strconv.Itoa(modTime.Year()), modTime.Month().String(), info.Name())
-
-			hash, err := computeFileHash(path)
-			if err != nil {
-				return fmt.Errorf("failed to compute hash for %s: %w", path, err)
-			}
-			fmt.Println("computed hash for", path, hash)
-			// Check if already in outcoming by hash to determine copied status
-			_, _, exists, err := db.findOutcomingByHash(hash)
-			if err != nil {
-				return fmt.Errorf("failed to find outcoming by hash for %s: %w", path, err)
-			}
-
-			// Determine file type
-			fileType := getFileType(path)
-
-			fileInfo := FileInfo{
-				name:          info.Name(),
-				size:          info.Size(),
-				modifiedAt:    modTime,
-				modifiedAtStr: modTime.Format("2006-January-02"),
-				srcPath:       path,
-				destPath:      dstPath,
-				hash:          hash,
-				copied:        exists,
-				fileType:      fileType,
-				tags:          []string{},
-			}
+	// When resuming, files up to the last checkpoint were already handled
+	resumed := config.resumeSkip()
+
+	if config.executingPlan() {
+		fmt.Println("Executing plan for", config.SrcFolder, "with", config.workerCount(), "workers")
+		return runPipeline(db, config, incomingIDsToDelete, fileInfoChan, func(emit func(path string, info os.FileInfo) error) error {
+			emit = ruleGate(config, emit)
+			return walkPlan(config, config.plan, func(path string, info os.FileInfo) error {
+				if resumed(path) {
+					config.archives.release(path)
+					return nil
+				}
+				return emit(path, info)
+			})
+		})
+	}
 
-			incomingID, ierr := db.insertIncomingRecord(fileInfo)
-			if ierr != nil {
-				return fmt.Errorf("failed to insert incoming record for %s: %w", path, ierr)
+	if config.files != nil {
+		fmt.Println("Processing", len(config.files), "files from", config.SrcFolder, "with", config.workerCount(), "workers")
+		return runPipeline(db, config, incomingIDsToDelete, fileInfoChan, func(emit func(path string, info os.FileInfo) error) error {
+			emit = ruleGate(config, emit)
+			sidecars := newSidecarIndex(config.takeout)
+			batch := make(map[string]bool, len(config.files))
+			for _, path := range config.files {
+				batch[path] = true
 			}
-			// If already copied, skip file processing
-			if fileInfo.copied {
-				fileInfoChan <- fileInfo
-				return nil
-			}
-
-			// Generate thumbnail and get thumbnail path
-			thumbnailPath, terr := processThumbnail(dstPath, config.DestFolder)
-			if terr != nil {
-				// Don't fail the copy operation if thumbnail generation fails
-				fmt.Println("thumbnail generation failed for", dstPath, ":", terr)
+			for _, path := range config.files {
+				if resumed(path) {
+					continue
+				}
+				info, err := os.Lstat(path)
+				if isArchiveMember(path) {
+					// Files a rule routed here from inside a zip archive
+					info, err = statSource(path)
+				}
+				if err != nil {
+					fmt.Println("skipping", path, ":", err)
+					continue
+				}
+				if archiveKind(path) != "" && info.Mode().IsRegular() && !isArchiveMember(path) {
+					if err := walkArchive(config, path, walkVisitor(db, config, resumed, sidecars), emit); err != nil {
+						return err
+					}
+					continue
+				}
+				if reason := config.filter.skipFile(path, info); reason != "" {
+					fmt.Println("skipping", path, ":", reason)
+					config.job.tracker.recordFiltered()
+					continue
+				}
+				if sidecarKind(path) != "" {
+					// A sidecar written after its media file was imported brings
+					// the media file back in, which attaches it as a duplicate
+					primary := walkSidecar(db, config, sidecars, path, info)
+					if primary == "" || batch[primary] {
+						continue
+					}
+					batch[primary] = true
+					if info, err = os.Lstat(primary); err != nil || config.filter.skipFile(primary, info) != "" {
+						continue
+					}
+					path = primary
+				}
+				if err := emit(path, info); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+	}
 
-			// Update FileInfo with thumbnail path
-			fileInfo.thumbnailPath = thumbnailPath
-
-			// Build metadata (EXIF for images, XMP/EXIF for videos) and store JSON in DB
-			metadataJSON := BuildMetadataJSON(dstPath)
-			fileInfo.metadata = metadataJSON
+	fmt.Println("Walking files from", config.SrcFolder, "with", config.workerCount(), "workers")
+	return runPipeline(db, config, incomingIDsToDelete, fileInfoChan, func(emit func(path string, info os.FileInfo) error) error {
+		emit = ruleGate(config, emit)
+		visit := walkVisitor(db, config, resumed, newSidecarIndex(config.takeout))
+		return filepath.Walk(config.SrcFolder,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
 
-			err = ensureDirectory(filepath.Dir(dstPath))
-			if err != nil {
-				if incomingID > 0 {
-					_ = db.markIncomingFailure(incomingID, fmt.Sprintf("mkdir failed: %v", err))
+				if info.IsDir() {
+					// Never re-import our own trash
+					if path != config.SrcFolder && (path == config.trashFolder() || path == config.DestFolder || config.filter.skipDir(path, info)) {
+						return filepath.SkipDir
+					}
+					return nil
 				}
-				return fmt.Errorf("failed to create destination directory for %s: %w", path, err)
-			}
 
-			if err := copyFile(path, dstPath, info.Name(), db, incomingID); err != nil {
-				return fmt.Errorf("failed to copy file %s: %w", path, err)
-			}
+				// Archives are walked like directories
+				if archiveKind(path) != "" && info.Mode().IsRegular() {
+					if path != config.SrcFolder && config.filter.skipDir(path, info) {
+						return nil
+					}
+					return walkArchive(config, path, visit, emit)
+				}
 
-			*incomingIDsToDelete = append(*incomingIDsToDelete, incomingID)
+				return visit(path, info, emit)
+			})
+	})
+}
 
-			if _, err := db.insertOutcomingRecord(fileInfo); err != nil {
-				return fmt.Errorf("failed to insert outcoming record for %s: %w", path, err)
-			}
+// walkVisitor returns the checks a walked file or archive member goes through before it is emitted
+func walkVisitor(db *DB, config ProcessingConfig, resumed func(string) bool, sidecars *sidecarIndex) func(path string, info os.FileInfo, emit func(path string, info os.FileInfo) error) error {
+	return func(path string, info os.FileInfo, emit func(path string, info os.FileInfo) error) error {
+		if resumed(path) {
+			return nil
+		}
 
-			// Send fileInfo to channel
-			fileInfoChan <- fileInfo
+		if reason := config.filter.skipFile(path, info); reason != "" {
+			fmt.Println("skipping", path, ":", reason)
+			config.job.tracker.recordFiltered()
+			return nil
+		}
 
+		// Sidecars travel with their media file
+		if sidecarKind(path) != "" {
+			walkSidecar(db, config, sidecars, path, info)
 			return nil
-		})
+		}
+
+		return emit(path, info)
+	}
+}
+
+// startProcessing validates the config and queues the scan as a job; the job's
+// Done channel is closed once the scan has finished
+func startProcessing(config ProcessingConfig) (*Job, error) {
+	if err := prepareScan(&config); err != nil {
+		return nil, err
+	}
+	return jobs.submit(config, func(job *Job) {
+		config.job = job
+		runScan(config)
+	}), nil
 }
 
-func fileProcessing(config ProcessingConfig) error {
+// prepareScan creates the destination, validates the settings and compiles the filters of a scan
+func prepareScan(config *ProcessingConfig) error {
 	// Initialize destination directory
 	if err := ensureDirectory(config.DestFolder); err != nil {
 		return fmt.Errorf("failed to initialize destination directory: %w", err)
 	}
 
+	if err := validateDestTemplate(config.destTemplate()); err != nil {
+		return fmt.Errorf("invalid destination template: %w", err)
+	}
+
+	if err := validateCollisionStrategy(config.collisionStrategy()); err != nil {
+		return err
+	}
+	if err := validateCleanupMode(config.cleanupMode()); err != nil {
+		return err
+	}
+	if err := validateLinkMode(config.linkMode()); err != nil {
+		return err
+	}
+	if err := validateUpgradeMode(config.upgradeMode()); err != nil {
+		return err
+	}
+	if err := validateSpaceCheck(config.spaceCheck()); err != nil {
+		return err
+	}
+	if config.DiskReserve < 0 {
+		return fmt.Errorf("invalid disk reserve %d", config.DiskReserve)
+	}
+	if err := config.Throttle.validate(); err != nil {
+		return err
+	}
+
+	filter, err := compileFilters(config.SrcFolder, config.Filters)
+	if err != nil {
+		return fmt.Errorf("invalid filters: %w", err)
+	}
+	config.filter = filter
+
+	if config.RulesFile != "" {
+		rules, err := loadRules(config.RulesFile)
+		if err != nil {
+			return fmt.Errorf("invalid rules: %w", err)
+		}
+		config.rules = rules
+	}
+
+	folders, err := compileFolderTags(config.FolderTags)
+	if err != nil {
+		return err
+	}
+	config.folders = folders
+	return nil
+}
+
+// runScan runs a queued scan to completion; it is called by the job queue
+func runScan(config ProcessingConfig) {
+	fmt.Println("Starting", config.job)
+	config.job.tracker.begin()
+	config.job.tracker.finish(scanSource(config))
+}
+
+// scanSource imports config.SrcFolder into the library and returns the error
+// that stopped the walk, if any. A multi-source job calls it once per source.
+func scanSource(config ProcessingConfig) error {
+	tracker := config.job.tracker
+
 	// Initialize database
 	db, err := initializeDB(config.DestFolder)
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
+	defer db.Close()
+
+	if config.Takeout {
+		config.takeout = newTakeoutIndex()
+	}
+	config.archives = newScanArchives(config)
+	defer config.archives.close()
+	if config.rules != nil {
+		config.decisions = newRuleDecisions(config.rules)
+	}
+	if config.DryRun {
+		config.plan = newImportPlan(config)
+	} else {
+		// Finish what a crashed scan left behind before starting a new one
+		if runs, err := reconcileInterruptedRuns(db); err != nil {
+			fmt.Println("failed to reconcile interrupted scans:", err)
+		} else if len(runs) > 0 {
+			fmt.Println(len(runs), "interrupted scan(s) can be resumed with -resume or POST /api/scan/resume/{id}")
+		}
+		if err := preflightSpace(db, config); err != nil {
+			return err
+		}
+		if err := beginScanRun(db, &config); err != nil {
+			return fmt.Errorf("failed to record scan run: %w", err)
+		}
+		tracker.sourceRun(config.runID)
+	}
+
+	// Drop trashed sources that are past their retention period
+	if config.cleanupMode() == CleanupTrash && !config.DryRun {
+		if n, err := purgeTrash(db, config.trashRetention()); err != nil {
+			fmt.Println("failed to purge trash:", err)
+		} else if n > 0 {
+			fmt.Println("purged", n, "expired trashed sources")
+		}
+	}
 
 	incomingIDsToDelete := make([]int64, 0, 128)
 
@@ -216,6 +699,10 @@ func fileProcessing(config ProcessingConfig) error {
 		defer wg.Done()
 		defer close(fileInfoChan)
 		if err := walkFiles(db, config, &incomingIDsToDelete, fileInfoChan); err != nil {
+			if errors.Is(err, errJobCancelled) {
+				errChan <- err
+				return
+			}
 			errChan <- fmt.Errorf("failed to walk source directory: %w", err)
 			return
 		}
@@ -230,32 +717,46 @@ func fileProcessing(config ProcessingConfig) error {
 		defer printWg.Done()
 		for fileInfo := range fileInfoChan {
 			fileInfoArr = append(fileInfoArr, fileInfo)
-			updateScanStatus(fileInfo, scanStatus)
+			tracker.record(fileInfo)
 		}
 	}()
 
-	go func() {
-		// Wait for walk goroutine to complete
-		wg.Wait()
+	// Wait for walk goroutine to complete
+	wg.Wait()
 
-		// Wait for printing goroutine to complete (channel is closed, so it will finish processing)
-		printWg.Wait()
+	// Wait for printing goroutine to complete (channel is closed, so it will finish processing)
+	printWg.Wait()
 
-		// Check for errors (goroutine has completed, so channel will have a value)
-		if walkErr := <-errChan; walkErr != nil {
-			fmt.Println("failed to walk source directory:", walkErr)
-		}
+	// Check for errors (goroutine has completed, so channel will have a value)
+	walkErr := <-errChan
+	if errors.Is(walkErr, errJobCancelled) {
+		fmt.Println("Cancelled", config.job)
+	} else if walkErr != nil {
+		fmt.Println("failed to walk source directory:", walkErr)
+	}
 
-		// Delete all incoming records in a single batch operation
-		if len(incomingIDsToDelete) > 0 {
-			if err := db.deleteIncomingByIDs(incomingIDsToDelete); err != nil {
-				fmt.Println("failed to delete incoming records:", err)
+	// Delete all incoming records in a single batch operation
+	if len(incomingIDsToDelete) > 0 {
+		if err := db.deleteIncomingByIDs(incomingIDsToDelete); err != nil {
+			fmt.Println("failed to delete incoming records:", err)
+		}
+	}
+	if config.DryRun && walkErr == nil {
+		config.plan.finalize()
+		tracker.setPlan(config.plan)
+		if config.PlanFile != "" {
+			if err := savePlan(config.plan, config.PlanFile); err != nil {
+				fmt.Println("failed to save plan:", err)
+			} else {
+				fmt.Println("Saved import plan to", config.PlanFile)
 			}
 		}
-		defer db.Close()
-	}()
-
-	return nil
+	}
+	finishScanRun(db, config, walkErr)
+	if !config.DryRun && !errors.Is(walkErr, errJobCancelled) {
+		config.decisions.startRouted(config)
+	}
+	return walkErr
 }
 
 // ensureDirectory creates a directory if it doesn't exist
@@ -269,40 +770,110 @@ func ensureDirectory(dirPath string) error {
 }
 
 // copyFile copies a file from source to destination
+// The data is written to a temp file in the destination directory, fsynced,
+// re-hashed against expectedHash (if set) and only then moved into place.
+// Source permissions and timestamps are preserved. An existing dstPath is never replaced.
 // Returns an error if the copy fails
 // If db and incomingID are provided, marks the incoming record as failed on error
-func copyFile(srcPath, dstPath, fileName string, db *DB, incomingID int64) error {
-	existingFile, err := os.Open(srcPath)
-	if err != nil {
-		fmt.Println("open src failed:", srcPath, err)
+// Reads go through throttle, if set
+func copyFile(srcPath, dstPath, expectedHash string, db *DB, incomingID int64, throttle *ioThrottle) error {
+	fail := func(stage string, err error) error {
+		fmt.Println(stage, "failed:", srcPath, "->", dstPath, err)
 		if db != nil && incomingID > 0 {
-			_ = db.markIncomingFailure(incomingID, fmt.Sprintf("open src failed: %v", err))
+			_ = db.markIncomingFailure(incomingID, fmt.Sprintf("%s failed: %v", stage, err))
 		}
-		return fmt.Errorf("failed to open source file: %w", err)
+		return fmt.Errorf("%s failed: %w", stage, err)
+	}
+
+	existingFile, srcInfo, err := openSource(srcPath)
+	if err != nil {
+		return fail("open src", err)
 	}
 	defer existingFile.Close()
 
-	dstFile, err := os.Create(dstPath)
+	tmpFile, err := os.CreateTemp(filepath.Dir(dstPath), ".photoManager-*.tmp")
 	if err != nil {
-		fmt.Println("create dst failed:", dstPath, err)
-		if db != nil && incomingID > 0 {
-			_ = db.markIncomingFailure(incomingID, fmt.Sprintf("create dst failed: %v", err))
+		return fail("create temp", err)
+	}
+	tmpPath := tmpFile.Name()
+	// Remove the temp file unless it was successfully moved into place
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmpPath)
 		}
-		return fmt.Errorf("failed to create destination file: %w", err)
+	}()
+
+	if _, err := io.Copy(tmpFile, throttle.reader(existingFile)); err != nil {
+		tmpFile.Close()
+		return fail("copy", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fail("fsync", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fail("close", err)
 	}
-	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, existingFile); err != nil {
-		fmt.Println("Unable to copy file --> ", fileName, err.Error())
-		if db != nil && incomingID > 0 {
-			_ = db.markIncomingFailure(incomingID, fmt.Sprintf("copy failed: %v", err))
+	if expectedHash != "" {
+		written, err := readFileHash(tmpPath, throttle)
+		if err != nil {
+			return fail("verify", err)
+		}
+		if written != expectedHash {
+			return fail("verify", fmt.Errorf("hash mismatch: expected %s, got %s", expectedHash, written))
 		}
-		return fmt.Errorf("failed to copy file: %w", err)
 	}
 
+	if err := preserveAttributes(tmpPath, srcInfo); err != nil {
+		return fail("preserve attributes", err)
+	}
+
+	if err := renameNoReplace(tmpPath, dstPath); err != nil {
+		return fail("rename", err)
+	}
+	committed = true
+	syncDir(filepath.Dir(dstPath))
+
 	return nil
 }
 
+// preserveAttributes copies permission bits and access/modification times from src onto path
+func preserveAttributes(path string, src os.FileInfo) error {
+	if err := os.Chmod(path, src.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fileAccessTime(src), src.ModTime())
+}
+
+// renameNoReplace moves oldPath to newPath, failing if newPath already exists.
+// A hard link is used where possible since it fails atomically on an existing target.
+func renameNoReplace(oldPath, newPath string) error {
+	err := os.Link(oldPath, newPath)
+	if err == nil {
+		return os.Remove(oldPath)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	// Filesystem without hard link support: check then rename
+	if destExists(newPath) {
+		return fmt.Errorf("%s already exists", newPath)
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// syncDir fsyncs a directory so a rename into it survives a crash (best-effort)
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
+
 // initializeDB opens and initializes the SQLite database connection
 // Returns the database connection and any error encountered
 func initializeDB(destFolder string) (*DB, error) {
@@ -319,13 +890,18 @@ func initializeDB(destFolder string) (*DB, error) {
 }
 
 func computeFileHash(path string) (string, error) {
-	f, err := os.Open(path)
+	return readFileHash(path, nil)
+}
+
+// readFileHash hashes a file, reading it through throttle if set
+func readFileHash(path string, throttle *ioThrottle) (string, error) {
+	f, _, err := openSource(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 	hasher := sha256.New()
-	if _, err := io.Copy(hasher, f); err != nil {
+	if _, err := io.Copy(hasher, throttle.reader(f)); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(hasher.Sum(nil)), nil
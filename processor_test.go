@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileVerifiesAndNeverOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.jpg")
+	if err := os.WriteFile(src, []byte("source bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := computeFileHash(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst.jpg")
+	if err := copyFile(src, dst, "0000", nil, 0, nil); err == nil {
+		t.Error("a copy with the wrong hash succeeded")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("unverified copy left in place: %v", err)
+	}
+
+	if err := copyFile(src, dst, hash, nil, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := computeFileHash(dst); err != nil || got != hash {
+		t.Errorf("copy hash %s, %v; want %s", got, err, hash)
+	}
+
+	// An existing destination is never replaced
+	if err := os.WriteFile(src, []byte("other bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst, "", nil, 0, nil); err == nil {
+		t.Error("an existing destination was overwritten")
+	}
+	if got, _ := computeFileHash(dst); got != hash {
+		t.Error("the existing destination changed")
+	}
+
+	temps, _ := filepath.Glob(filepath.Join(dir, ".photoManager-*.tmp"))
+	if len(temps) != 0 {
+		t.Errorf("temp files left behind: %v", temps)
+	}
+}
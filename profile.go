@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Source profile modes
+const (
+	ProfileCopy = "copy" // sources stay where they are
+	ProfileMove = "move" // sources are cleaned up once their library copy is verified
+)
+
+// SourceProfile is a named source the library imports from: a card, a NAS
+// share, a phone dump. Profiles are stored in the source_profiles table.
+type SourceProfile struct {
+	ID        int64       `json:"id"`
+	Name      string      `json:"name"`
+	Src       string      `json:"src"`
+	Filters   ScanFilters `json:"filters"`
+	Layout    string      `json:"layout"` // destination template, "" for the scan's
+	Tags      []string    `json:"tags"`   // added to every file imported from the source
+	Mode      string      `json:"mode"`   // copy or move
+	CreatedAt string      `json:"createdAt"`
+	UpdatedAt string      `json:"updatedAt"`
+}
+
+// validate normalizes a profile and checks its settings
+func (p *SourceProfile) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	// Profiles are listed comma-separated on the command line
+	if strings.Contains(p.Name, ",") {
+		return errors.New("name cannot contain commas")
+	}
+	if p.Src = strings.TrimSpace(p.Src); p.Src == "" {
+		return errors.New("src is required")
+	}
+	if p.Mode == "" {
+		p.Mode = ProfileCopy
+	}
+	if p.Mode != ProfileCopy && p.Mode != ProfileMove {
+		return fmt.Errorf("invalid mode %q (want %s or %s)", p.Mode, ProfileCopy, ProfileMove)
+	}
+	if p.Layout != "" {
+		if err := validateDestTemplate(p.Layout); err != nil {
+			return fmt.Errorf("invalid layout: %w", err)
+		}
+	}
+	if _, err := compileFilters(p.Src, p.Filters); err != nil {
+		return fmt.Errorf("invalid filters: %w", err)
+	}
+	// Tags are stored comma-separated
+	tags := []string{}
+	for _, t := range p.Tags {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if strings.Contains(t, ",") {
+			return fmt.Errorf("tag %q cannot contain commas", t)
+		}
+		tags = append(tags, t)
+	}
+	p.Tags = tags
+	return nil
+}
+
+// apply returns the config of a scan of the profile's source. Source, filters,
+// layout, tags and cleanup come from the profile, everything else from base.
+// A move cleans up with base's mode, or trashes sources if base has none.
+func (p SourceProfile) apply(base ProcessingConfig) ProcessingConfig {
+	c := base
+	c.Profile = p.Name
+	c.SrcFolder = p.Src
+	c.Filters = p.Filters
+	if p.Layout != "" {
+		c.DestTemplate = p.Layout
+	}
+	c.Tags = append(append([]string(nil), base.Tags...), p.Tags...)
+	if p.Mode == ProfileMove {
+		if c.cleanupMode() == CleanupNone {
+			c.Cleanup = CleanupTrash
+		}
+	} else {
+		c.Cleanup = CleanupNone
+	}
+	return c
+}
+
+// profileConfigs returns the scan configs of the named profiles, in order
+func profileConfigs(db *DB, names []string, base ProcessingConfig) ([]ProcessingConfig, error) {
+	seen := map[string]bool{}
+	var configs []ProcessingConfig
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		p, err := db.getSourceProfileByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, fmt.Errorf("unknown source profile %q", name)
+		}
+		configs = append(configs, p.apply(base))
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no source profiles given")
+	}
+	return configs, nil
+}
+
+// startSources queues one job that scans every config into the same library,
+// one source after the other, with counters per source. A single config is an
+// ordinary scan.
+func startSources(configs []ProcessingConfig) (*Job, error) {
+	if len(configs) == 1 {
+		return startProcessing(configs[0])
+	}
+	srcs := make([]string, len(configs))
+	sources := make([]SourceStatus, len(configs))
+	for i := range configs {
+		if configs[i].DryRun {
+			return nil, errors.New("a dry-run takes a single source")
+		}
+		if configs[i].DestFolder != configs[0].DestFolder {
+			return nil, errors.New("all sources of a scan must go to the same destination")
+		}
+		if err := prepareScan(&configs[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", configs[i].SrcFolder, err)
+		}
+		srcs[i] = configs[i].SrcFolder
+		sources[i] = SourceStatus{Profile: configs[i].Profile, Src: configs[i].SrcFolder, Status: "queued"}
+	}
+
+	base := ProcessingConfig{SrcFolder: strings.Join(srcs, ", "), DestFolder: configs[0].DestFolder, Throttle: configs[0].Throttle}
+	return jobs.submit(base, func(job *Job) {
+		fmt.Println("Starting", job)
+		job.tracker.setSources(sources)
+		job.tracker.begin()
+		var failed []string
+		var err error
+		for i, config := range configs {
+			config.job = job
+			fmt.Println("Scanning source", i+1, "of", len(configs), ":", config.SrcFolder)
+			job.tracker.beginSource(i)
+			err = scanSource(config)
+			job.tracker.endSource(err)
+			if errors.Is(err, errJobCancelled) {
+				break
+			}
+			if err != nil {
+				failed = append(failed, config.SrcFolder)
+				err = nil
+			}
+		}
+		if err == nil && len(failed) > 0 {
+			err = fmt.Errorf("%d of %d sources failed: %s", len(failed), len(configs), strings.Join(failed, ", "))
+		}
+		job.tracker.finish(err)
+	}), nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages of an incoming ledger row. A row moves hashed -> copying -> copied ->
+// recorded and is deleted once the scan finishes; failed rows are retried by the next scan.
+const (
+	stageHashed   = "hashed"   // seen and hashed, nothing written to the library
+	stageCopying  = "copying"  // a copy into destPath has started
+	stageCopied   = "copied"   // destPath is in place and verified, outcoming row not yet written
+	stageRecorded = "recorded" // outcoming row written, incoming row pending deletion
+	stageFailed   = "failed"   // processing failed, see the error column
+)
+
+// Scan run statuses
+const (
+	runRunning     = "running"
+	runInterrupted = "interrupted" // the process died mid-scan; can be resumed
+	runCompleted   = "completed"
+	runError       = "error"
+)
+
+// checkpointEvery is how many recorded files pass between run checkpoints
+const checkpointEvery = 50
+
+// A running scan refreshes the updated_at of its run every runHeartbeat. A
+// run that has not been refreshed for runStaleAfter is taken for dead.
+const (
+	runHeartbeat  = 30 * time.Second
+	runStaleAfter = 3 * runHeartbeat
+)
+
+// runOwner identifies this process in scan_runs.owner
+var runOwner = func() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid())
+}()
+
+// activeRuns holds the runs being processed by this process, which reconcile
+// must not touch, with the channels that stop their heartbeats
+var activeRuns = struct {
+	mu  sync.Mutex
+	ids map[int64]chan struct{}
+}{ids: make(map[int64]chan struct{})}
+
+// setRunActive marks a run as processed by this process, keeping its
+// updated_at fresh until it is set inactive again
+func setRunActive(db *DB, id int64, active bool) {
+	activeRuns.mu.Lock()
+	defer activeRuns.mu.Unlock()
+	if stop, ok := activeRuns.ids[id]; ok {
+		close(stop)
+		delete(activeRuns.ids, id)
+	}
+	if !active {
+		return
+	}
+	stop := make(chan struct{})
+	activeRuns.ids[id] = stop
+	go func() {
+		ticker := time.NewTicker(runHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := db.touchScanRun(id); err != nil {
+					fmt.Println("failed to refresh scan run", id, ":", err)
+				}
+			}
+		}
+	}()
+}
+
+func isRunActive(id int64) bool {
+	activeRuns.mu.Lock()
+	defer activeRuns.mu.Unlock()
+	_, ok := activeRuns.ids[id]
+	return ok
+}
+
+// runIsStale reports whether no process is running a run marked running: it
+// belongs to this process but is not active, its owner on this host has
+// exited, or its heartbeat stopped. A run of another live process is never
+// stale, whichever process shares the DB.
+func runIsStale(run ScanRunRow, now time.Time) bool {
+	if isRunActive(run.ID) {
+		return false
+	}
+	if run.Owner == runOwner {
+		return true
+	}
+	if i := strings.LastIndex(run.Owner, ":"); i >= 0 {
+		host, _ := os.Hostname()
+		if pid, err := strconv.Atoi(run.Owner[i+1:]); err == nil && run.Owner[:i] == host && !processAlive(pid) {
+			return true
+		}
+	}
+	updated, err := time.Parse(time.RFC3339, run.UpdatedAt)
+	return err != nil || now.Sub(updated) > runStaleAfter
+}
+
+// runConfig is what a scan run stores so it can be resumed with the same settings
+type runConfig struct {
+	ProcessingConfig
+	Plan *ImportPlan `json:"plan,omitempty"`
+}
+
+// beginScanRun creates the run row for a scan, or reopens it when resuming
+func beginScanRun(db *DB, config *ProcessingConfig) error {
+	if config.runID != 0 {
+		// A resume may have been queued twice; only the first one runs
+		run, err := db.getScanRun(config.runID)
+		if err != nil {
+			return err
+		}
+		if run == nil {
+			return fmt.Errorf("scan run %d is no longer interrupted", config.runID)
+		}
+		if ok, err := db.reopenScanRun(config.runID, runOwner); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("scan run %d is no longer interrupted", config.runID)
+		}
+		setRunActive(db, config.runID, true)
+		return nil
+	}
+	rc := runConfig{ProcessingConfig: *config}
+	if config.executingPlan() {
+		rc.Plan = config.plan
+	}
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	id, err := db.createScanRun(config.SrcFolder, config.DestFolder, string(data), runOwner)
+	if err != nil {
+		return err
+	}
+	config.runID = id
+	setRunActive(db, id, true)
+	return nil
+}
+
+// finishScanRun records the final status of a run. A cancelled run is left
+// interrupted so that it can be resumed later.
+func finishScanRun(db *DB, config ProcessingConfig, walkErr error) {
+	if config.runID == 0 {
+		return
+	}
+	defer setRunActive(db, config.runID, false)
+	status, errMsg := runCompleted, ""
+	if errors.Is(walkErr, errJobCancelled) {
+		status = runInterrupted
+	} else if walkErr != nil {
+		status, errMsg = runError, walkErr.Error()
+	}
+	if err := db.endScanRun(config.runID, status, errMsg); err != nil {
+		fmt.Println("failed to finish scan run:", err)
+	}
+}
+
+// runCheckpoint is the writer's progress through a run, in walk order
+type runCheckpoint struct {
+	processed int64
+	lastPath  string
+	sinceSave int
+	totals    RunTotals // Found and Filtered are filled in on save
+}
+
+func newRunCheckpoint(config ProcessingConfig) *runCheckpoint {
+	return &runCheckpoint{processed: config.resumeProcessed, totals: config.resumeTotals}
+}
+
+// advance records that fileInfo has been written and periodically saves the checkpoint
+func (cp *runCheckpoint) advance(db *DB, config ProcessingConfig, fileInfo FileInfo) {
+	if config.runID == 0 {
+		return
+	}
+	cp.processed++
+	cp.lastPath = fileInfo.srcPath
+	switch {
+	case fileInfo.err != nil:
+		cp.totals.Failed++
+		if err := db.insertScanRunError(config.runID, fileInfo.srcPath, fileInfo.err.Error()); err != nil {
+			fmt.Println("failed to log scan error:", err)
+		}
+	case fileInfo.copied:
+		cp.totals.Skipped++
+	default:
+		cp.totals.Copied++
+		cp.totals.Bytes += fileInfo.size
+	}
+	cp.sinceSave++
+	if cp.sinceSave >= checkpointEvery {
+		cp.save(db, config)
+	}
+}
+
+func (cp *runCheckpoint) save(db *DB, config ProcessingConfig) {
+	if config.runID == 0 {
+		return
+	}
+	cp.sinceSave = 0
+	totals := cp.totals
+	totals.Filtered += config.job.tracker.snapshot().Filtered
+	totals.Found = cp.processed + totals.Filtered
+	if err := db.checkpointScanRun(config.runID, cp.processed, cp.lastPath, totals); err != nil {
+		fmt.Println("failed to checkpoint scan run:", err)
+	}
+}
+
+// resumeSkip returns a function that reports whether a walked path was
+// already handled by the run being resumed. Walk order is deterministic, so
+// everything up to and including the checkpointed path is skipped. If that
+// path has since disappeared the whole tree is walked again; files already in
+// the library are then recognised as duplicates.
+func (c ProcessingConfig) resumeSkip() func(path string) bool {
+	if c.resumeAfter == "" {
+		return func(string) bool { return false }
+	}
+	if _, err := statSource(c.resumeAfter); err != nil {
+		fmt.Println("checkpoint", c.resumeAfter, "is gone, rescanning everything")
+		return func(string) bool { return false }
+	}
+	skipping := true
+	return func(path string) bool {
+		if !skipping {
+			return false
+		}
+		if path == c.resumeAfter {
+			skipping = false
+		}
+		return true
+	}
+}
+
+// reconcileInterruptedRuns repairs the ledger of every run left "running" by a
+// process that died. Copies that finished are recorded, half-written ones are
+// rolled back, and the run is marked interrupted so it can be resumed. Runs
+// still going in this or another process are left alone, see runIsStale.
+func reconcileInterruptedRuns(db *DB) ([]ScanRunRow, error) {
+	runs, err := db.listScanRunsByStatus(runRunning)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var reconciled []ScanRunRow
+	for _, run := range runs {
+		if !runIsStale(run, now) {
+			continue
+		}
+		if err := reconcileRun(db, run); err != nil {
+			return reconciled, fmt.Errorf("reconcile run %d: %w", run.ID, err)
+		}
+		if err := db.setScanRunStatus(run.ID, runInterrupted); err != nil {
+			return reconciled, err
+		}
+		run.Status = runInterrupted
+		reconciled = append(reconciled, run)
+	}
+	return reconciled, nil
+}
+
+func reconcileRun(db *DB, run ScanRunRow) error {
+	rows, err := db.listInFlightIncoming(run.ID)
+	if err != nil {
+		return err
+	}
+	recovered, rolledBack := 0, 0
+	for _, row := range rows {
+		switch row.Stage {
+		case stageCopying, stageCopied:
+			if libraryCopyMatches(row.DestPath, row.Hash) {
+				if err := recordRecoveredCopy(db, row, run.Dest); err != nil {
+					fmt.Println("failed to record recovered copy", row.DestPath, ":", err)
+					_ = db.markIncomingFailure(row.ID, "interrupted: "+err.Error())
+					rolledBack++
+					continue
+				}
+				recovered++
+				continue
+			}
+			if row.Stage == stageCopied {
+				fmt.Println("library copy", row.DestPath, "missing or changed after an interrupted scan")
+			}
+			removeStrayTemps(filepath.Dir(row.DestPath))
+			if row.ReplacesID != 0 {
+				restoreInterruptedUpgrade(db, row)
+			}
+			_ = db.markIncomingFailure(row.ID, "interrupted during copy")
+			rolledBack++
+		}
+	}
+	if err := db.deleteRecordedIncoming(run.ID); err != nil {
+		return err
+	}
+	if recovered > 0 || rolledBack > 0 {
+		fmt.Printf("Reconciled scan run %d: %d copies recovered, %d rolled back\n", run.ID, recovered, rolledBack)
+	}
+	return nil
+}
+
+// libraryCopyMatches reports whether path exists and has the given content hash
+func libraryCopyMatches(path, hash string) bool {
+	if path == "" {
+		return false
+	}
+	got, err := computeFileHash(path)
+	return err == nil && got == hash
+}
+
+// recordRecoveredCopy finishes a file whose copy completed before the crash.
+// An upgrade takes over the library row it replaces.
+func recordRecoveredCopy(db *DB, row LedgerRow, destFolder string) error {
+	_, _, exists, err := db.findOutcomingByHash(row.Hash)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		var replaced *OutcomingRow
+		if row.ReplacesID != 0 {
+			if replaced, err = db.getOutcomingByIDRow(row.ReplacesID); err != nil {
+				return err
+			}
+		}
+		// The thumbnail of the replaced version makes way for the new file's
+		if replaced != nil && replaced.ThumbnailPath != "" {
+			_ = os.Remove(filepath.Join(destFolder, filepath.FromSlash(replaced.ThumbnailPath)))
+		}
+		fileInfo := row.FileInfo
+		thumbnailPath, phash, terr := processThumbnail(row.DestPath, destFolder)
+		if terr != nil {
+			fmt.Println("thumbnail generation failed for", row.DestPath, ":", terr)
+		}
+		fileInfo.thumbnailPath = thumbnailPath
+		fileInfo.phash = phash
+		fileInfo.metadata = BuildMetadataJSON(row.DestPath)
+		if replaced != nil {
+			err = db.upgradeOutcomingRecord(replaced.ID, fileInfo, row.TrashPath)
+		} else {
+			_, err = db.insertOutcomingRecord(fileInfo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return db.setIncomingStage(row.ID, stageRecorded)
+}
+
+// restoreInterruptedUpgrade moves the library file an interrupted upgrade
+// trashed back to its place, unless something is there already
+func restoreInterruptedUpgrade(db *DB, row LedgerRow) {
+	if row.TrashPath == "" || !pathExists(row.TrashPath) {
+		return
+	}
+	replaced, err := db.getOutcomingByIDRow(row.ReplacesID)
+	if err != nil || replaced == nil {
+		fmt.Println("cannot restore", row.TrashPath, ": the library row it was replaced from is gone")
+		return
+	}
+	if pathExists(replaced.DestPath) {
+		return
+	}
+	target := &upgradeTarget{id: replaced.ID, destPath: replaced.DestPath, trashPath: row.TrashPath}
+	if restoreReplacedVersion(target); target.trashPath == "" {
+		fmt.Println("restored", replaced.DestPath, "after an interrupted upgrade")
+	}
+}
+
+// removeStrayTemps deletes temp files left in dir by an interrupted copy.
+// Temp files written to lately may belong to a copy of another scan and are kept.
+func removeStrayTemps(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, ".photoManager-*.tmp"))
+	for _, m := range matches {
+		if info, err := os.Lstat(m); err != nil || time.Since(info.ModTime()) < runStaleAfter {
+			continue
+		}
+		if err := os.Remove(m); err == nil {
+			fmt.Println("removed stray temp file", m)
+		}
+	}
+}
+
+// loadRunConfig rebuilds the ProcessingConfig of a stored run so it can be resumed
+func loadRunConfig(run ScanRunRow) (ProcessingConfig, error) {
+	var rc runConfig
+	if err := json.Unmarshal([]byte(run.Config), &rc); err != nil {
+		return ProcessingConfig{}, fmt.Errorf("invalid stored config for run %d: %w", run.ID, err)
+	}
+	config := rc.ProcessingConfig
+	config.SrcFolder, config.DestFolder = run.Src, run.Dest
+	config.plan = rc.Plan
+	config.runID = run.ID
+	config.resumeAfter = run.LastPath
+	config.resumeProcessed = run.Processed
+	config.resumeTotals = run.Totals
+	return config, nil
+}
+
+// resumeScanRun continues an interrupted run from its last checkpoint.
+// If id is 0 the most recent interrupted run is resumed.
+func resumeScanRun(db *DB, id int64) (*Job, *ScanRunRow, error) {
+	if _, err := reconcileInterruptedRuns(db); err != nil {
+		return nil, nil, err
+	}
+	var run *ScanRunRow
+	if id == 0 {
+		runs, err := db.listScanRunsByStatus(runInterrupted)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(runs) == 0 {
+			return nil, nil, fmt.Errorf("no interrupted scan to resume")
+		}
+		run = &runs[0]
+	} else {
+		var err error
+		if run, err = db.getScanRun(id); err != nil {
+			return nil, nil, err
+		}
+		if run == nil {
+			return nil, nil, fmt.Errorf("scan run %d not found", id)
+		}
+		if run.Status != runInterrupted {
+			return nil, nil, fmt.Errorf("scan run %d is %s, not interrupted", id, run.Status)
+		}
+	}
+	config, err := loadRunConfig(*run)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("Resuming scan run", run.ID, "after", run.Processed, "files")
+	job, err := startProcessing(config)
+	return job, run, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// interruptedCopy leaves a run of this process that is no longer active with a
+// ledger row at stage for a copy of content to destPath
+func interruptedCopy(t *testing.T, db *DB, dest, destPath, stage string, content []byte) (int64, string) {
+	t.Helper()
+	runID, err := db.createScanRun(t.TempDir(), dest, "{}", runOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), filepath.Base(destPath))
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := computeFileHash(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo := FileInfo{name: filepath.Base(src), size: int64(len(content)), modifiedAt: time.Now(), srcPath: src, destPath: destPath, hash: hash, fileType: getFileType(src), runID: runID}
+	if _, err := db.upsertIncomingStage(fileInfo, stage); err != nil {
+		t.Fatal(err)
+	}
+	return runID, hash
+}
+
+func openTestDB(t *testing.T, dest string) *DB {
+	t.Helper()
+	db, err := initializeDB(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReconcileRecordsFinishedCopy(t *testing.T) {
+	dest := t.TempDir()
+	db := openTestDB(t, dest)
+	content := []byte("copied before the crash")
+	destPath := filepath.Join(dest, "2020", "IMG_0001.JPG")
+	runID, hash := interruptedCopy(t, db, dest, destPath, stageCopied, content)
+	if err := ensureDirectory(filepath.Dir(destPath)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(destPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := reconcileInterruptedRuns(db)
+	if err != nil || len(runs) != 1 || runs[0].ID != runID {
+		t.Fatalf("reconciled %+v, %v; want run %d", runs, err, runID)
+	}
+	if _, got, ok, err := db.findOutcomingByHash(hash); err != nil || !ok || got != destPath {
+		t.Errorf("library row %q, %v, %v; want %s", got, ok, err, destPath)
+	}
+	if rows, err := db.listInFlightIncoming(runID); err != nil || len(rows) != 0 {
+		t.Errorf("ledger still holds %d rows: %v", len(rows), err)
+	}
+}
+
+func TestReconcileRollsBackPartialCopy(t *testing.T) {
+	dest := t.TempDir()
+	db := openTestDB(t, dest)
+	destPath := filepath.Join(dest, "2020", "IMG_0001.JPG")
+	runID, hash := interruptedCopy(t, db, dest, destPath, stageCopying, []byte("never finished"))
+	if err := ensureDirectory(filepath.Dir(destPath)); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(filepath.Dir(destPath), ".photoManager-1.tmp")
+	fresh := filepath.Join(filepath.Dir(destPath), ".photoManager-2.tmp")
+	for _, p := range []string{stray, fresh} {
+		if err := os.WriteFile(p, []byte("never"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * runStaleAfter)
+	if err := os.Chtimes(stray, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reconcileInterruptedRuns(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := db.findOutcomingByHash(hash); ok {
+		t.Error("a partial copy was recorded")
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("stray temp file kept: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("temp file of a possibly live copy removed: %v", err)
+	}
+	run, err := db.getScanRun(runID)
+	if err != nil || run == nil || run.Status != runInterrupted {
+		t.Errorf("run %+v, %v; want it interrupted", run, err)
+	}
+}
+
+func TestReconcileSkipsLiveRuns(t *testing.T) {
+	dest := t.TempDir()
+	db := openTestDB(t, dest)
+	runID, _ := interruptedCopy(t, db, dest, filepath.Join(dest, "IMG_0001.JPG"), stageCopying, []byte("still copying"))
+	setRunActive(db, runID, true)
+	defer setRunActive(db, runID, false)
+
+	// Another process on another host with a fresh heartbeat
+	otherID, err := db.createScanRun(t.TempDir(), dest, "{}", "elsewhere:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := reconcileInterruptedRuns(db)
+	if err != nil || len(runs) != 0 {
+		t.Fatalf("reconciled %+v, %v; want no run", runs, err)
+	}
+	for _, id := range []int64{runID, otherID} {
+		if run, err := db.getScanRun(id); err != nil || run.Status != runRunning {
+			t.Errorf("run %d: %+v, %v; want it still running", id, run, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// cloneFile is only implemented on Linux
+func cloneFile(dst, src *os.File) error {
+	return errReflinkUnsupported
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule routes and tags the files that meet all of its conditions. Rules are
+// read from a JSON file, {"rules": [...]}, and evaluated in order.
+type Rule struct {
+	Name    string         `json:"name"`
+	When    RuleConditions `json:"when"`
+	Tags    []string       `json:"tags,omitempty"`    // added to the file
+	Subtree string         `json:"subtree,omitempty"` // folder the layout is rendered under, e.g. "Drone/{year}"
+	Library string         `json:"library,omitempty"` // another library (destination folder) the file is imported into
+	Skip    bool           `json:"skip,omitempty"`    // the file is not imported
+	Stop    bool           `json:"stop,omitempty"`    // later rules are not evaluated once this one matches
+}
+
+// RuleConditions must all hold for a rule to match; a list holds if any of its items does
+type RuleConditions struct {
+	Type    []string `json:"type,omitempty"`    // image, video or other
+	Ext     []string `json:"ext,omitempty"`     // extensions, with or without the dot
+	Make    []string `json:"make,omitempty"`    // camera make globs, case-insensitive
+	Model   []string `json:"model,omitempty"`   // camera model globs, case-insensitive
+	GPS     *GPSBox  `json:"gps,omitempty"`     // location inside a box; files without one never match
+	Path    []string `json:"path,omitempty"`    // globs matched against each folder of the path relative to the source, or the folder path
+	MinSize int64    `json:"minSize,omitempty"` // bytes
+	MaxSize int64    `json:"maxSize,omitempty"` // bytes
+	After   string   `json:"after,omitempty"`   // taken on or after, 2006-01-02 or RFC 3339
+	Before  string   `json:"before,omitempty"`  // taken before, 2006-01-02 or RFC 3339
+}
+
+// GPSBox is a latitude/longitude bounding box. MinLon > MaxLon crosses the antimeridian.
+type GPSBox struct {
+	MinLat float64 `json:"minLat"`
+	MaxLat float64 `json:"maxLat"`
+	MinLon float64 `json:"minLon"`
+	MaxLon float64 `json:"maxLon"`
+}
+
+func (b GPSBox) contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon > b.MaxLon {
+		return lon >= b.MinLon || lon <= b.MaxLon
+	}
+	return lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// ruleSet is the compiled form of a list of rules
+type ruleSet struct {
+	rules     []compiledRule
+	needsExif bool // some rule looks at the camera, location or date
+}
+
+type compiledRule struct {
+	Rule
+	types  map[string]bool
+	exts   map[string]bool
+	make   []pathMatcher
+	model  []pathMatcher
+	path   []pathMatcher
+	after  time.Time
+	before time.Time
+}
+
+// loadRules reads and compiles the rules file at path
+func loadRules(path string) (*ruleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return compileRules(file.Rules)
+}
+
+// parseRuleDate parses the date of an after/before condition, in local time
+func parseRuleDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// compileRules validates rules and compiles their patterns
+func compileRules(rules []Rule) (*ruleSet, error) {
+	set := &ruleSet{}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		c := compiledRule{Rule: r, types: map[string]bool{}, exts: map[string]bool{}}
+		fail := func(err error) (*ruleSet, error) {
+			return nil, fmt.Errorf("%s: %w", r.Name, err)
+		}
+		for _, t := range r.When.Type {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t != "image" && t != "video" && t != "other" {
+				return fail(fmt.Errorf("invalid type %q (want image, video or other)", t))
+			}
+			c.types[t] = true
+		}
+		for _, e := range r.When.Ext {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+				c.exts["."+strings.TrimPrefix(e, ".")] = true
+			}
+		}
+		var err error
+		if c.make, err = compilePatterns(r.When.Make); err != nil {
+			return fail(err)
+		}
+		if c.model, err = compilePatterns(r.When.Model); err != nil {
+			return fail(err)
+		}
+		if c.path, err = compilePatterns(r.When.Path); err != nil {
+			return fail(err)
+		}
+		if r.When.MinSize < 0 || r.When.MaxSize < 0 || (r.When.MaxSize > 0 && r.When.MinSize > r.When.MaxSize) {
+			return fail(fmt.Errorf("invalid size limits: min %d, max %d", r.When.MinSize, r.When.MaxSize))
+		}
+		if b := r.When.GPS; b != nil && (b.MinLat > b.MaxLat || b.MinLat < -90 || b.MaxLat > 90 || b.MinLon < -180 || b.MaxLon > 180) {
+			return fail(errors.New("invalid gps box"))
+		}
+		if r.When.After != "" {
+			if c.after, err = parseRuleDate(r.When.After); err != nil {
+				return fail(fmt.Errorf("invalid after date %q", r.When.After))
+			}
+		}
+		if r.When.Before != "" {
+			if c.before, err = parseRuleDate(r.When.Before); err != nil {
+				return fail(fmt.Errorf("invalid before date %q", r.When.Before))
+			}
+		}
+		if r.Subtree != "" {
+			if err := validateDestTemplate(r.Subtree); err != nil {
+				return fail(fmt.Errorf("invalid subtree: %w", err))
+			}
+		}
+		if r.Library != "" {
+			c.Library = filepath.Clean(r.Library)
+		}
+		for _, t := range r.Tags {
+			if strings.Contains(t, ",") {
+				return fail(fmt.Errorf("tag %q cannot contain commas", t))
+			}
+		}
+		if len(c.make) > 0 || len(c.model) > 0 || r.When.GPS != nil || r.When.After != "" || r.When.Before != "" {
+			set.needsExif = true
+		}
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// RuleFacts are what rule conditions look at for one file
+type RuleFacts struct {
+	Type        string    `json:"type"`
+	Ext         string    `json:"ext"`
+	Dir         string    `json:"dir"` // folder relative to the source, slash-separated
+	Size        int64     `json:"size"`
+	Make        string    `json:"make,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	HasLocation bool      `json:"hasLocation"`
+	Latitude    float64   `json:"latitude,omitempty"`
+	Longitude   float64   `json:"longitude,omitempty"`
+	Date        time.Time `json:"date,omitempty"` // capture date, as the layout sees it
+}
+
+// ruleFacts gathers the facts of a file. EXIF is only read if a rule needs it.
+func ruleFacts(config ProcessingConfig, set *ruleSet, path string, info os.FileInfo) RuleFacts {
+	f := RuleFacts{
+		Type: getFileType(path),
+		Ext:  strings.ToLower(filepath.Ext(path)),
+		Size: info.Size(),
+	}
+	rel := filepath.ToSlash(path)
+	if config.filter != nil {
+		rel = config.filter.relPath(path)
+	}
+	if f.Dir = pathDir(rel); f.Dir == "." {
+		f.Dir = ""
+	}
+	if !set.needsExif {
+		return f
+	}
+	date, ed := fileDate(config, path, info)
+	f.Date = date
+	if ed != nil {
+		f.Make, f.Model = ed.CameraMake, ed.CameraModel
+		f.HasLocation, f.Latitude, f.Longitude = ed.HasLocation, ed.Latitude, ed.Longitude
+	}
+	if !f.HasLocation && config.takeout != nil {
+		if gm := config.takeout.metadata(path); gm != nil {
+			if sm := gm.sidecarMetadata(""); sm.HasLocation {
+				f.HasLocation, f.Latitude, f.Longitude = true, sm.Latitude, sm.Longitude
+			}
+		}
+	}
+	return f
+}
+
+// pathDir is path.Dir for slash-separated paths that may point into an archive
+func pathDir(rel string) string {
+	return strings.TrimSuffix(path.Dir(strings.Replace(rel, archiveSep, "/", 1)), "!")
+}
+
+// check returns the conditions of the rule the file does not meet, none if it matches
+func (r *compiledRule) check(f RuleFacts) []string {
+	var failed []string
+	w := r.When
+	if len(r.types) > 0 && !r.types[f.Type] {
+		failed = append(failed, fmt.Sprintf("type %s is not one of %v", f.Type, w.Type))
+	}
+	if len(r.exts) > 0 && !r.exts[f.Ext] {
+		failed = append(failed, fmt.Sprintf("extension %q is not one of %v", f.Ext, w.Ext))
+	}
+	if len(r.make) > 0 && (f.Make == "" || !matchAny(r.make, f.Make, f.Make)) {
+		failed = append(failed, fmt.Sprintf("make %q does not match %v", f.Make, w.Make))
+	}
+	if len(r.model) > 0 && (f.Model == "" || !matchAny(r.model, f.Model, f.Model)) {
+		failed = append(failed, fmt.Sprintf("model %q does not match %v", f.Model, w.Model))
+	}
+	if w.GPS != nil {
+		if !f.HasLocation {
+			failed = append(failed, "no location")
+		} else if !w.GPS.contains(f.Latitude, f.Longitude) {
+			failed = append(failed, fmt.Sprintf("location %.5f,%.5f is outside the gps box", f.Latitude, f.Longitude))
+		}
+	}
+	if len(r.path) > 0 && !r.matchPath(f.Dir) {
+		failed = append(failed, fmt.Sprintf("folder %q does not match %v", f.Dir, w.Path))
+	}
+	if w.MinSize > 0 && f.Size < w.MinSize {
+		failed = append(failed, fmt.Sprintf("size %d is below %d", f.Size, w.MinSize))
+	}
+	if w.MaxSize > 0 && f.Size > w.MaxSize {
+		failed = append(failed, fmt.Sprintf("size %d is above %d", f.Size, w.MaxSize))
+	}
+	if !r.after.IsZero() && f.Date.Before(r.after) {
+		failed = append(failed, fmt.Sprintf("date %s is before %s", f.Date.Format(time.RFC3339), w.After))
+	}
+	if !r.before.IsZero() && !f.Date.Before(r.before) {
+		failed = append(failed, fmt.Sprintf("date %s is not before %s", f.Date.Format(time.RFC3339), w.Before))
+	}
+	return failed
+}
+
+// matchPath matches the folder of a file, or any folder it is in, against the path patterns
+func (r *compiledRule) matchPath(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	for _, segment := range strings.Split(dir, "/") {
+		if matchAny(r.path, segment, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleDecision is what the rules decided for one file
+type RuleDecision struct {
+	Matched []string `json:"matched"` // names of the rules that matched, in order
+	Tags    []string `json:"tags"`
+	Subtree string   `json:"subtree,omitempty"`
+	Library string   `json:"library,omitempty"`
+	Skip    bool     `json:"skip"`
+}
+
+// RuleTrace is how one rule judged a file
+type RuleTrace struct {
+	Name      string   `json:"name"`
+	Evaluated bool     `json:"evaluated"` // false once an earlier matching rule stopped the evaluation
+	Matched   bool     `json:"matched"`
+	Failed    []string `json:"failed,omitempty"` // conditions the file does not meet
+}
+
+// evaluate runs the rules in order on the facts of a file. Tags add up; the
+// first matching rule with a subtree or library decides it; a skip ends the evaluation.
+func (s *ruleSet) evaluate(f RuleFacts) (RuleDecision, []RuleTrace) {
+	d := RuleDecision{Matched: []string{}, Tags: []string{}}
+	traces := make([]RuleTrace, len(s.rules))
+	stopped := false
+	for i := range s.rules {
+		r := &s.rules[i]
+		traces[i].Name = r.Name
+		if stopped {
+			continue
+		}
+		traces[i].Evaluated = true
+		if traces[i].Failed = r.check(f); len(traces[i].Failed) > 0 {
+			continue
+		}
+		traces[i].Matched = true
+		d.Matched = append(d.Matched, r.Name)
+		d.Tags = appendMissing(d.Tags, r.Tags...)
+		if d.Subtree == "" {
+			d.Subtree = r.Subtree
+		}
+		if d.Library == "" {
+			d.Library = r.Library
+		}
+		if r.Skip {
+			d.Skip = true
+		}
+		stopped = r.Stop || r.Skip
+	}
+	return d, traces
+}
+
+// appendMissing appends the non-empty items not already in list
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		found := false
+		for _, have := range list {
+			if have == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ruleDecisions remembers the decision for every file of a scan, so that the
+// walk, the layout and the recording of a file agree, and collects the files
+// routed to other libraries
+type ruleDecisions struct {
+	set    *ruleSet
+	mu     sync.Mutex
+	byPath map[string]*RuleDecision
+	routed map[string][]string // library -> source paths
+}
+
+func newRuleDecisions(set *ruleSet) *ruleDecisions {
+	return &ruleDecisions{set: set, byPath: make(map[string]*RuleDecision), routed: make(map[string][]string)}
+}
+
+// get returns the decision for a file, evaluating the rules the first time.
+// Returns nil when the scan has no rules.
+func (r *ruleDecisions) get(config ProcessingConfig, path string, info os.FileInfo) *RuleDecision {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	d, ok := r.byPath[path]
+	r.mu.Unlock()
+	if ok {
+		return d
+	}
+	decision, _ := r.set.evaluate(ruleFacts(config, r.set, path, info))
+	d = &decision
+	// A library rule in the library it names imports the file here
+	if d.Library == filepath.Clean(config.DestFolder) {
+		d.Library = ""
+	}
+	r.mu.Lock()
+	r.byPath[path] = d
+	r.mu.Unlock()
+	return d
+}
+
+// route sets a file aside for the library a rule sent it to
+func (r *ruleDecisions) route(library, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routed[library] = append(r.routed[library], path)
+}
+
+// startRouted queues a scan of the routed files in each library they were sent to
+func (r *ruleDecisions) startRouted(config ProcessingConfig) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	libraries := make([]string, 0, len(r.routed))
+	for library := range r.routed {
+		libraries = append(libraries, library)
+	}
+	r.mu.Unlock()
+	sort.Strings(libraries)
+	for _, library := range libraries {
+		c := config
+		c.DestFolder = library
+		c.files = r.routed[library]
+		c.routedFrom = config.job.ID
+		c.plan, c.runID, c.resumeAfter, c.resumeProcessed, c.resumeTotals = nil, 0, "", 0, RunTotals{}
+		job, err := startProcessing(c)
+		if err != nil {
+			fmt.Println("failed to import", len(c.files), "routed files into", library, ":", err)
+			continue
+		}
+		fmt.Println("Routed", len(c.files), "files to", library, "as job", job.ID)
+	}
+}
+
+// ruleGate applies the scan's rules before a file is emitted: files a rule
+// skips are counted as filtered, and files routed to another library are set
+// aside for a scan of that library once this one is done
+func ruleGate(config ProcessingConfig, emit func(path string, info os.FileInfo) error) func(path string, info os.FileInfo) error {
+	if config.decisions == nil {
+		return emit
+	}
+	return func(path string, info os.FileInfo) error {
+		d := config.decisions.get(config, path, info)
+		if d.Skip {
+			fmt.Println("skipping", path, ": rule", strings.Join(d.Matched, ", "))
+			config.job.tracker.recordFiltered()
+			config.archives.release(path)
+			return nil
+		}
+		if d.Library != "" {
+			// Another scan cannot read a tar member again, it is imported here
+			if archive, _, ok := splitArchivePath(path); ok && archiveKind(archive) == ArchiveTar {
+				fmt.Println("cannot route", path, "to", d.Library, ": tar members are imported into this library")
+				return emit(path, info)
+			}
+			if config.DryRun {
+				config.plan.addRouted(path, info.Size(), d.Library)
+			} else {
+				config.decisions.route(d.Library, path)
+			}
+			config.job.tracker.recordRouted()
+			return nil
+		}
+		return emit(path, info)
+	}
+}
+
+// RuleExplanation tells what the rules make of a single file and why
+type RuleExplanation struct {
+	Path     string       `json:"path"`
+	Facts    RuleFacts    `json:"facts"`
+	Rules    []RuleTrace  `json:"rules"`
+	Decision RuleDecision `json:"decision"`
+	DestPath string       `json:"destPath,omitempty"` // where the file would be imported, unless skipped
+}
+
+// explainRulesFor explains the rules for a file outside of a scan; config
+// only needs the destination, the layout and the source folder, if any
+func explainRulesFor(config ProcessingConfig, set *ruleSet, path string) (*RuleExplanation, error) {
+	if config.SrcFolder != "" {
+		filter, err := compileFilters(config.SrcFolder, ScanFilters{})
+		if err != nil {
+			return nil, err
+		}
+		config.filter = filter
+	}
+	if err := validateDestTemplate(config.destTemplate()); err != nil {
+		return nil, fmt.Errorf("invalid destination template: %w", err)
+	}
+	if config.Takeout {
+		config.takeout = newTakeoutIndex()
+	}
+	return explainRules(config, set, path)
+}
+
+// explainRules evaluates the rules on one source file
+func explainRules(config ProcessingConfig, set *ruleSet, path string) (*RuleExplanation, error) {
+	info, err := statSource(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	// All facts are shown, not only those the rules look at
+	facts := ruleFacts(config, &ruleSet{needsExif: true}, path, info)
+	decision, traces := set.evaluate(facts)
+	ex := &RuleExplanation{Path: path, Facts: facts, Rules: traces, Decision: decision}
+	if decision.Skip {
+		return ex, nil
+	}
+	config.decisions = newRuleDecisions(set)
+	if decision.Library != "" {
+		config.DestFolder = decision.Library
+	}
+	hash := ""
+	if strings.Contains(config.destTemplate()+decision.Subtree, "{hash") {
+		if hash, err = computeFileHash(path); err != nil {
+			return nil, err
+		}
+	}
+	if ex.DestPath, err = buildDestPath(config, path, info, hash); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleSetEvaluate(t *testing.T) {
+	pacific := &GPSBox{MinLat: -30, MaxLat: 10, MinLon: 170, MaxLon: -150}
+	tests := []struct {
+		name      string
+		rules     []Rule
+		facts     RuleFacts
+		want      RuleDecision
+		evaluated []bool
+	}{
+		{
+			name: "tags add up, first subtree wins",
+			rules: []Rule{
+				{Name: "images", When: RuleConditions{Type: []string{"image"}}, Tags: []string{"photo"}, Subtree: "Images"},
+				{Name: "jpeg", When: RuleConditions{Ext: []string{"jpg"}}, Tags: []string{"jpeg", "photo"}, Subtree: "Jpeg"},
+			},
+			facts:     RuleFacts{Type: "image", Ext: ".jpg"},
+			want:      RuleDecision{Matched: []string{"images", "jpeg"}, Tags: []string{"photo", "jpeg"}, Subtree: "Images"},
+			evaluated: []bool{true, true},
+		},
+		{
+			name: "stop ends the evaluation",
+			rules: []Rule{
+				{Name: "drone", When: RuleConditions{Make: []string{"dji*"}}, Tags: []string{"drone"}, Stop: true},
+				{Name: "all", Tags: []string{"other"}},
+			},
+			facts:     RuleFacts{Type: "image", Make: "DJI"},
+			want:      RuleDecision{Matched: []string{"drone"}, Tags: []string{"drone"}},
+			evaluated: []bool{true, false},
+		},
+		{
+			name: "a rule that does not match does not stop",
+			rules: []Rule{
+				{Name: "drone", When: RuleConditions{Make: []string{"dji*"}}, Stop: true},
+				{Name: "all", Tags: []string{"other"}},
+			},
+			facts:     RuleFacts{Type: "image", Make: "Canon"},
+			want:      RuleDecision{Matched: []string{"all"}, Tags: []string{"other"}},
+			evaluated: []bool{true, true},
+		},
+		{
+			name: "skip ends the evaluation",
+			rules: []Rule{
+				{Name: "screenshots", When: RuleConditions{Path: []string{"Screenshots"}}, Skip: true},
+				{Name: "all", Tags: []string{"other"}},
+			},
+			facts:     RuleFacts{Type: "image", Dir: "Phone/Screenshots"},
+			want:      RuleDecision{Matched: []string{"screenshots"}, Tags: []string{}, Skip: true},
+			evaluated: []bool{true, false},
+		},
+		{
+			name: "inside a box across the antimeridian",
+			rules: []Rule{
+				{Name: "fiji", When: RuleConditions{GPS: pacific}, Library: "/lib/travel"},
+			},
+			facts:     RuleFacts{HasLocation: true, Latitude: -17.7, Longitude: 178.1},
+			want:      RuleDecision{Matched: []string{"fiji"}, Tags: []string{}, Library: "/lib/travel"},
+			evaluated: []bool{true},
+		},
+		{
+			name: "west of the antimeridian inside the box",
+			rules: []Rule{
+				{Name: "fiji", When: RuleConditions{GPS: pacific}, Tags: []string{"pacific"}},
+			},
+			facts:     RuleFacts{HasLocation: true, Latitude: -14.3, Longitude: -170.7},
+			want:      RuleDecision{Matched: []string{"fiji"}, Tags: []string{"pacific"}},
+			evaluated: []bool{true},
+		},
+		{
+			name: "outside a box across the antimeridian",
+			rules: []Rule{
+				{Name: "fiji", When: RuleConditions{GPS: pacific}, Tags: []string{"pacific"}},
+			},
+			facts:     RuleFacts{HasLocation: true, Latitude: 0, Longitude: 0},
+			want:      RuleDecision{Matched: []string{}, Tags: []string{}},
+			evaluated: []bool{true},
+		},
+		{
+			name: "no location never matches a box",
+			rules: []Rule{
+				{Name: "world", When: RuleConditions{GPS: &GPSBox{MinLat: -90, MaxLat: 90, MinLon: -180, MaxLon: 180}}, Tags: []string{"geo"}},
+			},
+			facts:     RuleFacts{},
+			want:      RuleDecision{Matched: []string{}, Tags: []string{}},
+			evaluated: []bool{true},
+		},
+		{
+			name: "size and date limits",
+			rules: []Rule{
+				{Name: "big", When: RuleConditions{MinSize: 100}, Tags: []string{"big"}},
+				{Name: "2020", When: RuleConditions{After: "2020-01-01", Before: "2021-01-01"}, Tags: []string{"2020"}},
+			},
+			facts:     RuleFacts{Size: 50, Date: time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)},
+			want:      RuleDecision{Matched: []string{"2020"}, Tags: []string{"2020"}},
+			evaluated: []bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := compileRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, traces := set.evaluate(tt.facts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evaluate = %+v, want %+v", got, tt.want)
+			}
+			for i, trace := range traces {
+				if trace.Evaluated != tt.evaluated[i] {
+					t.Errorf("rule %s evaluated = %v, want %v", trace.Name, trace.Evaluated, tt.evaluated[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompileRulesRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown type", Rule{When: RuleConditions{Type: []string{"audio"}}}},
+		{"min above max", Rule{When: RuleConditions{MinSize: 10, MaxSize: 5}}},
+		{"latitudes swapped", Rule{When: RuleConditions{GPS: &GPSBox{MinLat: 10, MaxLat: -10}}}},
+		{"longitude out of range", Rule{When: RuleConditions{GPS: &GPSBox{MinLon: -200, MaxLon: 10}}}},
+		{"bad date", Rule{When: RuleConditions{After: "June 2020"}}},
+		{"comma in tag", Rule{Tags: []string{"a,b"}}},
+		{"subtree leaves the library", Rule{Subtree: "../{year}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileRules([]Rule{tt.rule}); err == nil {
+				t.Errorf("compileRules accepted %+v", tt.rule)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -26,8 +30,77 @@ type healthResp struct {
 }
 
 type scanReq struct {
-	Src  string `json:"src"`
-	Dest string `json:"dest"`
+	Src         string         `json:"src"`
+	Dest        string         `json:"dest"`
+	Workers     int            `json:"workers"`
+	Layout      string         `json:"layout"`
+	OnCollision string         `json:"onCollision"`
+	Cleanup     string         `json:"cleanup"`
+	TrashFolder string         `json:"trashFolder"`
+	TrashDays   int            `json:"trashRetentionDays"`
+	LinkMode    string         `json:"link"`
+	DryRun      bool           `json:"dryRun"`
+	PlanFile    string         `json:"planFile"`
+	Filters     ScanFilters    `json:"filters"`
+	ForceRehash bool           `json:"forceRehash"`
+	Upgrade     string         `json:"upgrade"`
+	Takeout     bool           `json:"takeout"`
+	Tags        []string       `json:"tags"`
+	Profiles    []string       `json:"profiles"` // source profiles to scan instead of src
+	RulesFile   string         `json:"rulesFile"`
+	FolderTags  FolderTags     `json:"folderTags"`
+	SpaceCheck  string         `json:"spaceCheck"`
+	DiskReserve int64          `json:"diskReserve"`
+	Throttle    ThrottleLimits `json:"throttle"`
+}
+
+// config converts a scan request into a ProcessingConfig
+func (req scanReq) config() ProcessingConfig {
+	return ProcessingConfig{
+		SrcFolder:      req.Src,
+		DestFolder:     req.Dest,
+		Workers:        req.Workers,
+		DestTemplate:   req.Layout,
+		OnCollision:    req.OnCollision,
+		Cleanup:        req.Cleanup,
+		TrashFolder:    req.TrashFolder,
+		TrashRetention: time.Duration(req.TrashDays) * 24 * time.Hour,
+		LinkMode:       req.LinkMode,
+		DryRun:         req.DryRun,
+		Filters:        req.Filters,
+		ForceRehash:    req.ForceRehash,
+		Upgrade:        req.Upgrade,
+		Takeout:        req.Takeout,
+		Tags:           req.Tags,
+		RulesFile:      req.RulesFile,
+		FolderTags:     req.FolderTags,
+		SpaceCheck:     req.SpaceCheck,
+		DiskReserve:    req.DiskReserve,
+		Throttle:       req.Throttle,
+	}
+}
+
+// explainRulesReq asks what the rules do with one source file. Rules in the
+// body are used instead of rulesFile; src roots the path conditions.
+type explainRulesReq struct {
+	scanReq
+	Path  string `json:"path"`
+	Rules []Rule `json:"rules"`
+}
+
+// watchReq starts the watcher with the given scan settings
+type watchReq struct {
+	scanReq
+	SettleSeconds int  `json:"settleSeconds"`
+	PollSeconds   int  `json:"pollSeconds"`
+	ForcePolling  bool `json:"forcePolling"`
+}
+
+// executePlanReq executes the plan in the body, or the last dry-run plan if omitted.
+// Scan settings such as link and cleanup apply to the execution.
+type executePlanReq struct {
+	scanReq
+	Plan *ImportPlan `json:"plan"`
 }
 
 type scanResp struct {
@@ -36,10 +109,12 @@ type scanResp struct {
 	Copied  int64  `json:"copied"`
 	Skipped int64  `json:"skipped"`
 	Failed  int64  `json:"failed"`
+	JobID   int64  `json:"jobId"`
 }
 
 type updateTagsReq struct {
-	Tags []string `json:"tags"`
+	Tags  []string `json:"tags"`
+	Stack bool     `json:"stack"` // apply to every file of the row's stack
 }
 
 type updateTagsResp struct {
@@ -54,8 +129,53 @@ func StartServer(addr string, dbFile string) error {
 	r.HandleFunc("/api/outcoming", withDB(dbFile, handleListOutcoming)).Methods(http.MethodGet)
 	r.HandleFunc("/api/outcoming/{id}", withDB(dbFile, handleGetOutcoming)).Methods(http.MethodGet)
 	r.HandleFunc("/api/outcoming/{id}/tags", withDB(dbFile, handleTags)).Methods(http.MethodPost)
-	r.HandleFunc("/api/scan", withDB(dbFile, handleScan)).Methods(http.MethodPost)
+	r.HandleFunc("/api/outcoming/{id}/versions", withDB(dbFile, handleOutcomingVersions)).Methods(http.MethodGet)
+	r.HandleFunc("/api/outcoming/{id}/attachments", withDB(dbFile, handleOutcomingAttachments)).Methods(http.MethodGet)
+	r.HandleFunc("/api/outcoming/{id}/delete", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleDeleteOutcoming(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodPost)
+	r.HandleFunc("/api/stacks/{id}", withDB(dbFile, handleGetStack)).Methods(http.MethodGet)
+	r.HandleFunc("/api/stacks/{id}/cover", withDB(dbFile, handleStackCover)).Methods(http.MethodPost)
+	r.HandleFunc("/api/scan", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleScan(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodPost)
+	r.HandleFunc("/api/rules/explain", func(w http.ResponseWriter, r *http.Request) {
+		handleExplainRules(w, r, filepath.Dir(dbFile))
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/api/profiles", withDB(dbFile, handleListProfiles)).Methods(http.MethodGet)
+	r.HandleFunc("/api/profiles", withDB(dbFile, handleCreateProfile)).Methods(http.MethodPost)
+	r.HandleFunc("/api/profiles/{id}", withDB(dbFile, handleGetProfile)).Methods(http.MethodGet)
+	r.HandleFunc("/api/profiles/{id}", withDB(dbFile, handleUpdateProfile)).Methods(http.MethodPost)
+	r.HandleFunc("/api/profiles/{id}/delete", withDB(dbFile, handleDeleteProfile)).Methods(http.MethodPost)
 	r.HandleFunc("/api/scan/status", handleScanStatus).Methods(http.MethodGet)
+	r.HandleFunc("/api/duplicates/near", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleNearDuplicates(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodGet)
+	r.HandleFunc("/api/duplicates", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleListDuplicates(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodGet)
+	r.HandleFunc("/api/duplicates/resolve", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleResolveDuplicates(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodPost)
+	r.HandleFunc("/api/duplicates/auto", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
+		handleAutoResolveDuplicates(w, r, db, filepath.Dir(dbFile))
+	})).Methods(http.MethodPost)
+	r.HandleFunc("/api/runs", withDB(dbFile, handleListRuns)).Methods(http.MethodGet)
+	r.HandleFunc("/api/runs/{id}", withDB(dbFile, handleGetRun)).Methods(http.MethodGet)
+	r.HandleFunc("/api/scan/interrupted", withDB(dbFile, handleListInterrupted)).Methods(http.MethodGet)
+	r.HandleFunc("/api/scan/reconcile", withDB(dbFile, handleReconcile)).Methods(http.MethodPost)
+	r.HandleFunc("/api/scan/resume/{id}", withDB(dbFile, handleResume)).Methods(http.MethodPost)
+	r.HandleFunc("/api/scan/plan", handleScanPlan).Methods(http.MethodGet)
+	r.HandleFunc("/api/scan/plan/execute", handleExecutePlan).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs", handleListJobs).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs/{id}", handleGetJob).Methods(http.MethodGet)
+	r.HandleFunc("/api/jobs/{id}/cancel", handleJobAction).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs/{id}/pause", handleJobAction).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs/{id}/resume", handleJobAction).Methods(http.MethodPost)
+	r.HandleFunc("/api/jobs/{id}/throttle", handleJobThrottle).Methods(http.MethodPost)
+	r.HandleFunc("/api/watch", handleWatchStatus).Methods(http.MethodGet)
+	r.HandleFunc("/api/watch/start", handleWatchStart).Methods(http.MethodPost)
+	r.HandleFunc("/api/watch/stop", handleWatchStop).Methods(http.MethodPost)
 	r.HandleFunc("/api/clear", withDB(dbFile, func(w http.ResponseWriter, r *http.Request, db *DB) {
 		if err := db.clearDBTables(); err != nil {
 			writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
@@ -91,6 +211,344 @@ func handleScanStatus(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, GetScanStatus())
 }
 
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	out := []JobInfo{}
+	for _, job := range jobs.list() {
+		out = append(out, job.Info())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// jobFromRequest looks up the job named by the {id} route variable, writing an error if there is none
+func jobFromRequest(w http.ResponseWriter, r *http.Request) *Job {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return nil
+	}
+	job := jobs.get(id)
+	if job == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "job not found"})
+	}
+	return job
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	if job := jobFromRequest(w, r); job != nil {
+		writeJSON(w, http.StatusOK, job.Info())
+	}
+}
+
+// handleJobAction cancels, pauses or resumes a job depending on the last path segment
+func handleJobAction(w http.ResponseWriter, r *http.Request) {
+	job := jobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+	if job.finished() {
+		writeJSON(w, http.StatusConflict, apiError{Error: "job already finished"})
+		return
+	}
+	switch path.Base(r.URL.Path) {
+	case "cancel":
+		job.Cancel()
+	case "pause":
+		job.Pause()
+	case "resume":
+		job.Resume()
+	}
+	writeJSON(w, http.StatusOK, job.Info())
+}
+
+// handleJobThrottle changes the read limits of a queued or running job
+func handleJobThrottle(w http.ResponseWriter, r *http.Request) {
+	job := jobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+	var limits ThrottleLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	if job.finished() {
+		writeJSON(w, http.StatusConflict, apiError{Error: "job already finished"})
+		return
+	}
+	if err := job.SetThrottle(limits); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, job.Info())
+}
+
+// parseDistance reads the ?distance= Hamming distance, writing an error if it is invalid
+func parseDistance(w http.ResponseWriter, r *http.Request) (int, bool) {
+	distance := defaultNearDistance
+	if s := r.URL.Query().Get("distance"); s != "" {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 0 || d > 64 {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid distance"})
+			return 0, false
+		}
+		distance = d
+	}
+	return distance, true
+}
+
+// parseDuplicateKind reads ?kind=exact|near; empty means both
+func parseDuplicateKind(w http.ResponseWriter, r *http.Request) (string, bool) {
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && kind != DupExact && kind != DupNear {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "kind must be exact or near"})
+		return "", false
+	}
+	return kind, true
+}
+
+func handleNearDuplicates(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
+	distance, ok := parseDistance(w, r)
+	if !ok {
+		return
+	}
+	groups, err := findNearDuplicates(db, destFolder, distance)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if groups == nil {
+		groups = []NearDuplicateGroup{}
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func handleListDuplicates(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
+	distance, ok := parseDistance(w, r)
+	if !ok {
+		return
+	}
+	kind, ok := parseDuplicateKind(w, r)
+	if !ok {
+		return
+	}
+	groups, err := listDuplicateGroups(db, destFolder, kind, distance)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if groups == nil {
+		groups = []DuplicateGroup{}
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// resolveDuplicatesReq keeps keeperId and trashes the other ids
+type resolveDuplicatesReq struct {
+	KeeperID int64   `json:"keeperId"`
+	IDs      []int64 `json:"ids"`
+}
+
+// handleResolveDuplicates resolves one group; ids outside the keeper's group at ?distance= are refused
+func handleResolveDuplicates(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
+	distance, ok := parseDistance(w, r)
+	if !ok {
+		return
+	}
+	var req resolveDuplicatesReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid json body"})
+		return
+	}
+	if req.KeeperID == 0 || len(req.IDs) == 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "keeperId and ids are required"})
+		return
+	}
+	res, err := resolveDuplicates(db, destFolder, req.KeeperID, req.IDs, distance)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotDuplicate) {
+			status = http.StatusBadRequest
+		} else if res == nil {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleAutoResolveDuplicates resolves every group (?kind=, ?distance=) with the keep-best policy
+func handleAutoResolveDuplicates(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
+	distance, ok := parseDistance(w, r)
+	if !ok {
+		return
+	}
+	kind, ok := parseDuplicateKind(w, r)
+	if !ok {
+		return
+	}
+	resolved, err := autoResolveDuplicates(db, destFolder, kind, distance)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resolved)
+}
+
+func handleListRuns(w http.ResponseWriter, r *http.Request, db *DB) {
+	offset, limit := parsePage(r)
+	runs, err := db.listScanRuns(offset, limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if runs == nil {
+		runs = []ScanRunRow{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// runDetail is a scan run with the files that failed in it
+type runDetail struct {
+	ScanRunRow
+	Errors []ScanRunError `json:"errors"`
+}
+
+func handleGetRun(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	run, err := db.getScanRun(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if run == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	errs, err := db.listScanRunErrors(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, runDetail{ScanRunRow: *run, Errors: errs})
+}
+
+func handleListInterrupted(w http.ResponseWriter, r *http.Request, db *DB) {
+	runs, err := db.listScanRunsByStatus(runInterrupted)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if runs == nil {
+		runs = []ScanRunRow{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func handleReconcile(w http.ResponseWriter, r *http.Request, db *DB) {
+	runs, err := reconcileInterruptedRuns(db)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if runs == nil {
+		runs = []ScanRunRow{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func handleResume(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	job, _, err := resumeScanRun(db, id)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, scanResp{Started: true, Status: "resumed", JobID: job.ID})
+}
+
+func handleScanPlan(w http.ResponseWriter, r *http.Request) {
+	plan := jobs.latestPlan()
+	if plan == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "no dry-run plan available"})
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="import-plan.csv"`)
+		_ = plan.writeCSV(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = plan.writeJSON(w)
+}
+
+func handleExecutePlan(w http.ResponseWriter, r *http.Request) {
+	var req executePlanReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	plan := req.Plan
+	if plan == nil {
+		plan = jobs.latestPlan()
+	}
+	if plan == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "no plan to execute"})
+		return
+	}
+	job, err := executePlan(plan, req.config())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, scanResp{Started: true, Status: "started", JobID: job.ID})
+}
+
+func handleWatchStatus(w http.ResponseWriter, r *http.Request) {
+	status := currentWatchStatus()
+	if status == nil {
+		writeJSON(w, http.StatusOK, WatchStatus{})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func handleWatchStart(w http.ResponseWriter, r *http.Request) {
+	var req watchReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	options := WatchOptions{
+		StableFor:    time.Duration(req.SettleSeconds) * time.Second,
+		PollInterval: time.Duration(req.PollSeconds) * time.Second,
+		ForcePolling: req.ForcePolling,
+	}
+	watcher, err := startWatch(req.config(), options)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, watcher.Status())
+}
+
+func handleWatchStop(w http.ResponseWriter, r *http.Request) {
+	if !stopWatch() {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "watcher not running"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, healthResp{Ok: true, Version: "0.1.0", Timestamp: time.Now()})
 }
@@ -119,7 +577,12 @@ func handleListIncoming(w http.ResponseWriter, r *http.Request, db *DB) {
 
 func handleListOutcoming(w http.ResponseWriter, r *http.Request, db *DB) {
 	offset, limit := parsePage(r)
-	rows, err := db.listOutcomingRows(offset, limit)
+	runID, _ := strconv.ParseInt(r.URL.Query().Get("runId"), 10, 64)
+	coversOnly := r.URL.Query().Get("stacks") == "collapse"
+	rows, err := db.listOutcomingRows(offset, limit, runID, coversOnly)
+	if err == nil {
+		err = attachStacks(db, rows)
+	}
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
 		return
@@ -143,7 +606,45 @@ func handleGetOutcoming(w http.ResponseWriter, r *http.Request, db *DB) {
 		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
 		return
 	}
-	writeJSON(w, http.StatusOK, row)
+	rows := []OutcomingRow{*row}
+	if err := attachStacks(db, rows); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, rows[0])
+}
+
+// handleOutcomingVersions lists the earlier files of a library row: replaced by upgrades or trashed as duplicates
+func handleOutcomingVersions(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	versions, err := db.listReplacedVersions(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if versions == nil {
+		versions = []ReplacedVersion{}
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// handleOutcomingAttachments lists the sidecars stored next to a library file
+func handleOutcomingAttachments(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	attachments, err := db.listAttachments(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, attachments)
 }
 
 func handleTags(w http.ResponseWriter, r *http.Request, db *DB) {
@@ -165,11 +666,23 @@ func handleTags(w http.ResponseWriter, r *http.Request, db *DB) {
 		req.Tags = []string{}
 	}
 
-	// Update tags in database
-	if err := db.updateTags(id, req.Tags); err != nil {
+	ids, err := stackTargets(db, id, req.Stack)
+	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
 		return
 	}
+	if ids == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+
+	// Update tags in database
+	for _, target := range ids {
+		if err := db.updateTags(target, req.Tags); err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+			return
+		}
+	}
 
 	writeJSON(w, http.StatusOK, updateTagsResp{
 		Ok:   true,
@@ -177,27 +690,301 @@ func handleTags(w http.ResponseWriter, r *http.Request, db *DB) {
 	})
 }
 
-func handleScan(w http.ResponseWriter, r *http.Request, db *DB) {
+// deleteOutcomingReq optionally extends a delete to the whole stack
+type deleteOutcomingReq struct {
+	Stack bool `json:"stack"`
+}
+
+type deleteOutcomingResp struct {
+	Ok      bool               `json:"ok"`
+	Deleted []TrashedDuplicate `json:"deleted"`
+}
+
+// handleDeleteOutcoming moves a library file (or its whole stack) to the library trash and removes its rows
+func handleDeleteOutcoming(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	var req deleteOutcomingReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	ids, err := stackTargets(db, id, req.Stack)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if ids == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	resp := deleteOutcomingResp{Ok: true, Deleted: []TrashedDuplicate{}}
+	for _, target := range ids {
+		row, err := db.getOutcomingByIDRow(target)
+		if err != nil || row == nil {
+			continue
+		}
+		trashPath, err := deleteLibraryFile(db, destFolder, target)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+			return
+		}
+		resp.Deleted = append(resp.Deleted, TrashedDuplicate{ID: target, DestPath: row.DestPath, TrashPath: trashPath})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handleGetStack(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	st, err := db.getStack(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if st == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "stack not found"})
+		return
+	}
+	members := []OutcomingRow{}
+	for _, member := range st.MemberIDs {
+		row, err := db.getOutcomingByIDRow(member)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+			return
+		}
+		if row != nil {
+			members = append(members, *row)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stack": st, "members": members})
+}
+
+// stackCoverReq names the member that becomes the cover
+type stackCoverReq struct {
+	ID int64 `json:"id"`
+}
+
+func handleStackCover(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	var req stackCoverReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	if err := db.setStackCover(id, req.ID); err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "file is not a member of this stack"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	st, err := db.getStack(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleScan starts a scan of src, or one job scanning the given source
+// profiles; profile scans go to the server's library unless dest is set
+func handleScan(w http.ResponseWriter, r *http.Request, db *DB, destFolder string) {
 	var req scanReq
 	_ = json.NewDecoder(r.Body).Decode(&req)
 
-	config := ProcessingConfig{
-		SrcFolder:  req.Src,
-		DestFolder: req.Dest,
+	config := req.config()
+	if len(req.Profiles) > 0 && config.DestFolder == "" {
+		config.DestFolder = destFolder
+	}
+	// Plans are only written into the library's plans folder
+	if req.PlanFile != "" {
+		planFile, err := libraryPlanFile(config.DestFolder, req.PlanFile)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+			return
+		}
+		config.PlanFile = planFile
 	}
 
-	// Start file processing in background (returns immediately)
-	fileProcessing(config)
+	// Queue the scan as a job (returns immediately)
+	var job *Job
+	var err error
+	if len(req.Profiles) > 0 {
+		var configs []ProcessingConfig
+		if configs, err = profileConfigs(db, req.Profiles, config); err == nil {
+			job, err = startSources(configs)
+		}
+	} else {
+		job, err = startProcessing(config)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
 
 	resp := scanResp{
 		Started: true,
 		Status:  "started",
 		Skipped: 0,
 		Failed:  0,
+		JobID:   job.ID,
 	}
 	writeJSON(w, http.StatusAccepted, resp)
 }
 
+// handleExplainRules evaluates the rules on one source file and shows how each
+// rule judged it and where the file would go; dest defaults to the server's library
+func handleExplainRules(w http.ResponseWriter, r *http.Request, destFolder string) {
+	var req explainRulesReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return
+	}
+	if req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "path is required"})
+		return
+	}
+	config := req.config()
+	if config.DestFolder == "" {
+		config.DestFolder = destFolder
+	}
+	var set *ruleSet
+	var err error
+	switch {
+	case req.Rules != nil:
+		set, err = compileRules(req.Rules)
+	case config.RulesFile != "":
+		set, err = loadRules(config.RulesFile)
+	default:
+		err = errors.New("rules or rulesFile is required")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	ex, err := explainRulesFor(config, set, req.Path)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, ex)
+}
+
+func handleListProfiles(w http.ResponseWriter, r *http.Request, db *DB) {
+	profiles, err := db.listSourceProfiles()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+func handleGetProfile(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	p, err := db.getSourceProfile(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if p == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// decodeProfile reads and validates a source profile from the request body,
+// answering the request if it is not valid. id is the profile being updated, 0 for a new one.
+func decodeProfile(w http.ResponseWriter, r *http.Request, db *DB, id int64) *SourceProfile {
+	var p SourceProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+		return nil
+	}
+	if err := p.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return nil
+	}
+	existing, err := db.getSourceProfileByName(p.Name)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return nil
+	}
+	if existing != nil && existing.ID != id {
+		writeJSON(w, http.StatusConflict, apiError{Error: fmt.Sprintf("profile %q already exists", p.Name)})
+		return nil
+	}
+	p.ID = id
+	return &p
+}
+
+func handleCreateProfile(w http.ResponseWriter, r *http.Request, db *DB) {
+	p := decodeProfile(w, r, db, 0)
+	if p == nil {
+		return
+	}
+	if err := db.insertSourceProfile(p); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func handleUpdateProfile(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	p := decodeProfile(w, r, db, id)
+	if p == nil {
+		return
+	}
+	if err := db.updateSourceProfile(p); err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	// Return the stored profile, with its creation time
+	if stored, err := db.getSourceProfile(id); err == nil && stored != nil {
+		p = stored
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func handleDeleteProfile(w http.ResponseWriter, r *http.Request, db *DB) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid id"})
+		return
+	}
+	if err := db.deleteSourceProfile(id); err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
 func parsePage(r *http.Request) (int64, int64) {
 	q := r.URL.Query()
 	var (
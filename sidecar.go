@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sidecar kinds, named after their extension
+const (
+	SidecarXMP  = "xmp"  // Lightroom/darktable/digiKam edits, ratings and keywords
+	SidecarAAE  = "aae"  // Apple Photos edit instructions
+	SidecarTHM  = "thm"  // camera thumbnail of a video
+	SidecarJSON = "json" // Google Photos/Takeout metadata
+)
+
+// maxOrphanReport caps the orphan sidecars listed in the scan status
+const maxOrphanReport = 100
+
+// sidecarKind returns the kind of a sidecar file name, or "" if it is not one
+func sidecarKind(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xmp":
+		return SidecarXMP
+	case ".aae":
+		return SidecarAAE
+	case ".thm":
+		return SidecarTHM
+	case ".json":
+		return SidecarJSON
+	}
+	return ""
+}
+
+// sidecarPreference ranks candidate primaries of a sidecar; lower wins.
+// XMP files usually belong to the RAW, THM files to the video.
+func sidecarPreference(kind, primary string) int {
+	ext := strings.ToLower(filepath.Ext(primary))
+	switch {
+	case kind == SidecarXMP && rawExts[ext]:
+		return 0
+	case kind == SidecarTHM && isVideoExt(ext):
+		return 0
+	case kind == SidecarAAE && isVideoExt(ext):
+		return 3
+	case isVideoExt(ext):
+		return 2
+	case rawExts[ext] && kind == SidecarAAE:
+		return 2
+	}
+	return 1
+}
+
+// sidecarFile is a sidecar that travels with a media file
+type sidecarFile struct {
+	kind     string
+	srcPath  string
+	destPath string
+	hash     string
+	size     int64
+	meta     *SidecarMetadata
+}
+
+// sidecarIndex maps sidecars to their primaries, one directory listing at a time
+type sidecarIndex struct {
+	mu        sync.Mutex
+	dirs      map[string]bool
+	primaryOf map[string]string   // sidecar path -> media file path
+	sidecars  map[string][]string // media file path -> sidecar paths
+	takeout   *takeoutIndex       // matches JSON files by the Takeout rules when importing a Takeout export
+}
+
+func newSidecarIndex(takeout *takeoutIndex) *sidecarIndex {
+	return &sidecarIndex{
+		takeout:   takeout,
+		dirs:      make(map[string]bool),
+		primaryOf: make(map[string]string),
+		sidecars:  make(map[string][]string),
+	}
+}
+
+// primary returns the media file a sidecar belongs to, or "" for an orphan
+func (x *sidecarIndex) primary(path string) string {
+	x.load(filepath.Dir(path))
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.primaryOf[path]
+}
+
+// of returns the sidecars of a media file
+func (x *sidecarIndex) of(path string) []string {
+	x.load(filepath.Dir(path))
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.sidecars[path]
+}
+
+// load matches the sidecars of dir with their media files by name: IMG_1.JPG
+// takes IMG_1.JPG.xmp and IMG_1.xmp (any case). When several media files share
+// the base name, sidecarPreference picks one. In a Takeout export JSON files
+// are matched by takeoutIndex instead.
+func (x *sidecarIndex) load(dir string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.dirs[dir] {
+		return
+	}
+	x.dirs[dir] = true
+	entries, err := readSourceDir(dir)
+	if err != nil {
+		return
+	}
+	byName := make(map[string]string)   // lower-cased full name -> path
+	byBase := make(map[string][]string) // lower-cased name without extension -> paths
+	var sidecars []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), "._") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if sidecarKind(e.Name()) != "" {
+			sidecars = append(sidecars, path)
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if !isImageExt(ext) && !isVideoExt(ext) && !rawExts[ext] {
+			continue
+		}
+		lower := strings.ToLower(e.Name())
+		byName[lower] = path
+		base := strings.TrimSuffix(lower, ext)
+		byBase[base] = append(byBase[base], path)
+	}
+	for _, sc := range sidecars {
+		kind := sidecarKind(sc)
+		if kind == SidecarJSON && x.takeout != nil {
+			if primary := x.takeout.sidecarOwner(sc); primary != "" {
+				x.primaryOf[sc] = primary
+				x.sidecars[primary] = append(x.sidecars[primary], sc)
+			}
+			continue
+		}
+		stem := strings.ToLower(strings.TrimSuffix(filepath.Base(sc), filepath.Ext(sc)))
+		primary, ok := byName[stem]
+		if !ok {
+			for _, candidate := range byBase[stem] {
+				if primary == "" || sidecarPreference(kind, candidate) < sidecarPreference(kind, primary) {
+					primary = candidate
+				}
+			}
+		}
+		if primary == "" {
+			continue
+		}
+		x.primaryOf[sc] = primary
+		x.sidecars[primary] = append(x.sidecars[primary], sc)
+	}
+}
+
+// walkSidecar handles a sidecar met by the directory walk. A sidecar is never
+// imported on its own: it travels with its media file, and an orphan is
+// reported instead. Returns the media file, "" for an orphan.
+func walkSidecar(db *DB, config ProcessingConfig, sidecars *sidecarIndex, path string, info os.FileInfo) string {
+	if primary := sidecars.primary(path); primary != "" {
+		return primary
+	}
+	// Album and account files of a Takeout export describe no single file
+	if config.takeout != nil && takeoutIndexFiles[strings.ToLower(filepath.Base(path))] {
+		return ""
+	}
+	fmt.Println("orphan sidecar", path, ": no matching media file")
+	config.job.tracker.recordOrphanSidecar(path)
+	if config.DryRun {
+		config.plan.addOrphanSidecar(path, info.Size())
+	} else if config.runID != 0 {
+		if err := db.insertScanRunError(config.runID, path, "orphan sidecar: no matching media file"); err != nil {
+			fmt.Println("failed to record orphan sidecar", path, ":", err)
+		}
+	}
+	return ""
+}
+
+// sidecarDestName names a sidecar after the destination of its primary, so
+// IMG_1.JPG.xmp follows IMG_1.JPG to IMG_1_1.JPG.xmp and IMG_1.xmp becomes IMG_1_1.xmp
+func sidecarDestName(sidecar, primarySrc, primaryDest string) string {
+	name, src, dst := filepath.Base(sidecar), filepath.Base(primarySrc), filepath.Base(primaryDest)
+	if len(name) > len(src) && strings.EqualFold(name[:len(src)], src) {
+		return dst + name[len(src):]
+	}
+	srcStem := strings.TrimSuffix(src, filepath.Ext(src))
+	dstStem := strings.TrimSuffix(dst, filepath.Ext(dst))
+	if len(name) >= len(srcStem) && strings.EqualFold(name[:len(srcStem)], srcStem) {
+		return dstStem + name[len(srcStem):]
+	}
+	// Takeout JSON names are truncated or numbered; they become IMG_1.JPG.json
+	return dst + filepath.Ext(name)
+}
+
+// placeSidecars copies the sidecars of a file next to its library copy and
+// parses them. A sidecar that is already there with the same content is kept;
+// one that cannot be placed is logged and dropped, the media file is not failed.
+func placeSidecars(config ProcessingConfig, state *scanState, fileInfo *FileInfo) {
+	// A duplicate of a file still being copied in this scan has no library copy to follow yet
+	if fileInfo.destPath == "" {
+		fileInfo.sidecars = nil
+		return
+	}
+	var placed []sidecarFile
+	for _, sc := range fileInfo.sidecars {
+		hash, err := readFileHash(sc.srcPath, config.throttle())
+		if err != nil {
+			fmt.Println("skipping sidecar", sc.srcPath, ":", err)
+			continue
+		}
+		sc.hash = hash
+		if info, err := statSource(sc.srcPath); err == nil {
+			sc.size = info.Size()
+		}
+		dest := filepath.Join(filepath.Dir(fileInfo.destPath), sidecarDestName(sc.srcPath, fileInfo.srcPath, fileInfo.destPath))
+		if existing, err := readFileHash(dest, config.throttle()); err == nil && existing == hash {
+			sc.destPath = dest
+		} else {
+			resolved, err := resolveCollision(config, state.dests, dest, hash)
+			if err != nil {
+				fmt.Println("skipping sidecar", sc.srcPath, ":", err)
+				continue
+			}
+			if err := copyFile(sc.srcPath, resolved, hash, nil, 0, config.throttle()); err != nil {
+				state.dests.release(resolved)
+				fmt.Println("skipping sidecar", sc.srcPath, ":", err)
+				continue
+			}
+			sc.destPath = resolved
+		}
+		sc.meta = parseSidecar(sc.kind, sc.srcPath)
+		placed = append(placed, sc)
+	}
+	fileInfo.sidecars = placed
+}
+
+// sidecarsOf lists the sidecars of a media file for processing
+func sidecarsOf(state *scanState, path string) []sidecarFile {
+	var out []sidecarFile
+	for _, sc := range state.sidecars.of(path) {
+		out = append(out, sidecarFile{kind: sidecarKind(sc), srcPath: sc})
+	}
+	return out
+}
+
+// SidecarMetadata is what a sidecar adds to the metadata of its media file
+type SidecarMetadata struct {
+	Kind        string     `json:"kind"`
+	File        string     `json:"file"`
+	Rating      int        `json:"rating,omitempty"`
+	Label       string     `json:"label,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Keywords    []string   `json:"keywords,omitempty"`
+	People      []string   `json:"people,omitempty"`
+	TakenAt     *time.Time `json:"takenAt,omitempty"`
+	Latitude    float64    `json:"latitude,omitempty"`
+	Longitude   float64    `json:"longitude,omitempty"`
+	HasLocation bool       `json:"hasLocation,omitempty"`
+	Editor      string     `json:"editor,omitempty"` // application that wrote an AAE edit
+}
+
+var (
+	xmpAttr = func(name string) *regexp.Regexp {
+		return regexp.MustCompile(name + `\s*=\s*"([^"]*)"|<` + name + `>([^<]*)</` + name + `>`)
+	}
+	xmpRating      = xmpAttr(`xmp:Rating`)
+	xmpLabel       = xmpAttr(`xmp:Label`)
+	xmpGPSLat      = xmpAttr(`exif:GPSLatitude`)
+	xmpGPSLon      = xmpAttr(`exif:GPSLongitude`)
+	xmpDate        = xmpAttr(`exif:DateTimeOriginal`)
+	xmpSubject     = regexp.MustCompile(`(?s)<dc:subject>(.*?)</dc:subject>`)
+	xmpTitle       = regexp.MustCompile(`(?s)<dc:title>(.*?)</dc:title>`)
+	xmpDescription = regexp.MustCompile(`(?s)<dc:description>(.*?)</dc:description>`)
+	rdfItem        = regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`)
+	aaeEditor      = regexp.MustCompile(`(?s)<key>adjustmentFormatIdentifier</key>\s*<string>([^<]*)</string>`)
+	xmpCoordinate  = regexp.MustCompile(`^(\d+),(\d+(?:\.\d+)?)([NSEW])$`)
+)
+
+// parseSidecar reads what a sidecar knows about its media file; nil if nothing
+func parseSidecar(kind, path string) *SidecarMetadata {
+	data, err := readSourceFile(path)
+	if err != nil {
+		return nil
+	}
+	meta := &SidecarMetadata{Kind: kind, File: filepath.Base(path)}
+	switch kind {
+	case SidecarXMP:
+		parseXMPSidecar(string(data), meta)
+	case SidecarAAE:
+		if m := aaeEditor.FindStringSubmatch(string(data)); m != nil {
+			meta.Editor = m[1]
+		}
+	case SidecarJSON:
+		gm, err := parseGoogleJSON(data)
+		if err != nil {
+			return nil
+		}
+		*meta = gm.sidecarMetadata(meta.File)
+	}
+	return meta
+}
+
+func firstMatch(re *regexp.Regexp, s string) string {
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	for _, g := range m[1:] {
+		if g != "" {
+			return strings.TrimSpace(g)
+		}
+	}
+	return ""
+}
+
+func rdfItems(block string) []string {
+	var out []string
+	for _, m := range rdfItem.FindAllStringSubmatch(block, -1) {
+		if v := strings.TrimSpace(m[1]); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func parseXMPSidecar(xmp string, meta *SidecarMetadata) {
+	meta.Rating, _ = strconv.Atoi(firstMatch(xmpRating, xmp))
+	meta.Label = firstMatch(xmpLabel, xmp)
+	if m := xmpSubject.FindStringSubmatch(xmp); m != nil {
+		meta.Keywords = rdfItems(m[1])
+	}
+	if m := xmpTitle.FindStringSubmatch(xmp); m != nil {
+		if items := rdfItems(m[1]); len(items) > 0 {
+			meta.Title = items[0]
+		}
+	}
+	if m := xmpDescription.FindStringSubmatch(xmp); m != nil {
+		if items := rdfItems(m[1]); len(items) > 0 {
+			meta.Description = items[0]
+		}
+	}
+	if date := firstMatch(xmpDate, xmp); len(date) >= 19 {
+		if t, err := time.Parse("2006-01-02T15:04:05", date[:19]); err == nil {
+			meta.TakenAt = &t
+		}
+	}
+	lat, latOK := parseXMPCoordinate(firstMatch(xmpGPSLat, xmp))
+	lon, lonOK := parseXMPCoordinate(firstMatch(xmpGPSLon, xmp))
+	if latOK && lonOK {
+		meta.Latitude, meta.Longitude, meta.HasLocation = lat, lon, true
+	}
+}
+
+// parseXMPCoordinate reads the XMP "DDD,MM.mmmmR" form, e.g. 52,22.5N
+func parseXMPCoordinate(s string) (float64, bool) {
+	m := xmpCoordinate.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	deg, _ := strconv.ParseFloat(m[1], 64)
+	minutes, _ := strconv.ParseFloat(m[2], 64)
+	v := deg + minutes/60
+	if m[3] == "S" || m[3] == "W" {
+		v = -v
+	}
+	return v, true
+}
+
+// googleMetadata is the part of a Google Photos JSON sidecar we use
+type googleMetadata struct {
+	Title        string          `json:"title"`
+	Description  string          `json:"description"`
+	PhotoTakenAt googleTimestamp `json:"photoTakenTime"`
+	GeoData      googleGeo       `json:"geoData"`
+	GeoDataExif  googleGeo       `json:"geoDataExif"`
+	People       []struct {
+		Name string `json:"name"`
+	} `json:"people"`
+	Favorited bool `json:"favorited"`
+}
+
+type googleTimestamp struct {
+	Timestamp string `json:"timestamp"`
+}
+
+type googleGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func parseGoogleJSON(data []byte) (*googleMetadata, error) {
+	var gm googleMetadata
+	if err := json.Unmarshal(data, &gm); err != nil {
+		return nil, err
+	}
+	return &gm, nil
+}
+
+// takenAt returns the capture time Google recorded, if any
+func (gm *googleMetadata) takenAt() (time.Time, bool) {
+	sec, err := strconv.ParseInt(gm.PhotoTakenAt.Timestamp, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
+
+func (gm *googleMetadata) sidecarMetadata(file string) SidecarMetadata {
+	meta := SidecarMetadata{Kind: SidecarJSON, File: file, Title: gm.Title, Description: gm.Description}
+	if t, ok := gm.takenAt(); ok {
+		meta.TakenAt = &t
+	}
+	for _, geo := range []googleGeo{gm.GeoDataExif, gm.GeoData} {
+		if geo.Latitude != 0 || geo.Longitude != 0 {
+			meta.Latitude, meta.Longitude, meta.HasLocation = geo.Latitude, geo.Longitude, true
+			break
+		}
+	}
+	for _, p := range gm.People {
+		if p.Name != "" {
+			meta.People = append(meta.People, p.Name)
+		}
+	}
+	if gm.Favorited {
+		meta.Rating = 5
+	}
+	return meta
+}
+
+// mergeSidecarMetadata adds sidecar metadata to a file's metadata JSON under "sidecars"
+func mergeSidecarMetadata(metadata string, metas []*SidecarMetadata) string {
+	var added []*SidecarMetadata
+	for _, m := range metas {
+		if m != nil {
+			added = append(added, m)
+		}
+	}
+	if len(added) == 0 {
+		return metadata
+	}
+	obj := map[string]interface{}{}
+	if metadata != "" {
+		_ = json.Unmarshal([]byte(metadata), &obj)
+	}
+	var existing []interface{}
+	if list, ok := obj["sidecars"].([]interface{}); ok {
+		existing = list
+	}
+	for _, m := range added {
+		existing = append(existing, m)
+	}
+	obj["sidecars"] = existing
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return metadata
+	}
+	return string(b)
+}
+
+// recordSidecars stores the placed sidecars of a file as attachments of
+// library row id and merges the metadata of newly attached ones into the row
+func recordSidecars(db *DB, id int64, fileInfo FileInfo, mergeMetadata bool) {
+	var metas []*SidecarMetadata
+	for _, sc := range fileInfo.sidecars {
+		added, err := db.insertAttachment(id, sc)
+		if err != nil {
+			fmt.Println("failed to record sidecar", sc.srcPath, ":", err)
+			continue
+		}
+		if added {
+			metas = append(metas, sc.meta)
+		}
+	}
+	if mergeMetadata && len(metas) > 0 {
+		if err := db.mergeOutcomingSidecarMetadata(id, metas); err != nil {
+			fmt.Println("failed to merge sidecar metadata for", fileInfo.srcPath, ":", err)
+		}
+	}
+}
+
+// cleanupSidecars applies the source cleanup of a media file to its attached sidecars
+func cleanupSidecars(db *DB, config ProcessingConfig, fileInfo FileInfo) {
+	mode := config.cleanupMode()
+	for _, sc := range fileInfo.sidecars {
+		if isArchiveMember(sc.srcPath) {
+			continue
+		}
+		if got, err := readFileHash(sc.destPath, config.throttle()); err != nil || got != sc.hash {
+			continue
+		}
+		trashPath := ""
+		if mode == CleanupTrash {
+			target, err := trashTarget(config, sc.srcPath, time.Now())
+			if err == nil {
+				err = ensureDirectory(filepath.Dir(target))
+			}
+			if err == nil {
+				err = moveFile(sc.srcPath, target)
+			}
+			if err != nil {
+				fmt.Println("source cleanup skipped for sidecar", sc.srcPath, ":", err)
+				continue
+			}
+			trashPath = target
+		} else if err := os.Remove(sc.srcPath); err != nil {
+			fmt.Println("source cleanup skipped for sidecar", sc.srcPath, ":", err)
+			continue
+		}
+		if err := db.insertCleanupRecord(sc.hash, sc.srcPath, mode, trashPath, config.trashExpiry(mode)); err != nil {
+			fmt.Println("failed to log sidecar cleanup:", err)
+		}
+	}
+}
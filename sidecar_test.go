@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarDestName(t *testing.T) {
+	tests := []struct {
+		sidecar, primarySrc, primaryDest, want string
+	}{
+		{"IMG_1.JPG.xmp", "IMG_1.JPG", "IMG_1.JPG", "IMG_1.JPG.xmp"},
+		{"IMG_1.JPG.xmp", "IMG_1.JPG", "IMG_1_1.JPG", "IMG_1_1.JPG.xmp"},
+		{"IMG_1.xmp", "IMG_1.CR2", "IMG_1_1.CR2", "IMG_1_1.xmp"},
+		{"img_1.jpg.xmp", "IMG_1.JPG", "2019_IMG_1.JPG", "2019_IMG_1.JPG.xmp"},
+		{"IMG_1.THM", "IMG_1.MOV", "IMG_1_abcdef01.MOV", "IMG_1_abcdef01.THM"},
+		{"IMG_1.JPG.supplemental-metadata.json", "IMG_1.JPG", "IMG_1_1.JPG", "IMG_1_1.JPG.supplemental-metadata.json"},
+		// Takeout JSON whose name was cut or numbered
+		{"Screenshot_20190101-120000_Some.json", "Screenshot_20190101-120000_Some Long App.jpg", "Screenshot.jpg", "Screenshot.jpg.json"},
+		{"IMG_1.jpg(1).json", "IMG_1(1).jpg", "IMG_1_1.jpg", "IMG_1_1.jpg.json"},
+	}
+	for _, tt := range tests {
+		if got := sidecarDestName(tt.sidecar, tt.primarySrc, tt.primaryDest); got != tt.want {
+			t.Errorf("sidecarDestName(%q, %q, %q) = %q, want %q", tt.sidecar, tt.primarySrc, tt.primaryDest, got, tt.want)
+		}
+	}
+}
+
+func TestSidecarIndexPairs(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  map[string]string // sidecar -> media file, "" for an orphan
+	}{
+		{
+			name:  "full name",
+			files: []string{"IMG_1.JPG", "IMG_1.JPG.xmp"},
+			want:  map[string]string{"IMG_1.JPG.xmp": "IMG_1.JPG"},
+		},
+		{
+			name:  "xmp goes to the raw",
+			files: []string{"IMG_1.JPG", "IMG_1.CR2", "IMG_1.xmp"},
+			want:  map[string]string{"IMG_1.xmp": "IMG_1.CR2"},
+		},
+		{
+			name:  "full name beats the raw",
+			files: []string{"IMG_1.JPG", "IMG_1.CR2", "IMG_1.JPG.xmp"},
+			want:  map[string]string{"IMG_1.JPG.xmp": "IMG_1.JPG"},
+		},
+		{
+			name:  "thm goes to the video",
+			files: []string{"MVI_2.JPG", "MVI_2.MOV", "MVI_2.THM"},
+			want:  map[string]string{"MVI_2.THM": "MVI_2.MOV"},
+		},
+		{
+			name:  "aae stays off the video",
+			files: []string{"IMG_3.HEIC", "IMG_3.MOV", "IMG_3.AAE"},
+			want:  map[string]string{"IMG_3.AAE": "IMG_3.HEIC"},
+		},
+		{
+			name:  "case differs",
+			files: []string{"img_4.jpg", "IMG_4.XMP"},
+			want:  map[string]string{"IMG_4.XMP": "img_4.jpg"},
+		},
+		{
+			name:  "orphan",
+			files: []string{"IMG_5.JPG", "IMG_6.xmp", "._IMG_5.JPG.xmp"},
+			want:  map[string]string{"IMG_6.xmp": "", "._IMG_5.JPG.xmp": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			x := newSidecarIndex(nil)
+			for sc, media := range tt.want {
+				want := ""
+				if media != "" {
+					want = filepath.Join(dir, media)
+				}
+				if got := x.primary(filepath.Join(dir, sc)); got != want {
+					t.Errorf("primary of %s = %q, want %q", sc, got, want)
+				}
+			}
+		})
+	}
+}
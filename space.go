@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Space check modes for ProcessingConfig.SpaceCheck
+const (
+	SpaceFail = "fail" // a scan whose writes do not fit on the destination is refused
+	SpaceWarn = "warn" // it runs anyway, with a warning in its status
+	SpaceOff  = "off"  // free space is not checked
+)
+
+// defaultDiskReserve is the free space imports leave on the destination unless configured
+const defaultDiskReserve = 1 << 30
+
+func (c ProcessingConfig) spaceCheck() string {
+	if c.SpaceCheck != "" {
+		return c.SpaceCheck
+	}
+	return SpaceFail
+}
+
+func validateSpaceCheck(s string) error {
+	switch s {
+	case SpaceFail, SpaceWarn, SpaceOff:
+		return nil
+	}
+	return fmt.Errorf("unknown space check %q (expected %s, %s or %s)", s, SpaceFail, SpaceWarn, SpaceOff)
+}
+
+// diskReserve returns the bytes to keep free on the destination
+func (c ProcessingConfig) diskReserve() int64 {
+	if c.DiskReserve > 0 {
+		return c.DiskReserve
+	}
+	return defaultDiskReserve
+}
+
+// writesData reports whether importing path copies its bytes rather than linking them
+func (c ProcessingConfig) writesData(path string) bool {
+	return c.linkMode() == LinkCopy || isArchiveMember(path)
+}
+
+// preflightSpace estimates what the scan will write and compares it with the
+// free space on the destination, less the reserve. It returns an error when
+// it does not fit and the space check is fail.
+func preflightSpace(db *DB, config ProcessingConfig) error {
+	if config.DryRun || config.spaceCheck() == SpaceOff {
+		return nil
+	}
+	free, ok := freeSpace(config.DestFolder)
+	if !ok {
+		return nil
+	}
+	need, err := estimateWrites(db, config)
+	if err != nil {
+		fmt.Println("failed to estimate the size of the import:", err)
+		return nil
+	}
+	reserve := config.diskReserve()
+	warning := ""
+	if need+reserve > free {
+		warning = fmt.Sprintf("not enough space on %s: about %d bytes to write, %d free, %d to keep free", config.DestFolder, need, free, reserve)
+	}
+	config.job.tracker.setSpace(need, free, warning)
+	switch {
+	case warning == "":
+		fmt.Println("About", need, "bytes to write,", free, "free on", config.DestFolder)
+		return nil
+	case config.spaceCheck() == SpaceWarn:
+		fmt.Println("warning:", warning)
+		return nil
+	}
+	return fmt.Errorf("%s", warning)
+}
+
+// estimateWrites returns about how many bytes a scan will write into the
+// library: the files the walk would import, less those the hash cache already
+// knows are in the library. Linked files take no space; an archive counts
+// with its own size, which for a compressed tar is less than it unpacks to.
+func estimateWrites(db *DB, config ProcessingConfig) (int64, error) {
+	if config.executingPlan() {
+		return config.plan.Totals.NewBytes, nil
+	}
+	resumed := config.resumeSkip()
+	var total int64
+	count := func(path string, info os.FileInfo) {
+		if resumed(path) || !config.writesData(path) {
+			return
+		}
+		if archiveKind(path) == "" && config.filter.skipFile(path, info) != "" {
+			return
+		}
+		if hash, ok := cachedHash(db, config, newHashCacheKey(path, info)); ok {
+			if _, _, exists, err := db.findOutcomingByHash(hash); err == nil && exists {
+				return
+			}
+		}
+		total += info.Size()
+	}
+
+	if config.files != nil {
+		for _, path := range config.files {
+			if info, err := statSource(path); err == nil && info.Mode().IsRegular() {
+				count(path, info)
+			}
+		}
+		return total, nil
+	}
+
+	err := filepath.Walk(config.SrcFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != config.SrcFolder && (path == config.trashFolder() || path == config.DestFolder || config.filter.skipDir(path, info)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if archiveKind(path) != "" && info.Mode().IsRegular() {
+			if path != config.SrcFolder && config.filter.skipDir(path, info) {
+				return nil
+			}
+			// Archive members are always copied
+			total += info.Size()
+			return nil
+		}
+		count(path, info)
+		return nil
+	})
+	return total, err
+}
+
+// ensureSpace fails a file whose copy would eat into the reserve on the
+// destination, so the scan never leaves a partial file on a full disk
+func ensureSpace(config ProcessingConfig, fileInfo *FileInfo) error {
+	if config.spaceCheck() == SpaceOff || !config.writesData(fileInfo.srcPath) {
+		return nil
+	}
+	free, ok := freeSpace(config.DestFolder)
+	if !ok {
+		return nil
+	}
+	if reserve := config.diskReserve(); fileInfo.size+reserve > free {
+		return fmt.Errorf("not enough space on %s for %s: %d bytes free, %d to keep free", config.DestFolder, fileInfo.srcPath, free, reserve)
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stackMaxSkew is how far apart the EXIF capture times of two images with the
+// same base name may be for them to be stacked; further apart they are taken
+// to be different shots that happen to share a recycled file number
+const stackMaxSkew = 2 * time.Second
+
+// contentIDScanBytes is how much of the head and tail of a file is searched for an Apple ContentIdentifier
+const contentIDScanBytes = 256 << 10
+
+var (
+	// editedSuffix matches the suffixes editors add to a copy: "IMG_1234 (edited)", "IMG_1234-edited", "IMG_1234_edited"
+	editedSuffix = regexp.MustCompile(`(?i)(\s*\(edited\)|[ _-]edited)$`)
+	// appleEdited matches Photos exports of edited pictures, IMG_E1234 for IMG_1234
+	appleEdited = regexp.MustCompile(`(?i)^(IMG_)E(\d+)$`)
+	uuidPattern = regexp.MustCompile(`[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}`)
+)
+
+// rawExts are camera RAW formats; they sort after the processed image of a stack
+var rawExts = map[string]bool{
+	".nef": true, ".cr2": true, ".cr3": true, ".arw": true, ".dng": true,
+	".raf": true, ".orf": true, ".rw2": true, ".pef": true, ".srw": true,
+}
+
+// stackBase strips the extension and any edit marker from a file name.
+// It reports whether the name was that of an edited version.
+func stackBase(name string) (string, bool) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if m := appleEdited.FindStringSubmatch(base); m != nil {
+		return strings.ToLower(m[1] + m[2]), true
+	}
+	if loc := editedSuffix.FindStringIndex(base); loc != nil && loc[0] > 0 {
+		return strings.ToLower(base[:loc[0]]), true
+	}
+	return strings.ToLower(base), false
+}
+
+// stackRank orders the members of a stack: processed originals first, then
+// RAW files, then edited versions, then videos such as the Live Photo clip
+func stackRank(path string) int {
+	ext := strings.ToLower(filepath.Ext(path))
+	_, edited := stackBase(filepath.Base(path))
+	switch {
+	case isVideoExt(ext):
+		return 3
+	case edited:
+		return 2
+	case rawExts[ext]:
+		return 1
+	}
+	return 0
+}
+
+// contentIdentifier returns the Apple ContentIdentifier that ties the photo
+// and the video of a Live Photo together, or "". Images carry it in the Apple
+// maker note, videos in the com.apple.quicktime.content.identifier key. The
+// reads go through throttle if set.
+func contentIdentifier(path string, throttle *ioThrottle) string {
+	var marker []byte
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".heic", ".heif", ".jpg", ".jpeg":
+		marker = []byte("Apple iOS")
+	case ".mov":
+		marker = []byte("com.apple.quicktime.content.identifier")
+	default:
+		return ""
+	}
+	info, err := statSource(path)
+	if err != nil {
+		return ""
+	}
+	// QuickTime metadata may sit at either end of the file
+	offsets := []int64{0}
+	if info.Size() > contentIDScanBytes {
+		offsets = append(offsets, info.Size()-contentIDScanBytes)
+	}
+	for _, off := range offsets {
+		buf := make([]byte, contentIDScanBytes)
+		n, err := readSourceAt(path, buf, off, throttle)
+		if err != nil && err != io.EOF {
+			return ""
+		}
+		buf = buf[:n]
+		if i := bytes.Index(buf, marker); i >= 0 {
+			window := buf[i:]
+			if len(window) > 4096 {
+				window = window[:4096]
+			}
+			if id := uuidPattern.Find(window); id != nil {
+				return strings.ToUpper(string(id))
+			}
+		}
+	}
+	return ""
+}
+
+// stack is a group of source files that belong together: RAW+JPEG pairs,
+// Live Photos and edited versions of the same picture
+type stack struct {
+	key     string   // source directory and shared base name, see stackBase
+	anchor  string   // source path whose layout decides the stack's destination folder
+	cover   string   // source path shown for the stack; the edited version if there is one
+	members []string // source paths, in stackRank order
+
+	dirOnce sync.Once
+	dir     string
+	dirErr  error
+}
+
+// destDir returns the library folder every member of the stack is copied to.
+// A stack already in the library keeps its folder; otherwise it is the folder
+// the layout gives the anchor.
+func (s *stack) destDir(db *DB, config ProcessingConfig) (string, error) {
+	s.dirOnce.Do(func() {
+		if dir, ok, err := db.stackLibraryDir(s.key); err != nil || ok {
+			s.dir, s.dirErr = dir, err
+			return
+		}
+		info, err := statSource(s.anchor)
+		if err != nil {
+			s.dirErr = err
+			return
+		}
+		hash := ""
+		if strings.Contains(filepath.Dir(config.destTemplate()), "{hash") {
+			if hash, err = readFileHash(s.anchor, config.throttle()); err != nil {
+				s.dirErr = err
+				return
+			}
+		}
+		dst, err := buildDestPath(config, s.anchor, info, hash)
+		if err != nil {
+			s.dirErr = err
+			return
+		}
+		s.dir = filepath.Dir(dst)
+	})
+	return s.dir, s.dirErr
+}
+
+// stackIndex finds the stacks of each source directory the first time a file in it is processed
+type stackIndex struct {
+	mu       sync.Mutex
+	dirs     map[string]map[string]*stack // directory -> source path -> stack of two or more files
+	throttle *ioThrottle                  // paces the reads that look for stacks
+}
+
+func newStackIndex(throttle *ioThrottle) *stackIndex {
+	return &stackIndex{dirs: make(map[string]map[string]*stack), throttle: throttle}
+}
+
+// lookup returns the stack path belongs to, or nil if it stands alone
+func (x *stackIndex) lookup(path string) *stack {
+	dir := filepath.Dir(path)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	stacks, ok := x.dirs[dir]
+	if !ok {
+		stacks = findStacks(dir, x.throttle)
+		x.dirs[dir] = stacks
+	}
+	return stacks[path]
+}
+
+// findStacks groups the media files of dir by base name, joins groups that
+// share a ContentIdentifier and splits off images shot at a different time
+func findStacks(dir string, throttle *ioThrottle) map[string]*stack {
+	// Members of a tar cannot be read out of order, so they are not stacked
+	if archive, _, ok := splitArchivePath(dir); ok && archiveKind(archive) == ArchiveTar {
+		return nil
+	}
+	entries, err := readSourceDir(dir)
+	if err != nil {
+		return nil
+	}
+	groups := make(map[string][]string)
+	var bases []string
+	hasVideo := false
+	for _, e := range entries {
+		// AppleDouble "._" files carry media extensions but are not media
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), "._") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if !isImageExt(ext) && !isVideoExt(ext) && !rawExts[ext] {
+			continue
+		}
+		hasVideo = hasVideo || ext == ".mov"
+		base, _ := stackBase(e.Name())
+		if _, ok := groups[base]; !ok {
+			bases = append(bases, base)
+		}
+		groups[base] = append(groups[base], filepath.Join(dir, e.Name()))
+	}
+
+	// Live Photos renamed on export still share their ContentIdentifier
+	owners := make(map[string]string) // ContentIdentifier -> base of the group holding it
+	for _, base := range bases {
+		if !hasVideo {
+			break
+		}
+		for _, path := range groups[base] {
+			id := contentIdentifier(path, throttle)
+			if id == "" {
+				continue
+			}
+			owner, seen := owners[id]
+			if !seen {
+				owners[id] = base
+				continue
+			}
+			if owner != base {
+				groups[owner] = append(groups[owner], groups[base]...)
+				delete(groups, base)
+				break
+			}
+		}
+	}
+
+	out := make(map[string]*stack)
+	for base, paths := range groups {
+		if len(paths) < 2 {
+			continue
+		}
+		for _, members := range splitByCaptureTime(paths, throttle) {
+			if len(members) < 2 {
+				continue
+			}
+			s := newStack(filepath.Join(dir, base), members)
+			for _, p := range members {
+				out[p] = s
+			}
+		}
+	}
+	return out
+}
+
+// splitByCaptureTime keeps images whose EXIF capture time is within
+// stackMaxSkew of the first dated one together; files without a date stay with it
+func splitByCaptureTime(paths []string, throttle *ioThrottle) [][]string {
+	sort.Slice(paths, func(a, b int) bool { return stackLess(paths[a], paths[b]) })
+	var first time.Time
+	var kept []string
+	var split [][]string
+	for _, p := range paths {
+		ed, err := readExif(p, throttle)
+		if err != nil || ed == nil || ed.DateTimeOriginal.IsZero() {
+			kept = append(kept, p)
+			continue
+		}
+		if first.IsZero() {
+			first = ed.DateTimeOriginal
+		}
+		d := ed.DateTimeOriginal.Sub(first)
+		if d < 0 {
+			d = -d
+		}
+		if d > stackMaxSkew {
+			split = append(split, []string{p})
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return append([][]string{kept}, split...)
+}
+
+func stackLess(a, b string) bool {
+	if ra, rb := stackRank(a), stackRank(b); ra != rb {
+		return ra < rb
+	}
+	return a < b
+}
+
+func newStack(key string, members []string) *stack {
+	sort.Slice(members, func(a, b int) bool { return stackLess(members[a], members[b]) })
+	s := &stack{key: key, anchor: members[0], cover: members[0], members: members}
+	for _, p := range members {
+		if stackRank(p) == 2 {
+			s.cover = p
+			break
+		}
+	}
+	return s
+}
+
+// assignStack records which stack a file belongs to, if any
+func assignStack(state *scanState, fileInfo *FileInfo) {
+	if s := state.stacks.lookup(fileInfo.srcPath); s != nil {
+		fileInfo.stackKey = s.key
+		fileInfo.stackCover = s.cover == fileInfo.srcPath
+	}
+}
+
+// stackDestPath moves dstPath into the stack's library folder, keeping its file name
+func stackDestPath(db *DB, config ProcessingConfig, state *scanState, fileInfo FileInfo, dstPath string) (string, error) {
+	s := state.stacks.lookup(fileInfo.srcPath)
+	if s == nil {
+		return dstPath, nil
+	}
+	dir, err := s.destDir(db, config)
+	if err != nil {
+		return "", fmt.Errorf("failed to place stack %s: %w", s.key, err)
+	}
+	return filepath.Join(dir, filepath.Base(dstPath)), nil
+}
+
+// stackTargets returns the library rows an operation on id applies to: id
+// alone, or every member of its stack when wholeStack is set
+func stackTargets(db *DB, id int64, wholeStack bool) ([]int64, error) {
+	row, err := db.getOutcomingByIDRow(id)
+	if err != nil || row == nil {
+		return nil, err
+	}
+	if !wholeStack || row.StackID == 0 {
+		return []int64{id}, nil
+	}
+	st, err := db.getStack(row.StackID)
+	if err != nil || st == nil {
+		return []int64{id}, err
+	}
+	return st.MemberIDs, nil
+}
+
+// deleteLibraryFile moves a library file to the library trash, drops its
+// thumbnail and removes its row. Returns the trash path, empty if the file was already gone.
+func deleteLibraryFile(db *DB, destFolder string, id int64) (string, error) {
+	row, err := db.getOutcomingByIDRow(id)
+	if err != nil {
+		return "", err
+	}
+	if row == nil {
+		return "", fmt.Errorf("%d: not found", id)
+	}
+	trashPath := ""
+	if destExists(row.DestPath) {
+		trashPath = libraryTrashTarget(destFolder, row.DestPath, time.Now())
+		if err := ensureDirectory(filepath.Dir(trashPath)); err != nil {
+			return "", err
+		}
+		if err := moveFile(row.DestPath, trashPath); err != nil {
+			return "", fmt.Errorf("failed to trash %s: %w", row.DestPath, err)
+		}
+	}
+	if row.ThumbnailPath != "" {
+		_ = os.Remove(filepath.Join(destFolder, filepath.FromSlash(row.ThumbnailPath)))
+	}
+	// Sidecars go to the trash with their file
+	attachments, err := db.listAttachments(id)
+	if err != nil {
+		return trashPath, err
+	}
+	for _, a := range attachments {
+		if !destExists(a.DestPath) {
+			continue
+		}
+		target := libraryTrashTarget(destFolder, a.DestPath, time.Now())
+		err := ensureDirectory(filepath.Dir(target))
+		if err == nil {
+			err = moveFile(a.DestPath, target)
+		}
+		if err != nil {
+			fmt.Println("failed to trash sidecar", a.DestPath, ":", err)
+		}
+	}
+	if err := db.deleteOutcomingRow(id); err != nil {
+		return trashPath, err
+	}
+	fmt.Println("deleted", row.DestPath, "->", trashPath)
+	return trashPath, nil
+}
+
+// attachStacks fills in the Stack of every stacked row
+func attachStacks(db *DB, rows []OutcomingRow) error {
+	stacks := make(map[int64]*Stack)
+	for i := range rows {
+		id := rows[i].StackID
+		if id == 0 {
+			continue
+		}
+		if _, ok := stacks[id]; !ok {
+			st, err := db.getStack(id)
+			if err != nil {
+				return err
+			}
+			stacks[id] = st
+		}
+		rows[i].Stack = stacks[id]
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// takeoutNameLimit is the length Google Takeout cuts the name of a JSON
+// sidecar to, not counting ".json". Media names longer than it are cut too.
+const takeoutNameLimit = 47
+
+// takeoutIndexFiles are the JSON files of a Takeout export that describe an
+// album or the account rather than a single media file
+var takeoutIndexFiles = map[string]bool{
+	"metadata.json":                     true,
+	"print-subscriptions.json":          true,
+	"shared_album_comments.json":        true,
+	"user-generated-memory-titles.json": true,
+}
+
+var (
+	// takeoutCopySuffix matches the "(1)" Takeout appends to a repeated name, "IMG_1(1).jpg" and "IMG_1.jpg(1).json"
+	takeoutCopySuffix = regexp.MustCompile(`^(.*)\((\d+)\)$`)
+	// takeoutYearFolder matches the folders Takeout groups photos by year in; they are not albums
+	takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+	// takeoutEdited matches the suffixes Google Photos gives edited copies, in a few languages
+	takeoutEdited = regexp.MustCompile(`(?i)-(edited|bearbeitet|modifié|editado|modificato|bewerkt)$`)
+)
+
+// takeoutIndex reads the JSON metadata of a Google Takeout export one directory at a time
+type takeoutIndex struct {
+	mu   sync.Mutex
+	dirs map[string]*takeoutDir
+}
+
+func newTakeoutIndex() *takeoutIndex {
+	return &takeoutIndex{dirs: make(map[string]*takeoutDir)}
+}
+
+// takeoutDir is what the JSON files of one Takeout folder say about its media
+type takeoutDir struct {
+	album   string                     // album title, "" for the year folders
+	jsonFor map[string]string          // media path -> JSON path describing it
+	owner   map[string]string          // JSON path -> media path it is the sidecar of
+	meta    map[string]*googleMetadata // JSON path -> parsed metadata
+}
+
+func (t *takeoutIndex) dir(dir string) *takeoutDir {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.dirs[dir]
+	if !ok {
+		d = loadTakeoutDir(dir)
+		t.dirs[dir] = d
+	}
+	return d
+}
+
+// metadata returns the Google metadata of a media file, nil if it has none
+func (t *takeoutIndex) metadata(path string) *googleMetadata {
+	d := t.dir(filepath.Dir(path))
+	return d.meta[d.jsonFor[path]]
+}
+
+// album returns the album a media file was exported in, "" if none
+func (t *takeoutIndex) album(path string) string {
+	return t.dir(filepath.Dir(path)).album
+}
+
+// sidecarOwner returns the media file a JSON file is the sidecar of, "" if none
+func (t *takeoutIndex) sidecarOwner(path string) string {
+	return t.dir(filepath.Dir(path)).owner[path]
+}
+
+// splitCopySuffix splits "name(1)" into "name" and "1"
+func splitCopySuffix(s string) (string, string) {
+	if m := takeoutCopySuffix.FindStringSubmatch(s); m != nil {
+		return m[1], m[2]
+	}
+	return s, ""
+}
+
+// takeoutNames returns the names a JSON sidecar of media may have, before any
+// truncation, and the copy number both carry: IMG_1(1).jpg is described by IMG_1.jpg(1).json
+func takeoutNames(media string) ([]string, string) {
+	ext := filepath.Ext(media)
+	stem, n := splitCopySuffix(strings.TrimSuffix(media, ext))
+	full := stem + ext
+	return []string{full, full + ".supplemental-metadata", stem}, n
+}
+
+// loadTakeoutDir matches the media of dir with their JSON files. Exact names
+// win over truncated ones, which win over the title recorded in the JSON.
+// Edited copies and the video of a Live Photo borrow the JSON of their original.
+func loadTakeoutDir(dir string) *takeoutDir {
+	d := &takeoutDir{
+		jsonFor: make(map[string]string),
+		owner:   make(map[string]string),
+		meta:    make(map[string]*googleMetadata),
+	}
+	// Albums are the folders of "Google Photos" other than the year folders;
+	// their metadata.json has the title, else the folder is named after the
+	// album. Tags are stored comma-separated.
+	if !takeoutYearFolder.MatchString(filepath.Base(dir)) {
+		data, err := readSourceFile(filepath.Join(dir, "metadata.json"))
+		if err == nil {
+			var album struct {
+				Title string `json:"title"`
+			}
+			if json.Unmarshal(data, &album) == nil {
+				d.album = strings.TrimSpace(album.Title)
+			}
+		}
+		if d.album == "" && (err == nil || filepath.Base(filepath.Dir(dir)) == "Google Photos") {
+			d.album = filepath.Base(dir)
+		}
+		d.album = strings.Join(strings.Fields(strings.ReplaceAll(d.album, ",", " ")), " ")
+	}
+
+	entries, err := readSourceDir(dir)
+	if err != nil {
+		return d
+	}
+	var media, jsons []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), "._") {
+			continue
+		}
+		name := e.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		switch {
+		case ext == ".json" && !takeoutIndexFiles[strings.ToLower(name)]:
+			data, err := readSourceFile(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			gm, err := parseGoogleJSON(data)
+			if err != nil {
+				continue
+			}
+			d.meta[filepath.Join(dir, name)] = gm
+			jsons = append(jsons, name)
+		case isImageExt(ext) || isVideoExt(ext) || rawExts[ext]:
+			media = append(media, name)
+		}
+	}
+
+	match := func(m, j string) {
+		mp, jp := filepath.Join(dir, m), filepath.Join(dir, j)
+		d.jsonFor[mp] = jp
+		d.owner[jp] = mp
+	}
+	unmatched := func() []string {
+		var out []string
+		for _, m := range media {
+			if _, ok := d.jsonFor[filepath.Join(dir, m)]; !ok {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	free := func(j string) bool {
+		_, taken := d.owner[filepath.Join(dir, j)]
+		return !taken
+	}
+	passes := []func(m, j string) bool{
+		// Exact: IMG_1.jpg.json, IMG_1.jpg.supplemental-metadata.json, IMG_1.json
+		func(m, j string) bool {
+			names, n := takeoutNames(m)
+			stem, jn := splitCopySuffix(strings.TrimSuffix(j, filepath.Ext(j)))
+			if n != jn {
+				return false
+			}
+			for _, name := range names {
+				if strings.EqualFold(stem, name) {
+					return true
+				}
+			}
+			return false
+		},
+		// Truncated: the JSON name is cut to takeoutNameLimit characters
+		func(m, j string) bool {
+			names, n := takeoutNames(m)
+			stem, jn := splitCopySuffix(strings.TrimSuffix(j, filepath.Ext(j)))
+			if n != jn || len(stem) < takeoutNameLimit-1 {
+				return false
+			}
+			for _, name := range names[:2] {
+				if len(name) > len(stem) && strings.EqualFold(name[:len(stem)], stem) {
+					return true
+				}
+			}
+			return false
+		},
+		// Title: the media name itself was cut; the JSON keeps the original one
+		func(m, j string) bool {
+			title := d.meta[filepath.Join(dir, j)].Title
+			if title == "" {
+				return false
+			}
+			if strings.EqualFold(title, m) {
+				return true
+			}
+			ext := filepath.Ext(m)
+			stem := strings.TrimSuffix(m, ext)
+			return len(m) >= takeoutNameLimit-len(ext) && strings.EqualFold(filepath.Ext(title), ext) &&
+				len(title) > len(stem) && strings.EqualFold(title[:len(stem)], stem)
+		},
+	}
+	for _, pass := range passes {
+		for _, m := range unmatched() {
+			for _, j := range jsons {
+				if free(j) && pass(m, j) {
+					match(m, j)
+					break
+				}
+			}
+		}
+	}
+
+	// Edited copies and Live Photo videos read the JSON of the original but do not own it
+	originals := make(map[string]string) // lower-cased stem -> JSON path
+	for _, m := range media {
+		if jp, ok := d.jsonFor[filepath.Join(dir, m)]; ok {
+			originals[strings.ToLower(strings.TrimSuffix(m, filepath.Ext(m)))] = jp
+		}
+	}
+	for _, m := range unmatched() {
+		stem := strings.TrimSuffix(m, filepath.Ext(m))
+		if loc := takeoutEdited.FindStringIndex(stem); loc != nil {
+			stem = stem[:loc[0]]
+		}
+		if jp, ok := originals[strings.ToLower(stem)]; ok {
+			d.jsonFor[filepath.Join(dir, m)] = jp
+		}
+	}
+	return d
+}
+
+// applyTakeoutMetadata fills what Takeout stripped from a file's metadata
+// with the JSON values: capture time and location when missing, and the caption
+func applyTakeoutMetadata(metadata string, gm *googleMetadata) string {
+	if gm == nil {
+		return metadata
+	}
+	obj := map[string]interface{}{}
+	if metadata != "" {
+		_ = json.Unmarshal([]byte(metadata), &obj)
+	}
+	if t, ok := gm.takenAt(); ok {
+		if s, _ := obj["DateTimeOriginal"].(string); s == "" || strings.HasPrefix(s, "0001-01-01") {
+			obj["DateTimeOriginal"] = t
+		}
+	}
+	if has, _ := obj["HasLocation"].(bool); !has {
+		sm := gm.sidecarMetadata("")
+		if sm.HasLocation {
+			obj["Latitude"], obj["Longitude"], obj["HasLocation"] = sm.Latitude, sm.Longitude, true
+		}
+	}
+	if gm.Description != "" {
+		obj["Caption"] = gm.Description
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return metadata
+	}
+	return string(b)
+}
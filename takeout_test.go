@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTakeoutDirMatchesJSON(t *testing.T) {
+	long := strings.Repeat("a", 40) + "_photo" // IMG names past the 47-character limit
+	cut := func(name string) string { return name[:takeoutNameLimit] }
+	title := strings.Repeat("b", 60) + ".jpg"
+
+	tests := []struct {
+		name  string
+		media []string
+		jsons map[string]string // JSON name -> title
+		want  map[string]string // media name -> JSON name
+	}{
+		{
+			name:  "exact",
+			media: []string{"IMG_1.jpg"},
+			jsons: map[string]string{"IMG_1.jpg.json": "IMG_1.jpg"},
+			want:  map[string]string{"IMG_1.jpg": "IMG_1.jpg.json"},
+		},
+		{
+			name:  "supplemental metadata",
+			media: []string{"IMG_1.jpg"},
+			jsons: map[string]string{"IMG_1.jpg.supplemental-metadata.json": ""},
+			want:  map[string]string{"IMG_1.jpg": "IMG_1.jpg.supplemental-metadata.json"},
+		},
+		{
+			name:  "without extension",
+			media: []string{"IMG_1.jpg"},
+			jsons: map[string]string{"IMG_1.json": ""},
+			want:  map[string]string{"IMG_1.jpg": "IMG_1.json"},
+		},
+		{
+			name:  "case differs",
+			media: []string{"img_1.JPG"},
+			jsons: map[string]string{"IMG_1.jpg.json": ""},
+			want:  map[string]string{"img_1.JPG": "IMG_1.jpg.json"},
+		},
+		{
+			name:  "repeated names",
+			media: []string{"IMG_1.jpg", "IMG_1(1).jpg"},
+			jsons: map[string]string{"IMG_1.jpg.json": "", "IMG_1.jpg(1).json": ""},
+			want:  map[string]string{"IMG_1.jpg": "IMG_1.jpg.json", "IMG_1(1).jpg": "IMG_1.jpg(1).json"},
+		},
+		{
+			name:  "copy number must agree",
+			media: []string{"IMG_1(2).jpg"},
+			jsons: map[string]string{"IMG_1.jpg(1).json": ""},
+			want:  map[string]string{},
+		},
+		{
+			name:  "truncated",
+			media: []string{long + ".jpg"},
+			jsons: map[string]string{cut(long+".jpg.supplemental-metadata") + ".json": ""},
+			want:  map[string]string{long + ".jpg": cut(long+".jpg.supplemental-metadata") + ".json"},
+		},
+		{
+			name:  "truncated repeated name",
+			media: []string{long + ".jpg", long + "(1).jpg"},
+			jsons: map[string]string{
+				cut(long+".jpg.supplemental-metadata") + ".json":    "",
+				cut(long+".jpg.supplemental-metadata") + "(1).json": "",
+			},
+			want: map[string]string{
+				long + ".jpg":    cut(long+".jpg.supplemental-metadata") + ".json",
+				long + "(1).jpg": cut(long+".jpg.supplemental-metadata") + "(1).json",
+			},
+		},
+		{
+			name:  "too short to be truncated",
+			media: []string{long + ".jpg"},
+			jsons: map[string]string{long[:20] + ".json": ""},
+			want:  map[string]string{},
+		},
+		{
+			name:  "media name cut, title kept",
+			media: []string{title[:takeoutNameLimit-4] + ".jpg"},
+			jsons: map[string]string{"other.json": title},
+			want:  map[string]string{title[:takeoutNameLimit-4] + ".jpg": "other.json"},
+		},
+		{
+			name:  "edited copy borrows the original's",
+			media: []string{"IMG_1.jpg", "IMG_1-edited.jpg"},
+			jsons: map[string]string{"IMG_1.jpg.json": ""},
+			want:  map[string]string{"IMG_1.jpg": "IMG_1.jpg.json", "IMG_1-edited.jpg": "IMG_1.jpg.json"},
+		},
+		{
+			name:  "album metadata is not a sidecar",
+			media: []string{"metadata.jpg"},
+			jsons: map[string]string{"metadata.json": "Trip"},
+			want:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, m := range tt.media {
+				if err := os.WriteFile(filepath.Join(dir, m), []byte("media"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for j, title := range tt.jsons {
+				if err := os.WriteFile(filepath.Join(dir, j), []byte(`{"title":"`+title+`"}`), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := loadTakeoutDir(dir)
+			for m, j := range tt.want {
+				if got := d.jsonFor[filepath.Join(dir, m)]; got != filepath.Join(dir, j) {
+					t.Errorf("JSON of %s = %q, want %q", m, got, filepath.Join(dir, j))
+				}
+			}
+			if len(d.jsonFor) != len(tt.want) {
+				t.Errorf("matched %d media files, want %d: %v", len(d.jsonFor), len(tt.want), d.jsonFor)
+			}
+		})
+	}
+}
+
+func TestSplitCopySuffix(t *testing.T) {
+	tests := []struct {
+		in, stem, n string
+	}{
+		{"IMG_1", "IMG_1", ""},
+		{"IMG_1(1)", "IMG_1", "1"},
+		{"IMG_1.jpg(12)", "IMG_1.jpg", "12"},
+		{"IMG_(a)", "IMG_(a)", ""},
+		{"(3)", "", "3"},
+	}
+	for _, tt := range tests {
+		if stem, n := splitCopySuffix(tt.in); stem != tt.stem || n != tt.n {
+			t.Errorf("splitCopySuffix(%q) = %q, %q, want %q, %q", tt.in, stem, n, tt.stem, tt.n)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the largest read the throttle lets through at once, so a
+// single read never takes much more than its share of the bandwidth
+const throttleChunk = 256 << 10
+
+// ThrottleLimits caps the reads of a job. An operation is one read of up to 256 KiB.
+type ThrottleLimits struct {
+	Bandwidth int64 `json:"bandwidth"` // bytes per second, 0 = unlimited
+	IOPS      int64 `json:"iops"`      // read operations per second, 0 = unlimited
+}
+
+func (l ThrottleLimits) validate() error {
+	if l.Bandwidth < 0 || l.IOPS < 0 {
+		return fmt.Errorf("invalid throttle limits: bandwidth %d, iops %d", l.Bandwidth, l.IOPS)
+	}
+	return nil
+}
+
+// ioThrottle paces the copy and hash reads of one job, across all of its
+// workers. Each read books its bytes and one operation on a schedule; a read
+// whose slot is in the future waits for it. A second of unused budget may be
+// spent at once.
+type ioThrottle struct {
+	ctx     context.Context // the job's; cancelling it stops every wait
+	mu      sync.Mutex
+	limits  ThrottleLimits
+	bytesAt time.Time     // time the booked bytes are paid up to
+	opsAt   time.Time     // time the booked operations are paid up to
+	changed chan struct{} // closed when the limits change, so waits recompute
+}
+
+func newIOThrottle(ctx context.Context, limits ThrottleLimits) *ioThrottle {
+	return &ioThrottle{ctx: ctx, limits: limits, changed: make(chan struct{})}
+}
+
+// Limits returns the current limits
+func (t *ioThrottle) Limits() ThrottleLimits {
+	if t == nil {
+		return ThrottleLimits{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+// set changes the limits; reads waiting under the old ones go ahead
+func (t *ioThrottle) set(limits ThrottleLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = limits
+	now := time.Now()
+	t.bytesAt, t.opsAt = now, now
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// book schedules n units at rate per second after at and returns the time they are paid up
+func book(at *time.Time, now time.Time, n, rate int64) time.Time {
+	if rate <= 0 {
+		return now
+	}
+	if earliest := now.Add(-time.Second); at.Before(earliest) {
+		*at = earliest
+	}
+	*at = at.Add(time.Duration(n * int64(time.Second) / rate))
+	return *at
+}
+
+// wait blocks until a read of n bytes fits in the limits. It returns
+// errJobCancelled once the job is cancelled.
+func (t *ioThrottle) wait(n int) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	now := time.Now()
+	until := book(&t.bytesAt, now, int64(n), t.limits.Bandwidth)
+	if ops := book(&t.opsAt, now, 1, t.limits.IOPS); ops.After(until) {
+		until = ops
+	}
+	changed := t.changed
+	t.mu.Unlock()
+
+	d := time.Until(until)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-changed:
+		return nil
+	case <-t.ctx.Done():
+		return errJobCancelled
+	}
+}
+
+// reader paces reads from r; a nil throttle returns r as it is
+func (t *ioThrottle) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *ioThrottle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := tr.t.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// WriteTo copies in reads of throttleChunk, so io.Copy counts operations of that size
+func (tr *throttledReader) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, throttleChunk)
+	var written int64
+	for {
+		n, err := tr.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -19,12 +19,12 @@ func isImageFile(filename string) bool {
 	return false
 }
 
-// generateThumbnail generates a thumbnail for an image file
-func generateThumbnail(srcPath, destPath string, maxSize int) error {
+// generateThumbnail generates a thumbnail for an image file and returns its perceptual hash
+func generateThumbnail(srcPath, destPath string, maxSize int) (string, error) {
 	// Open the source image
 	srcImg, err := imaging.Open(srcPath)
 	if err != nil {
-		return fmt.Errorf("failed to open image: %w", err)
+		return "", fmt.Errorf("failed to open image: %w", err)
 	}
 
 	// Get image bounds
@@ -46,11 +46,13 @@ func generateThumbnail(srcPath, destPath string, maxSize int) error {
 
 	// Resize the image
 	thumbImg := imaging.Resize(srcImg, thumbWidth, thumbHeight, imaging.Lanczos)
+	// Hash the thumbnail rather than the original so an existing thumbnail gives the same result
+	phash := formatPHash(dHash(thumbImg))
 
 	// Ensure the destination directory exists
 	destDir := filepath.Dir(destPath)
 	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+		return "", fmt.Errorf("failed to create thumbnail directory: %w", err)
 	}
 
 	// Save the thumbnail
@@ -68,18 +70,19 @@ func generateThumbnail(srcPath, destPath string, maxSize int) error {
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to save thumbnail: %w", err)
+		return "", fmt.Errorf("failed to save thumbnail: %w", err)
 	}
 
-	return nil
+	return phash, nil
 }
 
 // processThumbnail generates a thumbnail for an image file and returns the relative thumbnail path
-// Returns empty string if thumbnail generation is skipped or fails
-func processThumbnail(originalPath string, destFolder string) (string, error) {
+// and the image's perceptual hash
+// Returns empty strings if thumbnail generation is skipped or fails
+func processThumbnail(originalPath string, destFolder string) (string, string, error) {
 	// Check if file is an image
 	if !isImageFile(originalPath) {
-		return "", nil
+		return "", "", nil
 	}
 
 	// Determine thumbnail directory (default: dest/.thumbnails)
@@ -105,19 +108,21 @@ func processThumbnail(originalPath string, destFolder string) (string, error) {
 	if _, err := os.Stat(thumbPath); err == nil {
 		// Thumbnail exists, return relative path
 		if relThumbPath, err := filepath.Rel(destFolder, thumbPath); err == nil {
-			return filepath.ToSlash(relThumbPath), nil
+			phash, _ := perceptualHashFile(thumbPath)
+			return filepath.ToSlash(relThumbPath), phash, nil
 		}
 	}
 
 	// Generate thumbnail (default size: 200px)
-	if err := generateThumbnail(originalPath, thumbPath, 200); err != nil {
-		return "", fmt.Errorf("thumbnail generation failed for %s: %w", filepath.Base(originalPath), err)
+	phash, err := generateThumbnail(originalPath, thumbPath, 200)
+	if err != nil {
+		return "", "", fmt.Errorf("thumbnail generation failed for %s: %w", filepath.Base(originalPath), err)
 	}
 
 	// Return relative path from destination folder
 	if relThumbPath, err := filepath.Rel(destFolder, thumbPath); err == nil {
-		return filepath.ToSlash(relThumbPath), nil
+		return filepath.ToSlash(relThumbPath), phash, nil
 	}
 
-	return "", nil
+	return "", phash, nil
 }
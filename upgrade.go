@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Quality upgrade modes for ProcessingConfig.Upgrade
+const (
+	UpgradeNone    = "none"    // a better copy of a library image is imported as a new file
+	UpgradeReplace = "replace" // a better copy replaces the library file in place
+)
+
+// upgradeMaxDistance is how close the perceptual hashes of an incoming image and
+// a library image must be for them to count as the same picture
+const upgradeMaxDistance = 4
+
+func (c ProcessingConfig) upgradeMode() string {
+	if c.Upgrade != "" {
+		return c.Upgrade
+	}
+	return UpgradeNone
+}
+
+func validateUpgradeMode(s string) error {
+	switch s {
+	case UpgradeNone, UpgradeReplace:
+		return nil
+	}
+	return fmt.Errorf("unknown upgrade mode %q (expected %s or %s)", s, UpgradeNone, UpgradeReplace)
+}
+
+// upgradeTarget is the library file an incoming better copy replaces
+type upgradeTarget struct {
+	id            int64
+	destPath      string
+	thumbnailPath string
+	trashPath     string // where the replaced version went, set once it is trashed
+}
+
+// upgradeIndex holds the perceptual hashes of the library, loaded once per scan
+type upgradeIndex struct {
+	once   sync.Once
+	tree   bkTree
+	hashes map[int64]uint64
+	err    error
+}
+
+func (u *upgradeIndex) load(db *DB, destFolder string) error {
+	u.once.Do(func() {
+		if u.err = backfillPerceptualHashes(db, destFolder); u.err != nil {
+			return
+		}
+		if u.hashes, u.err = db.listPerceptualHashes(); u.err != nil {
+			return
+		}
+		for id, h := range u.hashes {
+			u.tree.add(h, id)
+		}
+	})
+	return u.err
+}
+
+// betterCopy reports whether src is a higher-quality version of lib: more
+// pixels, richer EXIF or more bytes for the same pixels, and never worse in any of them
+func betterCopy(src, lib DuplicateFile) bool {
+	ps, pl := src.Width*src.Height, lib.Width*lib.Height
+	if ps == 0 || ps < pl || src.ExifFields < lib.ExifFields {
+		return false
+	}
+	return ps > pl || src.ExifFields > lib.ExifFields || src.Size > lib.Size
+}
+
+// findUpgradeTarget looks for the library image an incoming image is a better
+// copy of. The closest perceptual match is compared; nil means none.
+func findUpgradeTarget(db *DB, config ProcessingConfig, state *scanState, fileInfo FileInfo) (*OutcomingRow, error) {
+	if !isImageFile(fileInfo.srcPath) {
+		return nil, nil
+	}
+	if err := state.upgrades.load(db, config.DestFolder); err != nil {
+		return nil, err
+	}
+	f, _, err := openSource(fileInfo.srcPath)
+	if err != nil {
+		return nil, nil
+	}
+	img, err := imaging.Decode(config.throttle().reader(f))
+	f.Close()
+	if err != nil {
+		return nil, nil
+	}
+	phash := dHash(img)
+	bestID, bestDist := int64(0), upgradeMaxDistance+1
+	state.upgrades.tree.within(phash, upgradeMaxDistance, func(id int64) {
+		if d := hammingDistance(phash, state.upgrades.hashes[id]); d < bestDist || (d == bestDist && id < bestID) {
+			bestID, bestDist = id, d
+		}
+	})
+	if bestID == 0 {
+		return nil, nil
+	}
+	row, err := db.getOutcomingByIDRow(bestID)
+	if err != nil || row == nil {
+		return nil, err
+	}
+	src := describeDuplicate(OutcomingRow{
+		DestPath:   fileInfo.srcPath,
+		Size:       fileInfo.size,
+		Metadata:   BuildMetadataJSON(fileInfo.srcPath),
+		ModifiedAt: fileInfo.modifiedAt.Format(time.RFC3339),
+	}, bestDist)
+	if !betterCopy(src, describeDuplicate(*row, bestDist)) {
+		return nil, nil
+	}
+	return row, nil
+}
+
+// upgradeDestPath keeps the library file's folder and name and takes the
+// incoming file's extension, so a JPEG replaced by a PNG becomes name.png
+func upgradeDestPath(libPath, srcPath string) string {
+	libExt, srcExt := filepath.Ext(libPath), filepath.Ext(srcPath)
+	if strings.EqualFold(libExt, srcExt) {
+		return libPath
+	}
+	return strings.TrimSuffix(libPath, libExt) + srcExt
+}
+
+// claimUpgrade marks fileInfo as replacing row and reserves its destination.
+// Returns false if another file of this scan already replaces row.
+func claimUpgrade(config ProcessingConfig, state *scanState, row OutcomingRow, fileInfo *FileInfo) (bool, error) {
+	if !state.claims.claim(fmt.Sprintf("upgrade:%d", row.ID)) {
+		return false, nil
+	}
+	dstPath := upgradeDestPath(row.DestPath, fileInfo.srcPath)
+	if dstPath == row.DestPath {
+		state.dests.hold(dstPath)
+	} else {
+		resolved, err := resolveCollision(config, state.dests, dstPath, fileInfo.hash)
+		if err != nil {
+			fileInfo.collision = true
+			fileInfo.destPath = dstPath
+			return false, err
+		}
+		fileInfo.collision = resolved != dstPath
+		dstPath = resolved
+	}
+	fileInfo.destPath = dstPath
+	fileInfo.replaces = &upgradeTarget{id: row.ID, destPath: row.DestPath, thumbnailPath: row.ThumbnailPath}
+	return true, nil
+}
+
+// trashReplacedVersion moves the library file being upgraded to the library
+// trash. The trash path goes into ledger row incomingID first, so that a
+// crash mid-upgrade can be finished or undone.
+func trashReplacedVersion(db *DB, config ProcessingConfig, incomingID int64, target *upgradeTarget) error {
+	if !pathExists(target.destPath) {
+		return nil
+	}
+	trashPath := libraryTrashTarget(config.DestFolder, target.destPath, time.Now())
+	if err := ensureDirectory(filepath.Dir(trashPath)); err != nil {
+		return err
+	}
+	if err := db.setIncomingTrashPath(incomingID, trashPath); err != nil {
+		return err
+	}
+	if err := moveFile(target.destPath, trashPath); err != nil {
+		return fmt.Errorf("failed to trash %s: %w", target.destPath, err)
+	}
+	target.trashPath = trashPath
+	return nil
+}
+
+// dropReplacedThumbnail deletes the thumbnail of the replaced version so that one is generated for the new file
+func dropReplacedThumbnail(config ProcessingConfig, target *upgradeTarget) {
+	if target.thumbnailPath != "" {
+		_ = os.Remove(filepath.Join(config.DestFolder, filepath.FromSlash(target.thumbnailPath)))
+	}
+}
+
+// restoreReplacedVersion puts the library file back after a failed upgrade
+func restoreReplacedVersion(target *upgradeTarget) {
+	if target.trashPath == "" {
+		return
+	}
+	if err := moveFile(target.trashPath, target.destPath); err != nil {
+		fmt.Println("failed to restore", target.destPath, "from", target.trashPath, ":", err)
+		return
+	}
+	target.trashPath = ""
+}
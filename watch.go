@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchOptions tunes how the incoming folder is watched
+type WatchOptions struct {
+	PollInterval time.Duration // polling backend scan interval, default 10s
+	StableFor    time.Duration // a file is imported once its size and mtime are unchanged this long, default 5s
+	ForcePolling bool          // use the polling backend even where inotify is available
+}
+
+func (o WatchOptions) pollInterval() time.Duration {
+	if o.PollInterval > 0 {
+		return o.PollInterval
+	}
+	return 10 * time.Second
+}
+
+func (o WatchOptions) stableFor() time.Duration {
+	if o.StableFor > 0 {
+		return o.StableFor
+	}
+	return 5 * time.Second
+}
+
+// WatchStatus is the state of the watcher, exposed next to ScanStatus
+type WatchStatus struct {
+	Running       bool      `json:"running"`
+	Backend       string    `json:"backend"`       // inotify or polling
+	Src           string    `json:"src"`           // watched folder
+	Pending       int       `json:"pending"`       // files waiting for their size to settle
+	Batches       int64     `json:"batches"`       // import batches run so far
+	FilesQueued   int64     `json:"filesQueued"`   // files handed to the pipeline so far
+	LastBatchTime time.Time `json:"lastBatchTime"` // when the last batch finished
+	Error         string    `json:"error"`         // last watcher error
+}
+
+// watchBackend reports paths that may have been created or changed under a root
+type watchBackend interface {
+	name() string
+	// run sends changed paths to out until stop is closed. It starts by sending
+	// every file that already exists so nothing dropped before startup is missed.
+	run(out chan<- string, stop <-chan struct{}) error
+}
+
+// pendingFile tracks a file until it has stopped changing
+type pendingFile struct {
+	size   int64
+	mtime  time.Time
+	stable time.Time // last time size or mtime changed
+}
+
+// Watcher imports files dropped into SrcFolder as soon as they finish writing
+type Watcher struct {
+	config  ProcessingConfig
+	options WatchOptions
+	backend watchBackend
+	skipDir func(path string, info os.FileInfo) bool
+
+	mu      sync.Mutex
+	status  WatchStatus
+	pending map[string]*pendingFile
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newWatcher validates the config and picks inotify where available, polling otherwise
+func newWatcher(config ProcessingConfig, options WatchOptions) (*Watcher, error) {
+	if config.DryRun {
+		return nil, errors.New("dry-run is not supported in watch mode")
+	}
+	if config.SrcFolder == "" || config.DestFolder == "" {
+		return nil, errors.New("src and dest are required")
+	}
+	if _, err := os.Stat(config.SrcFolder); err != nil {
+		return nil, err
+	}
+	filter, err := compileFilters(config.SrcFolder, config.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filters: %w", err)
+	}
+	skip := func(path string, info os.FileInfo) bool {
+		if path == config.SrcFolder {
+			return false
+		}
+		return path == config.trashFolder() || path == config.DestFolder || filter.skipDir(path, info)
+	}
+
+	var backend watchBackend
+	if !options.ForcePolling {
+		if b, err := newInotifyBackend(config.SrcFolder, skip); err == nil {
+			backend = b
+		} else {
+			fmt.Println("inotify unavailable, falling back to polling:", err)
+		}
+	}
+	if backend == nil {
+		backend = newPollingBackend(config, options, skip)
+	}
+
+	return &Watcher{
+		config:  config,
+		options: options,
+		backend: backend,
+		skipDir: skip,
+		pending: make(map[string]*pendingFile),
+		status:  WatchStatus{Backend: backend.name(), Src: config.SrcFolder},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start runs the watcher in the background until Stop is called
+func (w *Watcher) Start() {
+	w.mu.Lock()
+	w.status.Running = true
+	w.mu.Unlock()
+	go w.loop()
+}
+
+// Stop stops the watcher and waits for an in-flight batch to finish
+func (w *Watcher) Stop() {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+}
+
+// Done is closed once the watcher has stopped
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Status returns a snapshot of the watcher state
+func (w *Watcher) Status() WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.status
+	st.Pending = len(w.pending)
+	return st
+}
+
+func (w *Watcher) setError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Error = err.Error()
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	defer func() {
+		w.mu.Lock()
+		w.status.Running = false
+		w.mu.Unlock()
+	}()
+
+	changes := make(chan string, 4096)
+	go w.runBackend(changes)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	fmt.Println("Watching", w.config.SrcFolder, "using", w.backend.name())
+	for {
+		select {
+		case <-w.stop:
+			return
+		case path := <-changes:
+			w.touch(path)
+		case <-ticker.C:
+			if ready := w.stableFiles(); len(ready) > 0 {
+				w.importBatch(ready)
+			}
+		}
+	}
+}
+
+// runBackend feeds changes from the backend until the watcher stops. A failed
+// inotify backend (out of watches, for one) is replaced by polling; if polling
+// fails too the watcher is reported as no longer running.
+func (w *Watcher) runBackend(changes chan<- string) {
+	backend := w.backend
+	for {
+		err := backend.run(changes, w.stop)
+		if err == nil {
+			return
+		}
+		fmt.Println("watch backend", backend.name(), "stopped:", err)
+		w.mu.Lock()
+		w.status.Error = fmt.Sprintf("%s: %v", backend.name(), err)
+		if _, ok := backend.(*pollingBackend); ok {
+			w.status.Running = false
+			w.mu.Unlock()
+			return
+		}
+		backend = newPollingBackend(w.config, w.options, w.skipDir)
+		w.status.Backend = backend.name()
+		w.mu.Unlock()
+		fmt.Println("Watching", w.config.SrcFolder, "using", backend.name())
+	}
+}
+
+// touch (re)starts the settle timer for a path
+func (w *Watcher) touch(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[path] = &pendingFile{size: info.Size(), mtime: info.ModTime(), stable: time.Now()}
+}
+
+// stableFiles returns (and forgets) pending files whose size and mtime have settled
+func (w *Watcher) stableFiles() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	var ready []string
+	for path, p := range w.pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if info.Size() != p.size || !info.ModTime().Equal(p.mtime) {
+			p.size, p.mtime, p.stable = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(p.stable) >= w.options.stableFor() {
+			ready = append(ready, path)
+			delete(w.pending, path)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// importBatch runs the regular pipeline over a set of settled files
+func (w *Watcher) importBatch(paths []string) {
+	config := w.config
+	config.files = paths
+	job, err := startProcessing(config)
+	if err != nil {
+		fmt.Println("watch import failed:", err)
+		w.setError(err)
+		return
+	}
+	<-job.Done()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Batches++
+	w.status.FilesQueued += int64(len(paths))
+	w.status.LastBatchTime = time.Now()
+}
+
+// pollingBackend rescans the tree periodically and reports files whose size or mtime changed
+type pollingBackend struct {
+	root     string
+	interval time.Duration
+	skipDir  func(path string, info os.FileInfo) bool
+}
+
+func newPollingBackend(config ProcessingConfig, options WatchOptions, skipDir func(path string, info os.FileInfo) bool) *pollingBackend {
+	return &pollingBackend{root: config.SrcFolder, interval: options.pollInterval(), skipDir: skipDir}
+}
+
+func (b *pollingBackend) name() string { return "polling" }
+
+func (b *pollingBackend) run(out chan<- string, stop <-chan struct{}) error {
+	seen := make(map[string]pendingFile)
+	for {
+		current := make(map[string]pendingFile, len(seen))
+		err := filepath.Walk(b.root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Files can vanish mid-walk; keep going
+				return nil
+			}
+			if info.IsDir() {
+				if b.skipDir(path, info) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			current[path] = pendingFile{size: info.Size(), mtime: info.ModTime()}
+			if prev, ok := seen[path]; !ok || prev.size != info.Size() || !prev.mtime.Equal(info.ModTime()) {
+				select {
+				case out <- path:
+				case <-stop:
+					return errWatchStopped
+				}
+			}
+			return nil
+		})
+		if err == errWatchStopped {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seen = current
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(b.interval):
+		}
+	}
+}
+
+// errWatchStopped aborts a walk when the watcher is stopped
+var errWatchStopped = errors.New("watch stopped")
+
+// activeWatch is the watcher started through the API, if any
+var activeWatch struct {
+	mu      sync.Mutex
+	watcher *Watcher
+}
+
+// startWatch starts the server-wide watcher; it fails if one is already running
+func startWatch(config ProcessingConfig, options WatchOptions) (*Watcher, error) {
+	activeWatch.mu.Lock()
+	defer activeWatch.mu.Unlock()
+	if w := activeWatch.watcher; w != nil && w.Status().Running {
+		return nil, fmt.Errorf("already watching %s", w.config.SrcFolder)
+	}
+	w, err := newWatcher(config, options)
+	if err != nil {
+		return nil, err
+	}
+	w.Start()
+	activeWatch.watcher = w
+	return w, nil
+}
+
+// stopWatch stops the server-wide watcher; returns false if none was running
+func stopWatch() bool {
+	activeWatch.mu.Lock()
+	w := activeWatch.watcher
+	activeWatch.mu.Unlock()
+	if w == nil {
+		return false
+	}
+	w.Stop()
+	return true
+}
+
+// currentWatchStatus returns the status of the server-wide watcher, or nil
+func currentWatchStatus() *WatchStatus {
+	activeWatch.mu.Lock()
+	w := activeWatch.watcher
+	activeWatch.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	st := w.Status()
+	return &st
+}
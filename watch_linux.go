@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MODIFY | syscall.IN_DELETE_SELF
+
+// inotifyBackend watches every directory under root with inotify
+type inotifyBackend struct {
+	fd      int
+	root    string
+	skipDir func(path string, info os.FileInfo) bool
+
+	mu  sync.Mutex
+	wds map[int32]string
+}
+
+func newInotifyBackend(root string, skipDir func(path string, info os.FileInfo) bool) (watchBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &inotifyBackend{fd: fd, root: root, skipDir: skipDir, wds: make(map[int32]string)}, nil
+}
+
+func (b *inotifyBackend) name() string { return "inotify" }
+
+// addTree watches dir and its subdirectories and reports the files already in them
+func (b *inotifyBackend) addTree(dir string, out chan<- string, stop <-chan struct{}) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != b.root && b.skipDir(path, info) {
+				return filepath.SkipDir
+			}
+			wd, werr := syscall.InotifyAddWatch(b.fd, path, inotifyMask)
+			if werr == syscall.ENOENT || werr == syscall.ENOTDIR {
+				// Removed or replaced since it was listed
+				return filepath.SkipDir
+			}
+			if werr != nil {
+				return werr
+			}
+			b.mu.Lock()
+			b.wds[int32(wd)] = path
+			b.mu.Unlock()
+			return nil
+		}
+		select {
+		case out <- path:
+		case <-stop:
+			return errWatchStopped
+		}
+		return nil
+	})
+	if err == errWatchStopped {
+		return nil
+	}
+	return err
+}
+
+func (b *inotifyBackend) run(out chan<- string, stop <-chan struct{}) error {
+	defer syscall.Close(b.fd)
+	if err := b.addTree(b.root, out, stop); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		n, err := syscall.Read(b.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were dropped: rescan everything
+				if err := b.addTree(b.root, out, stop); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b.mu.Lock()
+			dir, ok := b.wds[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(b.wds, ev.Wd)
+			}
+			b.mu.Unlock()
+			if !ok || len(nameBytes) == 0 {
+				continue
+			}
+			path := filepath.Join(dir, string(bytes.TrimRight(nameBytes, "\x00")))
+
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// Files may land in a new directory before it is watched
+					if err := b.addTree(path, out, stop); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			select {
+			case out <- path:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
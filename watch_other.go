@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// newInotifyBackend is only available on Linux; other platforms use polling
+func newInotifyBackend(root string, skipDir func(path string, info os.FileInfo) bool) (watchBackend, error) {
+	return nil, errors.New("inotify is only supported on linux")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingBackend stops at once, the way inotify does when it runs out of watches
+type failingBackend struct{}
+
+func (failingBackend) name() string { return "inotify" }
+
+func (failingBackend) run(out chan<- string, stop <-chan struct{}) error {
+	return syscall.ENOSPC
+}
+
+func TestWatcherFallsBackToPolling(t *testing.T) {
+	w, err := newWatcher(ProcessingConfig{SrcFolder: t.TempDir(), DestFolder: t.TempDir()}, WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backend = failingBackend{}
+	w.Start()
+	defer w.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Status().Backend != "polling" {
+		if time.Now().After(deadline) {
+			t.Fatalf("status %+v, want the polling backend", w.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := w.Status(); !st.Running || st.Error == "" {
+		t.Errorf("status %+v, want running with the inotify error", st)
+	}
+}